@@ -0,0 +1,34 @@
+module github.com/tankcdr/ppe-kafka-go/cmd/replay
+
+go 1.23.2
+
+require (
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/tankcdr/ppe-kafka-go/events v0.0.0
+	github.com/tankcdr/ppe-kafka-go/kafka v0.0.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/gofrs/uuid v4.4.0+incompatible // indirect
+	github.com/hamba/avro/v2 v2.27.0 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/klauspost/compress v1.17.11 // indirect
+	github.com/mitchellh/mapstructure v1.5.0 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/pierrec/lz4/v4 v4.1.22 // indirect
+	github.com/twmb/franz-go v1.18.1 // indirect
+	github.com/twmb/franz-go/pkg/kmsg v1.9.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.1.0 // indirect
+	go.opentelemetry.io/otel v1.34.0 // indirect
+	go.opentelemetry.io/otel/metric v1.34.0 // indirect
+	go.opentelemetry.io/otel/trace v1.34.0 // indirect
+	google.golang.org/protobuf v1.36.0 // indirect
+)
+
+replace (
+	github.com/tankcdr/ppe-kafka-go/events => ../../events
+	github.com/tankcdr/ppe-kafka-go/kafka => ../../kafka
+)
@@ -0,0 +1,342 @@
+// Command replay re-injects messages from a dead-letter topic into the topic
+// they originally came from.
+//
+// Messages can be narrowed down by event name, order ID, error text and the
+// time they were dead-lettered. With -dry-run the matching messages are only
+// printed. Every replayed message carries an x-replay-count header, and
+// messages that have already been replayed -max-replays times are skipped so
+// a message that keeps failing cannot bounce between topics forever.
+//
+// Example:
+//
+//	replay -topic inventory-dlq -event OrderReceived -since 2024-12-16T00:00:00Z -dry-run
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	segkafka "github.com/segmentio/kafka-go"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+)
+
+// Config holds the command line options
+type Config struct {
+	Broker     string
+	Topic      string
+	EventName  string
+	OrderID    string
+	ErrorText  string
+	Since      time.Time
+	Until      time.Time
+	DryRun     bool
+	MaxReplays int
+	// FetchTimeout ends reading a partition when no message arrives for this
+	// long, in case its end is never reached exactly
+	FetchTimeout time.Duration
+}
+
+// deadLetter is a message read from the dead-letter topic together with the
+// details the filters and the report need.
+type deadLetter struct {
+	msg         segkafka.Message
+	sourceTopic string
+	eventName   string
+	orderID     string
+	lastError   string
+	failedAt    time.Time
+	replayCount int
+}
+
+func main() {
+	cfg, err := parseFlags()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx, cfg); err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+}
+
+func parseFlags() (*Config, error) {
+	var cfg Config
+	var since, until string
+
+	broker := os.Getenv("KAFKA_BROKER")
+	if broker == "" {
+		broker = "localhost:29092"
+	}
+
+	flag.StringVar(&cfg.Broker, "broker", broker, "Kafka broker address (defaults to $KAFKA_BROKER)")
+	flag.StringVar(&cfg.Topic, "topic", "", "dead-letter topic to read (required)")
+	flag.StringVar(&cfg.EventName, "event", "", "only replay events with this name, e.g. OrderReceived")
+	flag.StringVar(&cfg.OrderID, "order", "", "only replay events for this order ID")
+	flag.StringVar(&cfg.ErrorText, "error", "", "only replay messages whose last error contains this text")
+	flag.StringVar(&since, "since", "", "only replay messages dead-lettered at or after this RFC3339 time")
+	flag.StringVar(&until, "until", "", "only replay messages dead-lettered before this RFC3339 time")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "print the messages that would be replayed without publishing them")
+	flag.IntVar(&cfg.MaxReplays, "max-replays", 3, "skip messages that have already been replayed this many times")
+	flag.DurationVar(&cfg.FetchTimeout, "fetch-timeout", 10*time.Second, "stop reading a partition after waiting this long for a message")
+	flag.Parse()
+
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("-topic is required")
+	}
+
+	var err error
+	if since != "" {
+		if cfg.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	if until != "" {
+		if cfg.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+func run(ctx context.Context, cfg *Config) error {
+	messages, err := readTopic(ctx, cfg.Broker, cfg.Topic, cfg.FetchTimeout)
+	if err != nil {
+		return err
+	}
+	log.Printf("Read %d message(s) from %s\n", len(messages), cfg.Topic)
+
+	// One producer per origin topic, created on first use
+	producers := map[string]*kafka.KafkaProducer{}
+	defer func() {
+		for _, p := range producers {
+			p.Close()
+		}
+	}()
+
+	var matched, replayed, skipped int
+	for _, msg := range messages {
+		dl := newDeadLetter(msg)
+		if !cfg.matches(dl) {
+			continue
+		}
+		matched++
+
+		if dl.sourceTopic == "" {
+			log.Printf("Skipping offset %d: no %s header\n", msg.Offset, kafka.HeaderDLQSourceTopic)
+			skipped++
+			continue
+		}
+		if dl.replayCount >= cfg.MaxReplays {
+			log.Printf("Skipping offset %d: already replayed %d time(s), possible replay loop\n", msg.Offset, dl.replayCount)
+			skipped++
+			continue
+		}
+
+		if cfg.DryRun {
+			fmt.Printf("would replay %s\n", dl)
+			continue
+		}
+
+		producer, ok := producers[dl.sourceTopic]
+		if !ok {
+			producer = kafka.NewProducer(kafka.KafkaConfig{
+				Brokers: []string{cfg.Broker},
+				Topic:   dl.sourceTopic,
+			})
+			producers[dl.sourceTopic] = producer
+		}
+
+		if err := producer.Republish(ctx, msg.Key, msg.Value, dl.replayHeaders(cfg.Topic)); err != nil {
+			return fmt.Errorf("replaying offset %d to %s: %v", msg.Offset, dl.sourceTopic, err)
+		}
+		fmt.Printf("replayed %s\n", dl)
+		replayed++
+	}
+
+	log.Printf("Matched %d, replayed %d, skipped %d\n", matched, replayed, skipped)
+	return nil
+}
+
+// readTopic reads every message currently in topic, across all partitions.
+func readTopic(ctx context.Context, broker, topic string, fetchTimeout time.Duration) ([]segkafka.Message, error) {
+	conn, err := segkafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []segkafka.Message
+	for _, p := range partitions {
+		msgs, err := readPartition(ctx, broker, topic, p.ID, fetchTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("reading partition %d: %v", p.ID, err)
+		}
+		messages = append(messages, msgs...)
+	}
+	return messages, nil
+}
+
+// readPartition reads the committed messages of a partition, from its first
+// offset up to the high watermark observed when it starts, so it terminates on
+// a live topic. Aborted transactional messages are skipped, and so are commit
+// markers, so the last offset before the watermark may never be delivered:
+// reading ends when the reader has caught up with the watermark, or when no
+// message comes within fetchTimeout.
+func readPartition(ctx context.Context, broker, topic string, partition int, fetchTimeout time.Duration) ([]segkafka.Message, error) {
+	conn, err := segkafka.DialLeader(ctx, "tcp", broker, topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	if first >= last {
+		return nil, nil
+	}
+
+	reader := segkafka.NewReader(segkafka.ReaderConfig{
+		Brokers:        []string{broker},
+		Topic:          topic,
+		Partition:      partition,
+		IsolationLevel: segkafka.ReadCommitted,
+	})
+	defer reader.Close()
+
+	if err := reader.SetOffset(first); err != nil {
+		return nil, err
+	}
+
+	var messages []segkafka.Message
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				log.Printf("No message on partition %d for %v, stopping at offset %d of %d\n",
+					partition, fetchTimeout, reader.Offset(), last)
+				return messages, nil
+			}
+			return nil, err
+		}
+		if msg.Offset >= last {
+			// Written after the watermark was read
+			return messages, nil
+		}
+		messages = append(messages, msg)
+		if msg.Offset >= last-1 || reader.Lag() <= 0 {
+			return messages, nil
+		}
+	}
+}
+
+func newDeadLetter(msg segkafka.Message) *deadLetter {
+	dl := &deadLetter{
+		msg:      msg,
+		failedAt: msg.Time,
+	}
+
+	for _, h := range msg.Headers {
+		value := string(h.Value)
+		switch h.Key {
+		case kafka.HeaderDLQSourceTopic:
+			dl.sourceTopic = value
+		case kafka.HeaderDLQError:
+			dl.lastError = value
+		case kafka.HeaderDLQFailedAt:
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				dl.failedAt = t
+			}
+		case kafka.HeaderReplayCount:
+			dl.replayCount, _ = strconv.Atoi(value)
+		}
+	}
+
+	// Dead-lettered messages are often malformed, so the event details are
+	// best effort and simply left empty when they can't be decoded
+	if event, err := events.NewEventFromBytes(msg.Value); err == nil {
+		dl.eventName = event.EventName
+		dl.orderID = event.CorrelationId
+		if dl.orderID == "" {
+			var body struct {
+				OrderID string `json:"orderId"`
+			}
+			if json.Unmarshal(event.EventBody, &body) == nil {
+				dl.orderID = body.OrderID
+			}
+		}
+	}
+
+	return dl
+}
+
+func (cfg *Config) matches(dl *deadLetter) bool {
+	if cfg.EventName != "" && dl.eventName != cfg.EventName {
+		return false
+	}
+	if cfg.OrderID != "" && dl.orderID != cfg.OrderID {
+		return false
+	}
+	if cfg.ErrorText != "" && !strings.Contains(dl.lastError, cfg.ErrorText) {
+		return false
+	}
+	if !cfg.Since.IsZero() && dl.failedAt.Before(cfg.Since) {
+		return false
+	}
+	if !cfg.Until.IsZero() && !dl.failedAt.Before(cfg.Until) {
+		return false
+	}
+	return true
+}
+
+// replayHeaders returns the headers for the replayed message: the original
+// headers without the dead-letter metadata, plus the replay bookkeeping.
+func (dl *deadLetter) replayHeaders(dlqTopic string) []kafka.Header {
+	var headers []kafka.Header
+	for _, h := range dl.msg.Headers {
+		switch {
+		case strings.HasPrefix(h.Key, "x-dlq-"),
+			h.Key == kafka.HeaderReplayCount,
+			h.Key == kafka.HeaderReplayedAt,
+			h.Key == kafka.HeaderReplayedBy:
+			continue
+		}
+		headers = append(headers, h)
+	}
+
+	return append(headers,
+		kafka.Header{Key: kafka.HeaderReplayCount, Value: []byte(strconv.Itoa(dl.replayCount + 1))},
+		kafka.Header{Key: kafka.HeaderReplayedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+		kafka.Header{Key: kafka.HeaderReplayedBy, Value: []byte(fmt.Sprintf("%s/%d@%d", dlqTopic, dl.msg.Partition, dl.msg.Offset))},
+	)
+}
+
+func (dl *deadLetter) String() string {
+	return fmt.Sprintf("offset=%d partition=%d event=%q order=%q to=%s failedAt=%s replays=%d error=%q",
+		dl.msg.Offset, dl.msg.Partition, dl.eventName, dl.orderID, dl.sourceTopic,
+		dl.failedAt.Format(time.RFC3339), dl.replayCount, dl.lastError)
+}
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keysBucket holds the keys of a BoltDatabase, each with a boltEntry.
+var keysBucket = []byte("keys")
+
+// boltEntry is the value stored for a key. Files written before entries could
+// expire hold just the RFC 3339 time the key was added; those never expire.
+type boltEntry struct {
+	AddedAt   time.Time  `json:"addedAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Value     string     `json:"value,omitempty"` // set with CompareAndSwap
+}
+
+// value returns the value of the key: what CompareAndSwap put there, or the
+// time it was added.
+func (e *boltEntry) value() string {
+	if e.Value != "" {
+		return e.Value
+	}
+	return e.AddedAt.Format(time.RFC3339)
+}
+
+func (e *boltEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// BoltDatabase is a Store kept in a bbolt file, so processed keys survive a
+// restart. Only one process can have the file open at a time. It honours
+// WithTTL, WithJanitor and WithKeyPrefix; expired keys are no longer
+// reported, and are removed when added again or by the janitor.
+type BoltDatabase struct {
+	db     *bolt.DB
+	prefix string
+	ttl    time.Duration
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	janitor   sync.WaitGroup
+}
+
+// OpenBoltDatabase opens (creating if needed) the bbolt file at path. It
+// fails for WithMaxSize, which it doesn't support.
+func OpenBoltDatabase(path string, opts ...Option) (*BoltDatabase, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxSize > 0 {
+		return nil, fmt.Errorf("the %s store doesn't support a maximum size", BackendBolt)
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &BoltDatabase{db: db, prefix: o.keyPrefix, ttl: o.ttl, stop: make(chan struct{})}
+	if o.janitorInterval > 0 {
+		store.janitor.Add(1)
+		go store.runJanitor(o.janitorInterval)
+	}
+	return store, nil
+}
+
+// Add records key, restarting its TTL; the write is synced to disk before
+// Add returns.
+func (db *BoltDatabase) Add(key string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return db.put(tx.Bucket(keysBucket), key, time.Now())
+	})
+}
+
+// AddIfAbsent records key unless it is present and unexpired; bbolt
+// serialises writers, so the check and the write are atomic.
+func (db *BoltDatabase) AddIfAbsent(key string) (bool, error) {
+	var added bool
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		now := time.Now()
+		if e, ok := db.get(bucket, key); ok && !e.expired(now) {
+			return nil
+		}
+		added = true
+		return db.put(bucket, key, now)
+	})
+	return added, err
+}
+
+func (db *BoltDatabase) Exists(key string) (bool, error) {
+	var exists bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		e, ok := db.get(tx.Bucket(keysBucket), key)
+		exists = ok && !e.expired(time.Now())
+		return nil
+	})
+	return exists, err
+}
+
+func (db *BoltDatabase) Get(key string) (string, bool, error) {
+	var value string
+	var exists bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		e, ok := db.get(tx.Bucket(keysBucket), key)
+		if exists = ok && !e.expired(time.Now()); exists {
+			value = e.value()
+		}
+		return nil
+	})
+	return value, exists, err
+}
+
+// CompareAndSwap sets the value of key to new if it is old; see ValueStore.
+// bbolt serialises writers, so the check and the write are atomic.
+func (db *BoltDatabase) CompareAndSwap(key, old, new string) (bool, error) {
+	var swapped bool
+	err := db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		e, ok := db.get(bucket, key)
+		if ok && e.expired(time.Now()) {
+			ok = false
+		}
+		switch {
+		case !ok && old == "":
+			e = &boltEntry{AddedAt: time.Now().UTC()}
+		case !ok || e.value() != old:
+			return nil
+		}
+		e.Value = new
+		swapped = true
+		return db.write(bucket, key, e)
+	})
+	return swapped, err
+}
+
+func (db *BoltDatabase) Delete(key string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Delete([]byte(db.prefix + key))
+	})
+}
+
+// RemoveExpired removes every expired key now; the janitor calls it
+// periodically.
+func (db *BoltDatabase) RemoveExpired() error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		bucket := tx.Bucket(keysBucket)
+		var expired [][]byte
+		if err := bucket.ForEach(func(k, v []byte) error {
+			if decodeBoltEntry(v).expired(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		// Deleting while iterating would skip keys
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close stops the janitor, if there is one, and closes the file.
+func (db *BoltDatabase) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+	})
+	db.janitor.Wait()
+	return db.db.Close()
+}
+
+func (db *BoltDatabase) get(bucket *bolt.Bucket, key string) (*boltEntry, bool) {
+	v := bucket.Get([]byte(db.prefix + key))
+	if v == nil {
+		return nil, false
+	}
+	return decodeBoltEntry(v), true
+}
+
+func (db *BoltDatabase) put(bucket *bolt.Bucket, key string, now time.Time) error {
+	e := boltEntry{AddedAt: now.UTC()}
+	if db.ttl > 0 {
+		expires := now.Add(db.ttl).UTC()
+		e.ExpiresAt = &expires
+	}
+	return db.write(bucket, key, &e)
+}
+
+func (db *BoltDatabase) write(bucket *bolt.Bucket, key string, e *boltEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(db.prefix+key), v)
+}
+
+func decodeBoltEntry(v []byte) *boltEntry {
+	var e boltEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		// A plain timestamp from an older version, which doesn't expire
+		addedAt, _ := time.Parse(time.RFC3339, string(v))
+		e = boltEntry{AddedAt: addedAt}
+	}
+	return &e
+}
+
+func (db *BoltDatabase) runJanitor(interval time.Duration) {
+	defer db.janitor.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.RemoveExpired()
+		}
+	}
+}
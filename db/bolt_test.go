@@ -0,0 +1,129 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openBolt(t *testing.T, path string, opts ...Option) Store {
+	t.Helper()
+	store, err := Open(BackendBolt, path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func assertExists(t *testing.T, store Store, key string, want bool) {
+	t.Helper()
+	if exists, err := store.Exists(key); err != nil || exists != want {
+		t.Fatalf("Exists(%q) = %v, %v; want %v", key, exists, err, want)
+	}
+}
+
+func TestBoltSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	store := openBolt(t, path, WithKeyPrefix("inventory:"))
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	if added, err := store.AddIfAbsent("ORD-2"); err != nil || !added {
+		t.Fatalf("AddIfAbsent(ORD-2) = %v, %v", added, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openBolt(t, path, WithKeyPrefix("inventory:"))
+	defer store.Close()
+	assertExists(t, store, "ORD-1", true)
+	assertExists(t, store, "ORD-2", true)
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || added {
+		t.Fatalf("AddIfAbsent(ORD-1) after restart = %v, %v; want false", added, err)
+	}
+}
+
+func TestBoltKeyPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	store := openBolt(t, path, WithKeyPrefix("warehouse:"))
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// Another prefix doesn't see the key
+	store = openBolt(t, path, WithKeyPrefix("shipper:"))
+	defer store.Close()
+	assertExists(t, store, "ORD-1", false)
+}
+
+func TestBoltTTL(t *testing.T) {
+	store := openBolt(t, filepath.Join(t.TempDir(), "store.db"), WithTTL(50*time.Millisecond))
+	defer store.Close()
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, store, "ORD-1", true)
+
+	time.Sleep(60 * time.Millisecond)
+	assertExists(t, store, "ORD-1", false)
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || !added {
+		t.Fatalf("AddIfAbsent of an expired key = %v, %v; want true", added, err)
+	}
+}
+
+func TestBoltJanitorRemovesExpiredKeys(t *testing.T) {
+	store := openBolt(t, filepath.Join(t.TempDir(), "store.db"),
+		WithTTL(10*time.Millisecond), WithJanitor(10*time.Millisecond))
+	defer store.Close()
+	for _, key := range []string{"ORD-1", "ORD-2", "ORD-3"} {
+		if err := store.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bdb := store.(*BoltDatabase)
+	deadline := time.Now().Add(time.Second)
+	for {
+		var count int
+		bdb.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket(keysBucket).Stats().KeyN
+			return nil
+		})
+		if count == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d expired keys still in the file", count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBoltReadsOldEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.db")
+	store := openBolt(t, path, WithTTL(time.Millisecond))
+	// As written before keys could expire: just the time they were added
+	store.(*BoltDatabase).db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte("ORD-1"), []byte("2024-12-16T12:34:56Z"))
+	})
+	defer store.Close()
+	assertExists(t, store, "ORD-1", true)
+}
+
+func TestOpenRejectsUnsupportedOptions(t *testing.T) {
+	for _, backend := range []string{BackendBolt, BackendRedis} {
+		if store, err := Open(backend, filepath.Join(t.TempDir(), "store.db"), WithMaxSize(10)); err == nil {
+			store.Close()
+			t.Errorf("%s store opened with WithMaxSize", backend)
+		}
+	}
+	store, err := Open(BackendMemory, "", WithMaxSize(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+}
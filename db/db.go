@@ -1,19 +1,96 @@
 package db
 
+import "time"
+
+// SimpleDatabase is an in-memory Store. Its contents are lost on restart,
+// unless saved with Snapshot and loaded back with Restore. Each key holds a
+// value: the time it was added, or whatever CompareAndSwap last put there.
 type SimpleDatabase struct {
-	store *SimpleInMemoryDatabase[string, struct{}]
+	store *SimpleInMemoryDatabase[string, string]
 }
 
-func NewSimpleDatabase() *SimpleDatabase {
+// NewSimpleDatabase creates a SimpleDatabase; opts bound how long and how many
+// keys it remembers.
+func NewSimpleDatabase(opts ...Option) *SimpleDatabase {
 	return &SimpleDatabase{
-		store: NewSimpleInMemoryDatabase[string, struct{}](),
+		store: NewSimpleInMemoryDatabase[string, string](opts...),
 	}
 }
 
-func (db *SimpleDatabase) Add(value string) {
-	db.store.Add(value, struct{}{})
+func (db *SimpleDatabase) Add(value string) error {
+	db.store.Add(value, addedAt())
+	return nil
+}
+
+func (db *SimpleDatabase) AddIfAbsent(value string) (bool, error) {
+	_, added := db.store.PutIfAbsent(value, addedAt())
+	return added, nil
+}
+
+func (db *SimpleDatabase) Exists(value string) (bool, error) {
+	return db.store.Exists(value), nil
+}
+
+// Get returns the value of key, and whether it is present.
+func (db *SimpleDatabase) Get(key string) (string, bool, error) {
+	value, ok := db.store.Get(key)
+	return value, ok, nil
+}
+
+// CompareAndSwap sets the value of key to new if it is old; see ValueStore.
+func (db *SimpleDatabase) CompareAndSwap(key, old, new string) (bool, error) {
+	if old == "" {
+		// State, like a service's stock, must not make room for claims
+		_, added := db.store.putIfAbsent(key, new, 0, true)
+		return added, nil
+	}
+	return db.store.CompareAndSwap(key, old, new), nil
+}
+
+func (db *SimpleDatabase) Delete(value string) error {
+	db.store.Delete(value)
+	return nil
+}
+
+// Len returns the number of keys held.
+func (db *SimpleDatabase) Len() int {
+	return db.store.Len()
+}
+
+// Keys returns the keys that haven't expired, most recently used first.
+func (db *SimpleDatabase) Keys() []string {
+	return db.store.Keys()
+}
+
+// Range calls fn for each key that hasn't expired and its value, most
+// recently used first, until fn returns false. fn may use the database.
+func (db *SimpleDatabase) Range(fn func(key, value string) bool) {
+	db.store.Range(fn)
+}
+
+// Snapshot writes the keys that haven't expired to the file at path, see
+// SimpleInMemoryDatabase.Snapshot.
+func (db *SimpleDatabase) Snapshot(path string) error {
+	return db.store.Snapshot(path)
+}
+
+// Restore adds the keys of a file written by Snapshot, see
+// SimpleInMemoryDatabase.Restore.
+func (db *SimpleDatabase) Restore(path string) error {
+	return db.store.Restore(path)
+}
+
+// Stats returns the number of keys held and how many were evicted.
+func (db *SimpleDatabase) Stats() Stats {
+	return db.store.Stats()
+}
+
+func (db *SimpleDatabase) Close() error {
+	db.store.Close()
+	return nil
 }
 
-func (db *SimpleDatabase) Exists(value string) bool {
-	return db.store.Exists(value)
+// addedAt is the value a key gets when added, as in the other backends.
+func addedAt() string {
+	return time.Now().UTC().Format(time.RFC3339)
 }
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSimpleDatabaseCompareAndSwap(t *testing.T) {
+	db := NewSimpleDatabase(WithTTL(10 * time.Millisecond))
+	defer db.Close()
+
+	// Of several replicas of a handler creating a key, one wins
+	var wins sync.Map
+	var wg sync.WaitGroup
+	for _, writer := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if swapped, err := db.CompareAndSwap("state", "", writer); err != nil {
+				t.Error(err)
+			} else if swapped {
+				wins.Store(writer, true)
+			}
+		}()
+	}
+	wg.Wait()
+	winner, ok, _ := db.Get("state")
+	if !ok {
+		t.Fatal("state was not created")
+	}
+	wins.Range(func(writer, _ any) bool {
+		if writer != winner {
+			t.Errorf("%s won, but state is %s", writer, winner)
+		}
+		return true
+	})
+
+	if swapped, _ := db.CompareAndSwap("state", "stale", "x"); swapped {
+		t.Fatal("swapped from a stale value")
+	}
+	if swapped, _ := db.CompareAndSwap("state", winner, "next"); !swapped {
+		t.Fatal("swap from the current value failed")
+	}
+
+	// Keys created by CompareAndSwap don't expire; added ones do
+	db.Add("processed")
+	time.Sleep(20 * time.Millisecond)
+	if value, ok, _ := db.Get("state"); !ok || value != "next" {
+		t.Fatalf("state = %q, %v; want next", value, ok)
+	}
+	if exists, _ := db.Exists("processed"); exists {
+		t.Fatal("an added key outlived the TTL")
+	}
+}
+
+func TestSimpleDatabaseKeysAndRange(t *testing.T) {
+	db := NewSimpleDatabase()
+	defer db.Close()
+	for _, key := range []string{"ORD-1", "ORD-2", "ORD-3"} {
+		db.Add(key)
+	}
+
+	if !slices.Equal(db.Keys(), []string{"ORD-3", "ORD-2", "ORD-1"}) {
+		t.Fatalf("keys %v", db.Keys())
+	}
+	var visited []string
+	db.Range(func(key, value string) bool {
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			t.Errorf("%s holds %q, want the time it was added", key, value)
+		}
+		visited = append(visited, key)
+		return len(visited) < 2
+	})
+	if len(visited) != 2 {
+		t.Fatalf("Range visited %v after being stopped", visited)
+	}
+}
+
+func TestSimpleDatabaseSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	db := NewSimpleDatabase()
+	db.Add("ORD-1")
+	db.CompareAndSwap("state", "", "v1")
+	if err := db.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	restored := NewSimpleDatabase()
+	defer restored.Close()
+	if err := restored.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, restored, "ORD-1", true)
+	if value, _, _ := restored.Get("state"); value != "v1" {
+		t.Fatalf("state = %q, want v1", value)
+	}
+}
+
+func TestSimpleDatabaseMaxSizeKeepsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	db := NewSimpleDatabase(WithMaxSize(2))
+	if swapped, _ := db.CompareAndSwap("stock:state", "", "v1"); !swapped {
+		t.Fatal("creating the state key failed")
+	}
+	for _, orderID := range []string{"ORD-1", "ORD-2", "ORD-3", "ORD-4"} {
+		db.Add(orderID)
+	}
+	// The state key is the least recently used, but only claims make room
+	if value, ok, _ := db.Get("stock:state"); !ok || value != "v1" {
+		t.Fatalf("state = %q, %v; want v1", value, ok)
+	}
+	if db.Len() != 3 || db.Stats().CapacityEvictions != 2 {
+		t.Fatalf("%d keys, %d evicted; want 3, 2", db.Len(), db.Stats().CapacityEvictions)
+	}
+	if err := db.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A restored state key is still never evicted
+	restored := NewSimpleDatabase(WithMaxSize(1))
+	defer restored.Close()
+	if err := restored.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	restored.Add("ORD-5")
+	assertExists(t, restored, "stock:state", true)
+	assertExists(t, restored, "ORD-5", true)
+
+	// Deleting it gives its room back
+	restored.Delete("stock:state")
+	restored.Add("ORD-6")
+	if restored.Len() != 1 {
+		t.Fatalf("%d keys, want 1", restored.Len())
+	}
+}
@@ -1,50 +1,407 @@
 package db
 
 import (
+	"container/list"
 	"sync"
+	"time"
 )
 
+// EvictionReason tells why an entry was evicted from a SimpleInMemoryDatabase.
+type EvictionReason int
+
+const (
+	// EvictionExpired means the entry outlived its TTL.
+	EvictionExpired EvictionReason = iota
+	// EvictionCapacity means the entry was the least recently used one when
+	// the database was full.
+	EvictionCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionCapacity:
+		return "capacity"
+	}
+	return "unknown"
+}
+
+// Option configures a SimpleInMemoryDatabase, or the Store returned by Open.
+// Stores that can't honour an option fail to open rather than ignore it.
+type Option func(*options)
+
+type options struct {
+	ttl             time.Duration
+	maxSize         int
+	janitorInterval time.Duration
+	keyPrefix       string
+}
+
+// WithTTL makes entries expire ttl after they were last added. Expired
+// entries are no longer returned, and are removed when next looked up or by
+// the janitor. A RedisDatabase leaves expiry to Redis.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithMaxSize caps the database at size entries. Adding to a full database
+// evicts the least recently used entry. Keys a SimpleDatabase creates with
+// CompareAndSwap hold state, so they are never evicted and don't count
+// towards size. Only in-memory stores support it.
+func WithMaxSize(size int) Option {
+	return func(o *options) {
+		o.maxSize = size
+	}
+}
+
+// WithJanitor starts a goroutine that removes expired entries every interval,
+// so entries that are never looked up again don't stay in memory (or in the
+// file of a BoltDatabase). Stop it with Close. Redis expires keys itself.
+func WithJanitor(interval time.Duration) Option {
+	return func(o *options) {
+		o.janitorInterval = interval
+	}
+}
+
+// WithKeyPrefix prepends prefix to every key of a RedisDatabase or
+// BoltDatabase, so services sharing a Redis server don't see each other's
+// keys. In-memory stores, never shared, have no use for it.
+func WithKeyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.keyPrefix = prefix
+	}
+}
+
+// Stats describes the contents of a SimpleInMemoryDatabase.
+type Stats struct {
+	Size              int
+	Expirations       uint64 // entries removed because they expired
+	CapacityEvictions uint64 // entries removed to make room
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero if the entry doesn't expire
+	pinned  bool      // never evicted to make room
+}
+
 // SimpleInMemoryDatabase is a thread-safe in-memory key-value store.
 // K must be comparable (e.g., string, int), and V can be any type.
+// By default it grows without bound; see WithTTL, WithMaxSize and WithJanitor.
 type SimpleInMemoryDatabase[K comparable, V any] struct {
-	mu   sync.RWMutex
-	data map[K]V
+	mu      sync.Mutex
+	data    map[K]*list.Element
+	recency *list.List // of *entry[K, V], most recently used first
+	options options
+	onEvict func(key K, value V, reason EvictionReason)
+	stats   Stats
+	pinned  int // entries not counted towards the maximum size
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewSimpleInMemoryDatabase creates a new generic in-memory database.
-func NewSimpleInMemoryDatabase[K comparable, V any]() *SimpleInMemoryDatabase[K, V] {
-	return &SimpleInMemoryDatabase[K, V]{
-		data: make(map[K]V),
+func NewSimpleInMemoryDatabase[K comparable, V any](opts ...Option) *SimpleInMemoryDatabase[K, V] {
+	db := &SimpleInMemoryDatabase[K, V]{
+		data:    make(map[K]*list.Element),
+		recency: list.New(),
+		stop:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&db.options)
 	}
+
+	if db.options.janitorInterval > 0 {
+		go db.janitor(db.options.janitorInterval)
+	}
+	return db
 }
 
-// Add inserts or updates a value for the given key.
+// OnEvict registers fn to be called for every entry that expires or is
+// evicted to make room. It isn't called for Delete. fn runs without the
+// database locked, so it may use the database.
+func (db *SimpleInMemoryDatabase[K, V]) OnEvict(fn func(key K, value V, reason EvictionReason)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.onEvict = fn
+}
+
+// Add inserts or updates a value for the given key, using the database's TTL.
 func (db *SimpleInMemoryDatabase[K, V]) Add(key K, value V) {
+	db.AddWithTTL(key, value, db.options.ttl)
+}
+
+// AddWithTTL inserts or updates a value for the given key, expiring it after
+// ttl instead of the database's TTL. A ttl of 0 means the entry doesn't
+// expire.
+func (db *SimpleInMemoryDatabase[K, V]) AddWithTTL(key K, value V, ttl time.Duration) {
+	expires := expiry(time.Now(), ttl)
+
+	db.mu.Lock()
+	evicted := db.insert(key, value, expires, false)
+	onEvict := db.onEvict
+	db.mu.Unlock()
+
+	notify(onEvict, evicted, EvictionCapacity)
+}
+
+// PutIfAbsent adds value for key, using the database's TTL, unless key is
+// already present. It returns the value now stored and whether it was added;
+// the check and the add are one atomic step.
+func (db *SimpleInMemoryDatabase[K, V]) PutIfAbsent(key K, value V) (V, bool) {
+	return db.putIfAbsent(key, value, db.options.ttl, false)
+}
+
+// putIfAbsent is PutIfAbsent with the given ttl; a pinned entry is never
+// evicted to make room.
+func (db *SimpleInMemoryDatabase[K, V]) putIfAbsent(key K, value V, ttl time.Duration, pinned bool) (V, bool) {
+	now := time.Now()
+
+	db.mu.Lock()
+	var expired []*entry[K, V]
+	if elem, ok := db.data[key]; ok {
+		e := elem.Value.(*entry[K, V])
+		if !e.expired(now) {
+			db.recency.MoveToFront(elem)
+			actual := e.value
+			db.mu.Unlock()
+			return actual, false
+		}
+		expired = append(expired, db.remove(elem))
+		db.stats.Expirations++
+	}
+	evicted := db.insert(key, value, expiry(now, ttl), pinned)
+	onEvict := db.onEvict
+	db.mu.Unlock()
+
+	notify(onEvict, expired, EvictionExpired)
+	notify(onEvict, evicted, EvictionCapacity)
+	return value, true
+}
+
+// CompareAndSwap replaces the value for key with new if key is present with a
+// value equal to old, and reports whether it did. The entry's expiry is left
+// as it was. As with sync.Map, V must be comparable at run time; comparing
+// values such as slices or maps panics.
+func (db *SimpleInMemoryDatabase[K, V]) CompareAndSwap(key K, old, new V) bool {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	db.data[key] = value
+
+	elem, ok := db.data[key]
+	if !ok {
+		return false
+	}
+	e := elem.Value.(*entry[K, V])
+	if e.expired(time.Now()) || any(e.value) != any(old) {
+		return false
+	}
+	e.value = new
+	db.recency.MoveToFront(elem)
+	return true
 }
 
 // Exists checks if a key is in the database.
 func (db *SimpleInMemoryDatabase[K, V]) Exists(key K) bool {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	_, exists := db.data[key]
+	_, exists := db.Get(key)
 	return exists
 }
 
 // Get retrieves the value associated with the given key.
 // It returns the value and a boolean indicating if the key exists.
 func (db *SimpleInMemoryDatabase[K, V]) Get(key K) (V, bool) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	val, exists := db.data[key]
-	return val, exists
+	var zero V
+
+	db.mu.Lock()
+	elem, ok := db.data[key]
+	if !ok {
+		db.mu.Unlock()
+		return zero, false
+	}
+
+	e := elem.Value.(*entry[K, V])
+	if e.expired(time.Now()) {
+		db.remove(elem)
+		db.stats.Expirations++
+		onEvict := db.onEvict
+		db.mu.Unlock()
+
+		notify(onEvict, []*entry[K, V]{e}, EvictionExpired)
+		return zero, false
+	}
+
+	db.recency.MoveToFront(elem)
+	value := e.value
+	db.mu.Unlock()
+	return value, true
 }
 
 // Delete removes a key (and its value) from the database.
 func (db *SimpleInMemoryDatabase[K, V]) Delete(key K) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	delete(db.data, key)
+	if elem, ok := db.data[key]; ok {
+		db.remove(elem)
+	}
+}
+
+// Len returns the number of entries, including expired ones not removed yet.
+func (db *SimpleInMemoryDatabase[K, V]) Len() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.data)
+}
+
+// Keys returns the keys of the entries that haven't expired, most recently
+// used first.
+func (db *SimpleInMemoryDatabase[K, V]) Keys() []K {
+	var keys []K
+	db.Range(func(key K, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Range calls fn for each entry that hasn't expired, most recently used first,
+// until fn returns false. It iterates over a copy of the entries, so fn may
+// use the database; it doesn't count as a use of the entries.
+func (db *SimpleInMemoryDatabase[K, V]) Range(fn func(key K, value V) bool) {
+	for _, e := range db.entries() {
+		if !fn(e.Key, e.Value) {
+			return
+		}
+	}
+}
+
+// Stats returns the current size and eviction counts.
+func (db *SimpleInMemoryDatabase[K, V]) Stats() Stats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := db.stats
+	stats.Size = len(db.data)
+	return stats
+}
+
+// RemoveExpired removes every expired entry now; the janitor calls it
+// periodically.
+func (db *SimpleInMemoryDatabase[K, V]) RemoveExpired() {
+	now := time.Now()
+
+	db.mu.Lock()
+	var expired []*entry[K, V]
+	for elem := db.recency.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*entry[K, V]).expired(now) {
+			expired = append(expired, db.remove(elem))
+			db.stats.Expirations++
+		}
+		elem = next
+	}
+	onEvict := db.onEvict
+	db.mu.Unlock()
+
+	notify(onEvict, expired, EvictionExpired)
+}
+
+// Close stops the janitor, if there is one. The database remains usable.
+func (db *SimpleInMemoryDatabase[K, V]) Close() {
+	db.closeOnce.Do(func() {
+		close(db.stop)
+	})
+}
+
+func (db *SimpleInMemoryDatabase[K, V]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+			db.RemoveExpired()
+		}
+	}
+}
+
+// entries copies the entries that haven't expired, most recently used first.
+func (db *SimpleInMemoryDatabase[K, V]) entries() []snapshotEntry[K, V] {
+	now := time.Now()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	entries := make([]snapshotEntry[K, V], 0, len(db.data))
+	for elem := db.recency.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*entry[K, V])
+		if !e.expired(now) {
+			entries = append(entries, snapshotEntry[K, V]{Key: e.key, Value: e.value, Expires: e.expires, Pinned: e.pinned})
+		}
+	}
+	return entries
+}
+
+// insert adds or updates key, pinning it if asked to, then evicts the least
+// recently used unpinned entries beyond the maximum size and returns them;
+// db.mu must be held.
+func (db *SimpleInMemoryDatabase[K, V]) insert(key K, value V, expires time.Time, pinned bool) []*entry[K, V] {
+	elem, ok := db.data[key]
+	if ok {
+		db.recency.MoveToFront(elem)
+	} else {
+		elem = db.recency.PushFront(&entry[K, V]{key: key})
+		db.data[key] = elem
+	}
+	e := elem.Value.(*entry[K, V])
+	e.value, e.expires = value, expires
+	if pinned && !e.pinned {
+		e.pinned = true
+		db.pinned++
+	}
+
+	var evicted []*entry[K, V]
+	for db.options.maxSize > 0 && len(db.data)-db.pinned > db.options.maxSize {
+		victim := db.recency.Back()
+		for victim.Value.(*entry[K, V]).pinned {
+			victim = victim.Prev()
+		}
+		evicted = append(evicted, db.remove(victim))
+		db.stats.CapacityEvictions++
+	}
+	return evicted
+}
+
+// remove unlinks elem; db.mu must be held.
+func (db *SimpleInMemoryDatabase[K, V]) remove(elem *list.Element) *entry[K, V] {
+	e := db.recency.Remove(elem).(*entry[K, V])
+	delete(db.data, e.key)
+	if e.pinned {
+		db.pinned--
+	}
+	return e
+}
+
+// expiry returns when an entry added at now with ttl expires; zero for never.
+func expiry(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+func (e *entry[K, V]) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func notify[K comparable, V any](onEvict func(K, V, EvictionReason), evicted []*entry[K, V], reason EvictionReason) {
+	if onEvict == nil {
+		return
+	}
+	for _, e := range evicted {
+		onEvict(e.key, e.value, reason)
+	}
 }
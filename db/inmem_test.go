@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// evictions records the entries a SimpleInMemoryDatabase evicts.
+type evictions struct {
+	mu      sync.Mutex
+	reasons map[string]EvictionReason
+}
+
+func recordEvictions(db *SimpleInMemoryDatabase[string, int]) *evictions {
+	e := &evictions{reasons: map[string]EvictionReason{}}
+	db.OnEvict(func(key string, _ int, reason EvictionReason) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.reasons[key] = reason
+	})
+	return e
+}
+
+func (e *evictions) of(key string) (EvictionReason, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	reason, ok := e.reasons[key]
+	return reason, ok
+}
+
+func TestEvictsLeastRecentlyUsed(t *testing.T) {
+	db := NewSimpleInMemoryDatabase[string, int](WithMaxSize(2))
+	evicted := recordEvictions(db)
+
+	db.Add("a", 1)
+	db.Add("b", 2)
+	db.Get("a") // b is now the least recently used
+	db.Add("c", 3)
+
+	if !slices.Equal(db.Keys(), []string{"c", "a"}) {
+		t.Fatalf("keys %v, want [c a]", db.Keys())
+	}
+	if reason, ok := evicted.of("b"); !ok || reason != EvictionCapacity {
+		t.Fatalf("b evicted: %v, %v; want capacity", reason, ok)
+	}
+	if stats := db.Stats(); stats.Size != 2 || stats.CapacityEvictions != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestEvictionUnderConcurrentUse(t *testing.T) {
+	const size = 10
+	db := NewSimpleInMemoryDatabase[string, int](WithMaxSize(size))
+	evicted := recordEvictions(db)
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprintf("%d-%d", w, i)
+				db.Add(key, i)
+				db.Get(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := db.Stats()
+	if stats.Size != size || db.Len() != size {
+		t.Fatalf("size %d, want %d", stats.Size, size)
+	}
+	if stats.CapacityEvictions != 8*200-size {
+		t.Fatalf("%d capacity evictions, want %d", stats.CapacityEvictions, 8*200-size)
+	}
+	if _, ok := evicted.of(db.Keys()[0]); ok {
+		t.Fatal("a key still held was reported evicted")
+	}
+}
+
+func TestJanitorRemovesExpiredEntries(t *testing.T) {
+	db := NewSimpleInMemoryDatabase[string, int](WithTTL(10*time.Millisecond), WithJanitor(5*time.Millisecond))
+	defer db.Close()
+	evicted := recordEvictions(db)
+
+	// Keep writing while the janitor runs
+	var wg sync.WaitGroup
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 50 {
+				db.Add(strconv.Itoa(w*50+i), i)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+	}
+	db.AddWithTTL("forever", 0, 0)
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for db.Len() > 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries left, want only the one without a TTL", db.Len())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !db.Exists("forever") {
+		t.Fatal("the entry without a TTL was removed")
+	}
+	if reason, ok := evicted.of("0"); !ok || reason != EvictionExpired {
+		t.Fatalf("0 evicted: %v, %v; want expired", reason, ok)
+	}
+	if stats := db.Stats(); stats.Expirations != 200 {
+		t.Fatalf("%d expirations, want 200", stats.Expirations)
+	}
+}
+
+func TestCompareAndSwapCounts(t *testing.T) {
+	db := NewSimpleInMemoryDatabase[string, int]()
+	db.Add("counter", 0)
+
+	// Every increment retries until its swap wins, so none is lost
+	const workers, increments = 8, 100
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				for {
+					current, _ := db.Get("counter")
+					if db.CompareAndSwap("counter", current, current+1) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := db.Get("counter"); got != workers*increments {
+		t.Fatalf("counter %d, want %d", got, workers*increments)
+	}
+	if db.CompareAndSwap("missing", 0, 1) {
+		t.Fatal("swapped a missing key")
+	}
+}
+
+func TestCompareAndSwapKeepsExpiry(t *testing.T) {
+	db := NewSimpleInMemoryDatabase[string, int](WithTTL(50 * time.Millisecond))
+	db.Add("a", 1)
+	time.Sleep(30 * time.Millisecond)
+	if !db.CompareAndSwap("a", 1, 2) {
+		t.Fatal("swap failed")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if db.Exists("a") {
+		t.Fatal("the swap extended the entry's TTL")
+	}
+	if db.CompareAndSwap("a", 2, 3) {
+		t.Fatal("swapped an expired entry")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	db := NewSimpleInMemoryDatabase[string, int](WithTTL(time.Hour))
+	db.Add("a", 1)
+	db.Add("b", 2)
+	db.AddWithTTL("gone", 3, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := db.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewSimpleInMemoryDatabase[string, int]()
+	if err := restored.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(restored.Keys(), []string{"b", "a"}) {
+		t.Fatalf("restored keys %v, want [b a]", restored.Keys())
+	}
+	if value, _ := restored.Get("a"); value != 1 {
+		t.Fatalf("a = %d, want 1", value)
+	}
+	if err := NewSimpleInMemoryDatabase[string, int]().Restore(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("restoring a missing file: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout bounds each call to Redis, since Store methods take no context.
+const redisTimeout = 5 * time.Second
+
+// RedisDatabase is a Store kept in Redis, so every replica of a service sees
+// the same keys and deduplication survives rebalances and restarts. Keys are
+// written with SET NX, so of several replicas adding the same key exactly one
+// succeeds, and expire after the TTL given with WithTTL, if any.
+type RedisDatabase struct {
+	client redis.UniversalClient
+	prefix string
+	ttl    time.Duration
+}
+
+// OpenRedisDatabase connects to the Redis server at url, e.g.
+// redis://localhost:6379/0, and checks that it answers. It fails for
+// WithMaxSize; cap a Redis server's memory with its maxmemory settings.
+func OpenRedisDatabase(url string, opts ...Option) (*RedisDatabase, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxSize > 0 {
+		return nil, fmt.Errorf("the %s store doesn't support a maximum size", BackendRedis)
+	}
+
+	redisOptions, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Redis URL: %w", err)
+	}
+	client := redis.NewClient(redisOptions)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to Redis at %s: %w", redisOptions.Addr, err)
+	}
+	return NewRedisDatabase(client, opts...), nil
+}
+
+// NewRedisDatabase creates a RedisDatabase on an existing client, which it
+// closes on Close.
+func NewRedisDatabase(client redis.UniversalClient, opts ...Option) *RedisDatabase {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &RedisDatabase{client: client, prefix: o.keyPrefix, ttl: o.ttl}
+}
+
+// Add records key. A key that is already present keeps its original expiry.
+func (db *RedisDatabase) Add(key string) error {
+	_, err := db.AddIfAbsent(key)
+	return err
+}
+
+// AddIfAbsent records key unless it is already present, in a single atomic
+// step, and reports whether it was added.
+func (db *RedisDatabase) AddIfAbsent(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return db.client.SetNX(ctx, db.prefix+key, addedAt(), db.ttl).Result()
+}
+
+func (db *RedisDatabase) Exists(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	count, err := db.client.Exists(ctx, db.prefix+key).Result()
+	return count > 0, err
+}
+
+func (db *RedisDatabase) Get(key string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	value, err := db.client.Get(ctx, db.prefix+key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// compareAndSwapScript swaps KEYS[1] from ARGV[1] to ARGV[2]; a missing key
+// counts as "". Redis runs scripts atomically.
+var compareAndSwapScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	if ARGV[1] ~= '' then
+		return 0
+	end
+	redis.call('SET', KEYS[1], ARGV[2])
+	return 1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+return 1
+`)
+
+// CompareAndSwap sets the value of key to new if it is old; see ValueStore.
+func (db *RedisDatabase) CompareAndSwap(key, old, new string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	swapped, err := compareAndSwapScript.Run(ctx, db.client, []string{db.prefix + key}, old, new).Int()
+	return swapped == 1, err
+}
+
+func (db *RedisDatabase) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	return db.client.Del(ctx, db.prefix+key).Err()
+}
+
+func (db *RedisDatabase) Close() error {
+	return db.client.Close()
+}
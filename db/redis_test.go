@@ -0,0 +1,138 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// openRedis returns a store on server, as a replica of a service would open it.
+func openRedis(t *testing.T, server *miniredis.Miniredis, opts ...Option) ValueStore {
+	t.Helper()
+	store, err := Open(BackendRedis, "redis://"+server.Addr()+"/0", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestRedisAddIfAbsent(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := openRedis(t, server, WithKeyPrefix("inventory:"))
+
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || !added {
+		t.Fatalf("first AddIfAbsent = %v, %v; want true", added, err)
+	}
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || added {
+		t.Fatalf("second AddIfAbsent = %v, %v; want false", added, err)
+	}
+	assertExists(t, store, "ORD-1", true)
+	if !server.Exists("inventory:ORD-1") {
+		t.Fatalf("keys on the server: %v, want inventory:ORD-1", server.Keys())
+	}
+
+	// Deleting releases the claim
+	if err := store.Delete("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, store, "ORD-1", false)
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || !added {
+		t.Fatalf("AddIfAbsent after Delete = %v, %v; want true", added, err)
+	}
+}
+
+func TestRedisReplicasClaimOnce(t *testing.T) {
+	server := miniredis.RunT(t)
+	replicas := []ValueStore{
+		openRedis(t, server, WithKeyPrefix("inventory:")),
+		openRedis(t, server, WithKeyPrefix("inventory:")),
+	}
+
+	var claims atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			added, err := replicas[i%len(replicas)].AddIfAbsent("ORD-1")
+			if err != nil {
+				t.Error(err)
+			}
+			if added {
+				claims.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if claims.Load() != 1 {
+		t.Fatalf("ORD-1 claimed %d times, want once", claims.Load())
+	}
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	server := miniredis.RunT(t)
+	warehouse := openRedis(t, server, WithKeyPrefix("warehouse:"))
+	shipper := openRedis(t, server, WithKeyPrefix("shipper:"))
+
+	if err := warehouse.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, shipper, "ORD-1", false)
+	if added, err := shipper.AddIfAbsent("ORD-1"); err != nil || !added {
+		t.Fatalf("shipper AddIfAbsent = %v, %v; want true", added, err)
+	}
+}
+
+func TestRedisTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := openRedis(t, server, WithTTL(time.Hour))
+
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("ORD-1"); ttl != time.Hour {
+		t.Fatalf("TTL %v, want 1h", ttl)
+	}
+
+	// Adding again doesn't extend the original expiry
+	server.FastForward(30 * time.Minute)
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("ORD-1"); ttl != 30*time.Minute {
+		t.Fatalf("TTL %v after adding again, want 30m", ttl)
+	}
+
+	server.FastForward(30 * time.Minute)
+	assertExists(t, store, "ORD-1", false)
+	if added, err := store.AddIfAbsent("ORD-1"); err != nil || !added {
+		t.Fatalf("AddIfAbsent of an expired key = %v, %v; want true", added, err)
+	}
+}
+
+func TestRedisWithoutTTLKeepsKeys(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := openRedis(t, server)
+
+	if err := store.Add("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("ORD-1"); ttl != 0 {
+		t.Fatalf("TTL %v, want none", ttl)
+	}
+	server.FastForward(24 * time.Hour)
+	assertExists(t, store, "ORD-1", true)
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	addr := server.Addr()
+	server.Close()
+	if _, err := Open(BackendRedis, "redis://"+addr+"/0"); err == nil {
+		t.Fatal("opened a store on a stopped server")
+	}
+}
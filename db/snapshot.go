@@ -0,0 +1,82 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotEntry is how an entry is written by Snapshot.
+type snapshotEntry[K comparable, V any] struct {
+	Key     K         `json:"key"`
+	Value   V         `json:"value"`
+	Expires time.Time `json:"expires"` // zero if the entry doesn't expire
+	Pinned  bool      `json:"pinned,omitempty"`
+}
+
+// Snapshot writes the entries that haven't expired to the file at path as
+// JSON, so they can be loaded back with Restore, e.g. after a restart. The
+// file is replaced atomically; K and V must be encodable as JSON.
+func (db *SimpleInMemoryDatabase[K, V]) Snapshot(path string) error {
+	data, err := json.Marshal(db.entries())
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore adds the entries of a file written by Snapshot, keeping their
+// expiry and recency. Entries that have expired since are skipped, and
+// existing entries with the same keys are replaced. A missing file restores
+// nothing.
+func (db *SimpleInMemoryDatabase[K, V]) Restore(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []snapshotEntry[K, V]
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+
+	now := time.Now()
+	db.mu.Lock()
+	var evicted []*entry[K, V]
+	// Entries were written most recently used first
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if !e.Expires.IsZero() && now.After(e.Expires) {
+			continue
+		}
+		evicted = append(evicted, db.insert(e.Key, e.Value, e.Expires, e.Pinned)...)
+	}
+	onEvict := db.onEvict
+	db.mu.Unlock()
+
+	notify(onEvict, evicted, EvictionCapacity)
+	return nil
+}
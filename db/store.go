@@ -0,0 +1,56 @@
+package db
+
+import "fmt"
+
+// Store records the keys (e.g. order IDs) a service has already processed,
+// so that redelivered or replayed messages can be recognised.
+type Store interface {
+	Add(key string) error
+	// AddIfAbsent adds key unless it is already present, and reports whether
+	// it was added. Of several concurrent callers adding the same key, exactly
+	// one gets true, so it can be used to claim the key.
+	AddIfAbsent(key string) (bool, error)
+	Exists(key string) (bool, error)
+	// Delete removes key, e.g. to release a claim whose work failed.
+	Delete(key string) error
+	Close() error
+}
+
+// ValueStore is a Store whose keys also hold a value that can be updated
+// atomically, for state shared by the replicas of a service. A key added with
+// Add or AddIfAbsent holds the time it was added.
+type ValueStore interface {
+	Store
+	// Get returns the value of key, and whether it is present.
+	Get(key string) (string, bool, error)
+	// CompareAndSwap sets the value of key to new if it is old, and reports
+	// whether it did, in one atomic step. A missing key counts as having the
+	// value "", so CompareAndSwap(key, "", value) creates key; a key created
+	// this way holds state rather than recording work done, so it neither
+	// expires nor is evicted to make room. A swapped key keeps its expiry.
+	CompareAndSwap(key, old, new string) (bool, error)
+}
+
+// Store backends accepted by Open.
+const (
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+	BackendRedis  = "redis"
+)
+
+// Open returns the Store for backend. path is the database file of the bolt
+// backend or the server URL of the redis one, and is ignored for the
+// in-memory one. Every backend honours WithTTL and WithKeyPrefix; it fails
+// for WithMaxSize with the bolt and redis backends, which can't enforce it.
+func Open(backend, path string, opts ...Option) (ValueStore, error) {
+	switch backend {
+	case "", BackendMemory:
+		return NewSimpleDatabase(opts...), nil
+	case BackendBolt:
+		return OpenBoltDatabase(path, opts...)
+	case BackendRedis:
+		return OpenRedisDatabase(path, opts...)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
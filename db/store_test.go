@@ -0,0 +1,131 @@
+package db
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// valueStores opens a store of each backend, keeping keys for an hour.
+func valueStores(t *testing.T) map[string]ValueStore {
+	t.Helper()
+	server := miniredis.RunT(t)
+	stores := map[string]ValueStore{}
+	for backend, path := range map[string]string{
+		BackendMemory: "",
+		BackendBolt:   filepath.Join(t.TempDir(), "store.db"),
+		BackendRedis:  "redis://" + server.Addr() + "/0",
+	} {
+		store, err := Open(backend, path, WithKeyPrefix("test:"), WithTTL(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[backend] = store
+	}
+	return stores
+}
+
+func TestValueStoreCompareAndSwap(t *testing.T) {
+	for backend, store := range valueStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			if _, ok, err := store.Get("state"); err != nil || ok {
+				t.Fatalf("Get of a missing key = %v, %v", ok, err)
+			}
+			if swapped, err := store.CompareAndSwap("state", "v0", "v1"); err != nil || swapped {
+				t.Fatalf("swapped a missing key from v0: %v, %v", swapped, err)
+			}
+			if swapped, err := store.CompareAndSwap("state", "", "v1"); err != nil || !swapped {
+				t.Fatalf("creating the key: %v, %v", swapped, err)
+			}
+			if swapped, err := store.CompareAndSwap("state", "", "v1"); err != nil || swapped {
+				t.Fatalf("created the key twice: %v, %v", swapped, err)
+			}
+			if swapped, err := store.CompareAndSwap("state", "v1", "v2"); err != nil || !swapped {
+				t.Fatalf("swapping v1 for v2: %v, %v", swapped, err)
+			}
+			if value, ok, err := store.Get("state"); err != nil || !ok || value != "v2" {
+				t.Fatalf("Get = %q, %v, %v; want v2", value, ok, err)
+			}
+
+			// An added key holds the time it was added
+			if err := store.Add("ORD-1"); err != nil {
+				t.Fatal(err)
+			}
+			value, ok, err := store.Get("ORD-1")
+			if err != nil || !ok {
+				t.Fatalf("Get of an added key = %v, %v", ok, err)
+			}
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				t.Fatalf("added key holds %q", value)
+			}
+		})
+	}
+}
+
+func TestValueStoreCompareAndSwapIsAtomic(t *testing.T) {
+	for backend, store := range valueStores(t) {
+		t.Run(backend, func(t *testing.T) {
+			const workers, increments = 4, 25
+			var wg sync.WaitGroup
+			for range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range increments {
+						for {
+							current, _, err := store.Get("counter")
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							next := current + "x"
+							if swapped, err := store.CompareAndSwap("counter", current, next); err != nil {
+								t.Error(err)
+								return
+							} else if swapped {
+								break
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if value, _, _ := store.Get("counter"); len(value) != workers*increments {
+				t.Fatalf("%d increments recorded, want %d", len(value), workers*increments)
+			}
+		})
+	}
+}
+
+func TestRedisCompareAndSwapKeepsTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := openRedis(t, server, WithTTL(time.Hour))
+
+	if swapped, err := store.CompareAndSwap("state", "", "v1"); err != nil || !swapped {
+		t.Fatalf("creating the key: %v, %v", swapped, err)
+	}
+	if ttl := server.TTL("state"); ttl != 0 {
+		t.Fatalf("created key expires in %v, want never", ttl)
+	}
+
+	store.Add("ORD-1")
+	if swapped, err := store.CompareAndSwap("ORD-1", mustGet(t, store, "ORD-1"), "shipped"); err != nil || !swapped {
+		t.Fatalf("swapping an added key: %v, %v", swapped, err)
+	}
+	if ttl := server.TTL("ORD-1"); ttl != time.Hour {
+		t.Fatalf("swapped key expires in %v, want 1h", ttl)
+	}
+}
+
+func mustGet(t *testing.T, store ValueStore, key string) string {
+	t.Helper()
+	value, ok, err := store.Get(key)
+	if err != nil || !ok {
+		t.Fatalf("Get(%q) = %v, %v", key, ok, err)
+	}
+	return value
+}
@@ -9,24 +9,39 @@ import (
 	"github.com/tankcdr/ppe-kafka-go/kafka"
 )
 
-// HandleError processes an error by logging it, updating the event, publishing the error to Kafka, and returning the formatted error.
+// HandleError processes an error by logging it, wrapping the event in an error event, publishing the error to Kafka, and returning the formatted error.
 func HandleError(ctx context.Context, event *events.Event, producer *kafka.KafkaProducer, customMessage string) error {
+	return report(ctx, event, producer, customMessage, events.NewErrorEvent)
+}
+
+// HandleDuplicate reports event on the error topic as a duplicate, like
+// HandleError, so it is counted but not taken for a failure of the order.
+func HandleDuplicate(ctx context.Context, event *events.Event, producer *kafka.KafkaProducer, customMessage string) error {
+	return report(ctx, event, producer, customMessage, events.NewDuplicateEvent)
+}
+
+func report(ctx context.Context, event *events.Event, producer *kafka.KafkaProducer, customMessage string,
+	newEvent func(*events.Event, string) (*events.Event, error)) error {
 	// Log the error
 	log.Printf("%s\n", customMessage)
 
 	err := fmt.Errorf(customMessage)
 
-	// Update the event with the error message
+	// Wrap the failed event in an error event
 	errorString := fmt.Sprintf("%s: %v", customMessage, err)
-	event.ErrorMessage = &errorString
-	event.EventName = events.OrderStatus[events.Error]
+	errorEvent, eventErr := newEvent(event, errorString)
+	if eventErr != nil {
+		log.Printf("Failed to create Error event: %v\n", eventErr)
+		return fmt.Errorf("Failed to create Error event: %v", eventErr)
+	}
 
 	// Publish an error event to Kafka
-	if publishErr := producer.Publish(ctx, event); publishErr != nil {
+	if publishErr := producer.Publish(ctx, errorEvent); publishErr != nil {
 		log.Printf("Failed to produce Error event: %v\n", publishErr)
 		return fmt.Errorf("Failed to produce Error event: %v", publishErr)
 	}
 
-	// Return the formatted error
-	return fmt.Errorf(errorString)
+	// Return the formatted error; the event now lives on the error topic, so
+	// consumers should commit it rather than retry
+	return kafka.Handled(fmt.Errorf(errorString))
 }
@@ -16,25 +16,48 @@ const (
 	OrderPickedPacked
 	NotificationEvent
 	Error
+	OrderRejected
+	OrderCancelled
+	ReleaseStock
+	CancelShipment
+	CancellationAnswered
 )
 
 var OrderStatus = map[EventType]string{
-	OrderReceived:     "OrderReceived",
-	OrderConfirmed:    "OrderConfirmed",
-	OrderPickedPacked: "OrderPickedPacked",
-	NotificationEvent: "Notification",
-	Error:             "Error",
+	OrderReceived:        "OrderReceived",
+	OrderConfirmed:       "OrderConfirmed",
+	OrderPickedPacked:    "OrderPickedPacked",
+	NotificationEvent:    "Notification",
+	Error:                "Error",
+	OrderRejected:        "OrderRejected",
+	OrderCancelled:       "OrderCancelled",
+	ReleaseStock:         "ReleaseStock",
+	CancelShipment:       "CancelShipment",
+	CancellationAnswered: "CancellationAnswered",
 }
 
+// CurrentEnvelopeVersion is the version of the Event envelope written by this
+// package. Version 1 envelopes (which have no envelopeVersion field) carried
+// the body as a string of escaped JSON; from version 2 the body is a nested
+// JSON object, as described by the files in schemas/.
+const CurrentEnvelopeVersion = 2
+
 type Event struct {
-	EventId      string  `json:"eventId"`
-	EventName    string  `json:"eventName"`
-	Timestamp    string  `json:"timestamp"`
-	EventBody    string  `json:"eventBody"`
-	ErrorMessage *string `json:"errorMessage,omitempty"`
+	EventId         string `json:"eventId"`
+	EventName       string `json:"eventName"`
+	EnvelopeVersion int    `json:"envelopeVersion"`
+	// SchemaVersion is the version of the body's schema for this event name;
+	// see RegisterUpcaster
+	SchemaVersion int    `json:"schemaVersion"`
+	Timestamp     string `json:"timestamp"`
+	// CorrelationId ties together every event in an order's lifecycle; it is
+	// the order ID for order and notification events
+	CorrelationId string          `json:"correlationId,omitempty"`
+	EventBody     json.RawMessage `json:"eventBody"`
+	ErrorMessage  *string         `json:"errorMessage,omitempty"`
 }
 
-func NewEvent(eventType EventType, eventBody string) *Event {
+func NewEvent(eventType EventType, eventBody json.RawMessage) *Event {
 	// Generate a new UUID for eventId
 	u, err := uuid.NewV4()
 	if err != nil {
@@ -47,11 +70,23 @@ func NewEvent(eventType EventType, eventBody string) *Event {
 	timestamp := now.Format(time.RFC3339)
 
 	return &Event{
-		EventId:   u.String(),
-		EventName: OrderStatus[eventType],
-		Timestamp: timestamp,
-		EventBody: eventBody,
+		EventId:         u.String(),
+		EventName:       OrderStatus[eventType],
+		EnvelopeVersion: CurrentEnvelopeVersion,
+		SchemaVersion:   SchemaVersion(OrderStatus[eventType]),
+		Timestamp:       timestamp,
+		EventBody:       eventBody,
+	}
+}
+
+// NewEventFrom creates an event of the given type that carries the body and
+// correlation ID of source, for services passing an order on to the next stage.
+func NewEventFrom(eventType EventType, source *Event) *Event {
+	event := NewEvent(eventType, source.EventBody)
+	if event != nil {
+		event.CorrelationId = source.CorrelationId
 	}
+	return event
 }
 
 func NewEventFromBytes(value []byte) (*Event, error) {
@@ -62,6 +97,58 @@ func NewEventFromBytes(value []byte) (*Event, error) {
 	return event, nil
 }
 
+// UnmarshalJSON decodes both envelope versions. A version 1 body, a JSON
+// string holding escaped JSON, is unwrapped into the nested form, and a body
+// written with an older schema version is upcast to the current one, so
+// callers only ever see the current layout while old messages are still in
+// flight.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type envelope Event // no methods, so no recursion
+	var decoded envelope
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	if len(decoded.EventBody) > 0 && decoded.EventBody[0] == '"' {
+		var body string
+		if err := json.Unmarshal(decoded.EventBody, &body); err != nil {
+			return fmt.Errorf("failed to decode string eventBody: %w", err)
+		}
+		// Anything that isn't JSON is kept as the JSON string it arrived as
+		if json.Valid([]byte(body)) {
+			decoded.EventBody = json.RawMessage(body)
+		}
+	}
+	if decoded.EnvelopeVersion == 0 {
+		decoded.EnvelopeVersion = 1
+	}
+	if decoded.SchemaVersion == 0 {
+		decoded.SchemaVersion = 1
+	}
+
+	*e = Event(decoded)
+	return e.upcast()
+}
+
+// DecodeBody decodes the body of event into a new T.
+func DecodeBody[T any](event *Event) (*T, error) {
+	body := new(T)
+	if err := json.Unmarshal(event.EventBody, body); err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %w", event.EventName, err)
+	}
+	return body, nil
+}
+
+// Order decodes the body of an order event.
+func (e *Event) Order() (*Order, error) {
+	return DecodeBody[Order](e)
+}
+
+// Notification decodes the body of a Notification event.
+func (e *Event) Notification() (*Notification, error) {
+	return DecodeBody[Notification](e)
+}
+
 /****************************************************************************************
  * Order implementation
  * This is expected input into the system and will be used to process orders
@@ -73,13 +160,17 @@ type OrderItem struct {
 	Price    float64 `json:"price"`
 }
 
+// DefaultCurrency is the currency of orders that don't specify one.
+const DefaultCurrency = "USD"
+
 // OrderBody represents the body of the OrderReceived event.
 type Order struct {
-	OrderID     string      `json:"orderId"`
+	OrderID     string      `json:"orderId"` // generated by the order service if absent
 	CustomerID  string      `json:"customerId"`
 	OrderDate   time.Time   `json:"orderDate"`
 	Items       []OrderItem `json:"items"`
 	TotalAmount float64     `json:"totalAmount"`
+	Currency    string      `json:"currency"` // ISO 4217 code, since schema version 2
 }
 
 func NewOrderFromBytes(value []byte) (*Order, error) {
@@ -90,6 +181,7 @@ func NewOrderFromBytes(value []byte) (*Order, error) {
 	return order, nil
 }
 
+// ToEvent creates an event of the given type with the order as its body.
 func (o *Order) ToEvent(eventType EventType) (*Event, error) {
 	var oJSON []byte
 	var err error
@@ -97,7 +189,11 @@ func (o *Order) ToEvent(eventType EventType) (*Event, error) {
 		return nil, err
 	}
 
-	return NewEvent(eventType, string(oJSON)), nil
+	event := NewEvent(eventType, oJSON)
+	if event != nil {
+		event.CorrelationId = o.OrderID
+	}
+	return event, nil
 }
 
 /****************************************************************************************
@@ -110,11 +206,13 @@ type NotificationType int
 const (
 	OrderFulfilled NotificationType = iota
 	OrderShipped
+	CancellationConfirmed
 )
 
 var NotificationStatus = map[NotificationType]string{
-	OrderFulfilled: "OrderFulfilled",
-	OrderShipped:   "OrderShipped",
+	OrderFulfilled:        "OrderFulfilled",
+	OrderShipped:          "OrderShipped",
+	CancellationConfirmed: "CancellationConfirmed",
 }
 
 type Notification struct {
@@ -139,6 +237,7 @@ func NewNotificationFromBytes(value []byte) (*Notification, error) {
 	return notification, nil
 }
 
+// ToEvent creates a Notification event with the notification as its body.
 func (n *Notification) ToEvent() (*Event, error) {
 	var nJSON []byte
 	var err error
@@ -146,5 +245,237 @@ func (n *Notification) ToEvent() (*Event, error) {
 		return nil, err
 	}
 
-	return NewEvent(NotificationEvent, string(nJSON)), nil
+	event := NewEvent(NotificationEvent, nJSON)
+	if event != nil {
+		event.CorrelationId = n.OrderID
+	}
+	return event, nil
+}
+
+/****************************************************************************************
+ * Rejection implementation
+ * Published by the inventory service for orders it cannot fill
+ ****************************************************************************************/
+
+// RejectedOutOfStock is the reason of a rejection for lack of stock.
+const RejectedOutOfStock = "OutOfStock"
+
+// StockShortage is an item of a rejected order that is short of stock.
+type StockShortage struct {
+	ItemID    string `json:"itemId"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// Rejection is the body of an OrderRejected event: the order, why it was
+// rejected and, when it was out of stock, the items that were short.
+type Rejection struct {
+	Order
+	Reason    string          `json:"reason"`
+	Shortages []StockShortage `json:"shortages,omitempty"`
+}
+
+// NewRejectionEvent creates an OrderRejected event for order.
+func NewRejectionEvent(order *Order, reason string, shortages []StockShortage) (*Event, error) {
+	var rJSON []byte
+	var err error
+	if rJSON, err = json.Marshal(&Rejection{Order: *order, Reason: reason, Shortages: shortages}); err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(OrderRejected, rJSON)
+	if event != nil {
+		event.CorrelationId = order.OrderID
+	}
+	return event, nil
+}
+
+// Rejection decodes the body of an OrderRejected event.
+func (e *Event) Rejection() (*Rejection, error) {
+	return DecodeBody[Rejection](e)
+}
+
+/****************************************************************************************
+ * Cancellation implementation
+ * Published by the order service when a customer cancels an order
+ ****************************************************************************************/
+
+// Cancellation is the body of an OrderCancelled event: the order the customer
+// asked to cancel. Whether it can still be cancelled is up to the services
+// downstream.
+type Cancellation struct {
+	Order
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewCancellationEvent creates an OrderCancelled event for order.
+func NewCancellationEvent(order *Order, reason string) (*Event, error) {
+	var cJSON []byte
+	var err error
+	if cJSON, err = json.Marshal(&Cancellation{Order: *order, Reason: reason}); err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(OrderCancelled, cJSON)
+	if event != nil {
+		event.CorrelationId = order.OrderID
+	}
+	return event, nil
+}
+
+// Cancellation decodes the body of an OrderCancelled event.
+func (e *Event) Cancellation() (*Cancellation, error) {
+	return DecodeBody[Cancellation](e)
+}
+
+// CancellationReply is the body of a CancellationAnswered event: the answer of a
+// service to a request to stop an order. Accepted means the service has
+// recorded the cancellation and won't take the order any further.
+type CancellationReply struct {
+	OrderID string `json:"orderId"`
+	// Service is the service answering, e.g. "warehouse" or "shipper"
+	Service string `json:"service"`
+	// Request is the name of the event answered, e.g. OrderCancelled
+	Request  string `json:"request"`
+	Accepted bool   `json:"accepted"`
+	// Reason says why the request was refused
+	Reason string `json:"reason,omitempty"`
+}
+
+// NewCancellationReplyEvent creates a CancellationAnswered event carrying reply.
+func NewCancellationReplyEvent(reply *CancellationReply) (*Event, error) {
+	var rJSON []byte
+	var err error
+	if rJSON, err = json.Marshal(reply); err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(CancellationAnswered, rJSON)
+	if event != nil {
+		event.CorrelationId = reply.OrderID
+	}
+	return event, nil
+}
+
+// CancellationReply decodes the body of a CancellationAnswered event.
+func (e *Event) CancellationReply() (*CancellationReply, error) {
+	return DecodeBody[CancellationReply](e)
+}
+
+/****************************************************************************************
+ * Compensation implementation
+ * Commands published by the orchestrator to undo the steps of a failed order
+ ****************************************************************************************/
+
+// Compensation is the body of a ReleaseStock or CancelShipment command: the
+// order to undo and the step whose failure made it necessary.
+type Compensation struct {
+	OrderID    string `json:"orderId"`
+	FailedStep string `json:"failedStep"`
+	Reason     string `json:"reason"`
+}
+
+// NewCompensationEvent creates a command of the given type undoing a step of
+// the order named in compensation.
+func NewCompensationEvent(eventType EventType, compensation *Compensation) (*Event, error) {
+	var cJSON []byte
+	var err error
+	if cJSON, err = json.Marshal(compensation); err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(eventType, cJSON)
+	if event != nil {
+		event.CorrelationId = compensation.OrderID
+	}
+	return event, nil
+}
+
+// Compensation decodes the body of a ReleaseStock or CancelShipment command.
+func (e *Event) Compensation() (*Compensation, error) {
+	return DecodeBody[Compensation](e)
+}
+
+/****************************************************************************************
+ * Error implementation
+ * Published to the error topic when a service cannot process an event
+ ****************************************************************************************/
+
+// Kinds of ErrorReport.
+const (
+	// ErrorKindFailure reports an event that could not be processed.
+	ErrorKindFailure = "failure"
+	// ErrorKindDuplicate reports an event skipped because it was processed
+	// before, which redelivery makes routine; the order itself is fine.
+	ErrorKindDuplicate = "duplicate"
+)
+
+// ErrorReport is the body of an Error event.
+type ErrorReport struct {
+	ErrorMessage string `json:"errorMessage"`
+	FailedEvent  *Event `json:"failedEvent"`
+	Kind         string `json:"kind,omitempty"` // ErrorKindFailure if empty
+}
+
+// Failure reports whether the failed event could not be processed, as
+// opposed to having been skipped as a duplicate. Reports without a kind,
+// published before kinds existed, are failures.
+func (r *ErrorReport) Failure() bool {
+	return r.Kind == "" || r.Kind == ErrorKindFailure
+}
+
+// NewErrorEvent creates an Error event reporting that failed could not be processed.
+// The event keeps the correlation ID of the failed event.
+func NewErrorEvent(failed *Event, errorMessage string) (*Event, error) {
+	return newErrorEvent(failed, errorMessage, ErrorKindFailure)
+}
+
+// NewDuplicateEvent creates an Error event reporting that failed was skipped
+// as a duplicate.
+func NewDuplicateEvent(failed *Event, errorMessage string) (*Event, error) {
+	return newErrorEvent(failed, errorMessage, ErrorKindDuplicate)
+}
+
+func newErrorEvent(failed *Event, errorMessage, kind string) (*Event, error) {
+	var rJSON []byte
+	var err error
+	if rJSON, err = json.Marshal(&ErrorReport{ErrorMessage: errorMessage, FailedEvent: failed, Kind: kind}); err != nil {
+		return nil, err
+	}
+
+	event := NewEvent(Error, rJSON)
+	if event != nil {
+		event.CorrelationId = failed.CorrelationId
+		event.ErrorMessage = &errorMessage
+	}
+	return event, nil
+}
+
+// ErrorReport decodes the body of an Error event. Error events published
+// before ErrorReport existed were the failed event itself, renamed to Error
+// with the message in ErrorMessage; those are returned as a report whose
+// failed event has the original body but no name.
+func (e *Event) ErrorReport() (*ErrorReport, error) {
+	report, err := DecodeBody[ErrorReport](e)
+	if err != nil {
+		return nil, err
+	}
+	if report.FailedEvent != nil {
+		return report, nil
+	}
+
+	legacy := &ErrorReport{
+		FailedEvent: &Event{
+			EventId:         e.EventId,
+			EnvelopeVersion: e.EnvelopeVersion,
+			SchemaVersion:   e.SchemaVersion,
+			Timestamp:       e.Timestamp,
+			CorrelationId:   e.CorrelationId,
+			EventBody:       e.EventBody,
+		},
+	}
+	if e.ErrorMessage != nil {
+		legacy.ErrorMessage = *e.ErrorMessage
+	}
+	return legacy, nil
 }
@@ -0,0 +1,98 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Upcaster transforms an event body from one schema version to the next.
+type Upcaster func(body json.RawMessage) (json.RawMessage, error)
+
+type upcasterKey struct {
+	eventName   string
+	fromVersion int
+}
+
+var (
+	upcastersMu sync.RWMutex
+	upcasters   = map[upcasterKey]Upcaster{}
+	// schemaVersions holds the current body schema version per event name,
+	// for event names that have moved past version 1
+	schemaVersions = map[string]int{}
+)
+
+func init() {
+	// Version 2 of the order payload added the currency. Every event whose
+	// body is an order (or embeds one) defaulted to it before then.
+	for _, eventName := range []string{
+		OrderStatus[OrderReceived],
+		OrderStatus[OrderConfirmed],
+		OrderStatus[OrderPickedPacked],
+		OrderStatus[NotificationEvent],
+	} {
+		RegisterUpcaster(eventName, 1, addDefaultCurrency)
+	}
+}
+
+// RegisterUpcaster registers fn to turn bodies of eventName at schema version
+// fromVersion into version fromVersion+1. The current schema version of an
+// event name is one past the highest version with an upcaster, so changing a
+// payload means registering the upcaster from the previous version.
+func RegisterUpcaster(eventName string, fromVersion int, fn Upcaster) {
+	upcastersMu.Lock()
+	defer upcastersMu.Unlock()
+
+	upcasters[upcasterKey{eventName, fromVersion}] = fn
+	if fromVersion+1 > schemaVersions[eventName] {
+		schemaVersions[eventName] = fromVersion + 1
+	}
+}
+
+// SchemaVersion returns the current body schema version for eventName.
+func SchemaVersion(eventName string) int {
+	upcastersMu.RLock()
+	defer upcastersMu.RUnlock()
+
+	if version, ok := schemaVersions[eventName]; ok {
+		return version
+	}
+	return 1
+}
+
+// upcast brings the body of e up to the current schema version of its event
+// name, one version at a time. Bodies from a newer version than this build
+// knows about are left alone.
+func (e *Event) upcast() error {
+	current := SchemaVersion(e.EventName)
+
+	upcastersMu.RLock()
+	defer upcastersMu.RUnlock()
+
+	for e.SchemaVersion < current {
+		fn, ok := upcasters[upcasterKey{e.EventName, e.SchemaVersion}]
+		if !ok {
+			return fmt.Errorf("no upcaster for %s schema version %d", e.EventName, e.SchemaVersion)
+		}
+		body, err := fn(e.EventBody)
+		if err != nil {
+			return fmt.Errorf("upcasting %s from schema version %d: %w", e.EventName, e.SchemaVersion, err)
+		}
+		e.EventBody = body
+		e.SchemaVersion++
+	}
+	return nil
+}
+
+// addDefaultCurrency upcasts an order payload from version 1, which had no
+// currency, to version 2.
+func addDefaultCurrency(body json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["currency"]; !ok {
+		fields["currency"] = json.RawMessage(`"` + DefaultCurrency + `"`)
+	}
+	return json.Marshal(fields)
+}
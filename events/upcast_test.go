@@ -0,0 +1,155 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fixture decodes testdata/name, an event as it was once published.
+func fixture(t *testing.T, name string) *Event {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := NewEventFromBytes(data)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", name, err)
+	}
+	return event
+}
+
+// assertFixtureOrder checks the order every order fixture carries, with the
+// currency version 2 added.
+func assertFixtureOrder(t *testing.T, order *Order) {
+	t.Helper()
+	if order.OrderID != "ORD-20241216-0001" || order.CustomerID != "CUST-1001" {
+		t.Errorf("order %s of %s, want ORD-20241216-0001 of CUST-1001", order.OrderID, order.CustomerID)
+	}
+	if len(order.Items) != 2 || order.Items[0].ItemID != "ITEM-001" || order.Items[0].Quantity != 2 {
+		t.Errorf("items %+v", order.Items)
+	}
+	if order.TotalAmount != 66.75 {
+		t.Errorf("total %v, want 66.75", order.TotalAmount)
+	}
+	if order.Currency != DefaultCurrency {
+		t.Errorf("currency %q, want %q", order.Currency, DefaultCurrency)
+	}
+}
+
+func TestUpcastOrderFixtures(t *testing.T) {
+	for name, envelopeVersion := range map[string]int{
+		"v1_order_received.json":           1,
+		"v1_order_confirmed.json":          1,
+		"v1_order_picked_packed.json":      1,
+		"v2_order_received_schema_v1.json": 2,
+	} {
+		t.Run(name, func(t *testing.T) {
+			event := fixture(t, name)
+			if event.EnvelopeVersion != envelopeVersion {
+				t.Errorf("EnvelopeVersion = %d, want %d", event.EnvelopeVersion, envelopeVersion)
+			}
+			if event.SchemaVersion != 2 {
+				t.Errorf("SchemaVersion = %d, want 2", event.SchemaVersion)
+			}
+			if event.EventBody[0] != '{' {
+				t.Errorf("body is not a nested object: %s", event.EventBody)
+			}
+			order, err := event.Order()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertFixtureOrder(t, order)
+		})
+	}
+}
+
+func TestUpcastNotificationFixture(t *testing.T) {
+	event := fixture(t, "v1_notification.json")
+	if event.SchemaVersion != 2 {
+		t.Errorf("SchemaVersion = %d, want 2", event.SchemaVersion)
+	}
+	notification, err := event.Notification()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notification.Type != 1 {
+		t.Errorf("notificationType %d, want 1", notification.Type)
+	}
+	assertFixtureOrder(t, &notification.Order)
+}
+
+func TestUpcastErrorFixture(t *testing.T) {
+	// Before ErrorReport, an Error event was the failed event renamed
+	event := fixture(t, "v1_error.json")
+	if event.EnvelopeVersion != 1 || event.SchemaVersion != 1 {
+		t.Errorf("versions %d/%d, want 1/1", event.EnvelopeVersion, event.SchemaVersion)
+	}
+	report, err := event.ErrorReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ErrorMessage != "Failed to process event: Failed to process event" {
+		t.Errorf("errorMessage %q", report.ErrorMessage)
+	}
+	var order Order
+	if err := json.Unmarshal(report.FailedEvent.EventBody, &order); err != nil {
+		t.Fatalf("failed event body: %v", err)
+	}
+	if order.OrderID != "ORD-20241216-0001" || order.TotalAmount != 66.75 {
+		t.Errorf("failed order %+v", order)
+	}
+	// Reports from before kinds existed are failures
+	if !report.Failure() {
+		t.Error("legacy report isn't a failure")
+	}
+}
+
+func TestErrorReportKinds(t *testing.T) {
+	failed := fixture(t, "v1_order_confirmed.json")
+	for _, tc := range []struct {
+		newEvent func(*Event, string) (*Event, error)
+		kind     string
+		failure  bool
+	}{
+		{NewErrorEvent, ErrorKindFailure, true},
+		{NewDuplicateEvent, ErrorKindDuplicate, false},
+	} {
+		event, err := tc.newEvent(failed, "message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := NewEventFromBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := decoded.ErrorReport()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Kind != tc.kind || report.Failure() != tc.failure {
+			t.Errorf("%s report: kind %q, Failure() = %v", tc.kind, report.Kind, report.Failure())
+		}
+	}
+}
+
+func TestUpcastLeavesNewerSchemaAlone(t *testing.T) {
+	data := []byte(`{"eventName": "OrderReceived", "envelopeVersion": 2, "schemaVersion": 3,
+		"eventBody": {"orderId": "ORD-1", "currency": "EUR", "giftWrap": true}}`)
+	event, err := NewEventFromBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.SchemaVersion != 3 {
+		t.Errorf("SchemaVersion = %d, want 3", event.SchemaVersion)
+	}
+	if string(event.EventBody) != `{"orderId": "ORD-1", "currency": "EUR", "giftWrap": true}` {
+		t.Errorf("body changed to %s", event.EventBody)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// cancellationServices are the services that must each stop an order before
+// inventory confirms its cancellation and releases its stock.
+var cancellationServices = []string{"warehouse", "shipper"}
+
+// Cancellations collects, for each cancelled order, the order and the answers
+// of the services that must stop it, in a db.ValueStore. Like Stock, every
+// change is a compare-and-swap retried when another change got in first, so
+// whichever replica sees the last of the cancellation and its answers
+// decides, and only one does. Decided cancellations are kept so that a
+// redelivered answer isn't taken for a new one.
+type Cancellations struct {
+	store db.ValueStore
+}
+
+// cancellation is what Cancellations keeps in the store for an order.
+type cancellation struct {
+	Order   *events.Order   `json:"order,omitempty"` // nil until OrderCancelled is seen
+	Answers map[string]bool `json:"answers"`         // by service: whether it accepted
+	Decided bool            `json:"decided"`
+}
+
+// Decision is the outcome of a cancellation every service has answered.
+type Decision struct {
+	Order events.Order
+	// Refused lists the services that couldn't stop the order; the
+	// cancellation is confirmed only if there are none
+	Refused []string
+}
+
+// Accepted reports whether every service stopped the order.
+func (d *Decision) Accepted() bool {
+	return len(d.Refused) == 0
+}
+
+// NewCancellations creates a Cancellations kept in store.
+func NewCancellations(store db.ValueStore) *Cancellations {
+	return &Cancellations{store: store}
+}
+
+// Request records that order was cancelled. It returns the decision if the
+// services have already answered, and nil otherwise.
+func (c *Cancellations) Request(order events.Order) (*Decision, error) {
+	return c.decide(order.OrderID, func(state *cancellation) {
+		state.Order = &order
+	})
+}
+
+// Answer records the answer of a service. It returns the decision if this
+// was the last thing missing, and nil otherwise; an answer already recorded
+// is kept.
+func (c *Cancellations) Answer(orderID, service string, accepted bool) (*Decision, error) {
+	return c.decide(orderID, func(state *cancellation) {
+		if _, ok := state.Answers[service]; !ok {
+			state.Answers[service] = accepted
+		}
+	})
+}
+
+// Reopen undoes the decision on an order's cancellation when acting on it
+// failed, so that it is decided again when the cancellation or an answer is
+// redelivered.
+func (c *Cancellations) Reopen(orderID string) error {
+	return c.update(orderID, func(state *cancellation) bool {
+		if !state.Decided {
+			return false
+		}
+		state.Decided = false
+		return true
+	})
+}
+
+// decide applies record to the cancellation of an order and, if it can now
+// be decided, marks it decided and returns the decision.
+func (c *Cancellations) decide(orderID string, record func(state *cancellation)) (*Decision, error) {
+	var decision *Decision
+	err := c.update(orderID, func(state *cancellation) bool {
+		decision = nil
+		record(state)
+		if state.Decided || state.Order == nil {
+			return true
+		}
+		var refused []string
+		for _, service := range cancellationServices {
+			accepted, ok := state.Answers[service]
+			if !ok {
+				return true
+			}
+			if !accepted {
+				refused = append(refused, service)
+			}
+		}
+		state.Decided = true
+		decision = &Decision{Order: *state.Order, Refused: refused}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decision, nil
+}
+
+// update applies change to the cancellation of an order and stores the
+// result, starting again if another change was stored in the meantime.
+// change reports whether it changed anything; if not, nothing is stored.
+func (c *Cancellations) update(orderID string, change func(state *cancellation) bool) error {
+	key := cancellationKey(orderID)
+	for {
+		current, _, err := c.store.Get(key)
+		if err != nil {
+			return fmt.Errorf("loading cancellation of %s: %w", orderID, err)
+		}
+		state := &cancellation{}
+		if current != "" {
+			if err := json.Unmarshal([]byte(current), state); err != nil {
+				return fmt.Errorf("decoding cancellation of %s: %w", orderID, err)
+			}
+		}
+		if state.Answers == nil {
+			state.Answers = map[string]bool{}
+		}
+		if !change(state) {
+			return nil
+		}
+
+		encoded, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		swapped, err := c.store.CompareAndSwap(key, current, string(encoded))
+		if err != nil {
+			return fmt.Errorf("storing cancellation of %s: %w", orderID, err)
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// cancellationKey is the store key holding the cancellation of an order.
+func cancellationKey(orderID string) string {
+	return "cancellation:" + orderID
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+)
+
+func testOrder(orderID string) events.Order {
+	return events.Order{OrderID: orderID, CustomerID: "CUST-1", TotalAmount: 1,
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+}
+
+// eventMessage returns a message carrying event.
+func eventMessage(t *testing.T, topic string, event *events.Event, err error) *kafka.Message {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kafka.Message{Topic: topic, Value: value}
+}
+
+func answerMessage(t *testing.T, orderID, service string, accepted bool) *kafka.Message {
+	t.Helper()
+	event, err := events.NewCancellationReplyEvent(&events.CancellationReply{
+		OrderID: orderID, Service: service, Request: events.OrderStatus[events.OrderCancelled], Accepted: accepted,
+	})
+	return eventMessage(t, "order-cancellation-reply", event, err)
+}
+
+func TestCancellationWaitsForEveryService(t *testing.T) {
+	cancellations := NewCancellations(db.NewSimpleDatabase())
+
+	// Answers may come before inventory sees the cancellation itself
+	if decision, err := cancellations.Answer("ORD-1", "shipper", true); err != nil || decision != nil {
+		t.Fatalf("Answer(shipper) = %+v, %v; want no decision yet", decision, err)
+	}
+	if decision, err := cancellations.Request(testOrder("ORD-1")); err != nil || decision != nil {
+		t.Fatalf("Request = %+v, %v; want no decision before the warehouse answers", decision, err)
+	}
+	decision, err := cancellations.Answer("ORD-1", "warehouse", true)
+	if err != nil || decision == nil {
+		t.Fatalf("Answer(warehouse) = %+v, %v; want a decision", decision, err)
+	}
+	if !decision.Accepted() || decision.Order.OrderID != "ORD-1" {
+		t.Fatalf("decision %+v; want ORD-1 accepted", decision)
+	}
+
+	// A redelivered answer is not decided again, unless acting on the
+	// decision failed
+	if decision, err := cancellations.Answer("ORD-1", "warehouse", true); err != nil || decision != nil {
+		t.Fatalf("redelivered Answer = %+v, %v; want no decision", decision, err)
+	}
+	if err := cancellations.Reopen("ORD-1"); err != nil {
+		t.Fatal(err)
+	}
+	if decision, err := cancellations.Answer("ORD-1", "warehouse", true); err != nil || decision == nil {
+		t.Fatalf("Answer after Reopen = %+v, %v; want a decision", decision, err)
+	}
+}
+
+func TestCancellationDecidedOnceAcrossReplicas(t *testing.T) {
+	store := db.NewSimpleDatabase()
+	for i := 0; i < 50; i++ {
+		orderID := fmt.Sprintf("ORD-%d", i)
+		var wg sync.WaitGroup
+		decisions := make(chan *Decision, 3)
+		record := func(decide func(c *Cancellations) (*Decision, error)) {
+			defer wg.Done()
+			// Each replica has its own Cancellations over the shared store
+			decision, err := decide(NewCancellations(store))
+			if err != nil {
+				t.Error(err)
+			}
+			decisions <- decision
+		}
+		wg.Add(3)
+		go record(func(c *Cancellations) (*Decision, error) { return c.Request(testOrder(orderID)) })
+		go record(func(c *Cancellations) (*Decision, error) { return c.Answer(orderID, "warehouse", true) })
+		go record(func(c *Cancellations) (*Decision, error) { return c.Answer(orderID, "shipper", true) })
+		wg.Wait()
+		close(decisions)
+
+		decided := 0
+		for decision := range decisions {
+			if decision != nil {
+				decided++
+			}
+		}
+		if decided != 1 {
+			t.Fatalf("%s decided %d times; want once", orderID, decided)
+		}
+	}
+}
+
+func TestShipperRefusalKeepsStock(t *testing.T) {
+	store := db.NewSimpleDatabase()
+	stock := stockOf(t, store, map[string]int{"ITEM-1": 1})
+	order := testOrder("ORD-1")
+	if err := store.Add(order.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	if shortages, err := stock.Reserve(order.OrderID, order.Items); err != nil || len(shortages) > 0 {
+		t.Fatalf("Reserve = %+v, %v", shortages, err)
+	}
+	cancellations := NewCancellations(store)
+	cancel := CancelMessageWrapper(store, stock, cancellations, &KafkaProducers{})
+	answer := AnswerMessageWrapper(store, stock, cancellations, &KafkaProducers{})
+
+	cancelled, err := events.NewCancellationEvent(&order, "changed my mind")
+	if err := cancel(context.Background(), eventMessage(t, "order-cancelled", cancelled, err)); err != nil {
+		t.Fatal(err)
+	}
+	if err := answer(context.Background(), answerMessage(t, order.OrderID, "warehouse", true)); err != nil {
+		t.Fatal(err)
+	}
+	if holds, err := stock.Holds(order.OrderID); err != nil || !holds {
+		t.Fatalf("Holds before the shipper answers = %v, %v; want true", holds, err)
+	}
+
+	// The order has shipped: nothing is confirmed and the stock is kept for
+	// the shipment
+	if err := answer(context.Background(), answerMessage(t, order.OrderID, "shipper", false)); err != nil {
+		t.Fatal(err)
+	}
+	if holds, err := stock.Holds(order.OrderID); err != nil || !holds {
+		t.Fatalf("Holds after the shipper refused = %v, %v; want true", holds, err)
+	}
+	assertLevel(t, stock, "ITEM-1", 1, 1)
+}
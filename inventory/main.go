@@ -2,12 +2,11 @@ package main
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/gin-gonic/gin"
@@ -16,14 +15,39 @@ import (
 	errors "github.com/tankcdr/ppe-kafka-go/error"
 	events "github.com/tankcdr/ppe-kafka-go/events"
 	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
 )
 
 // Config holds the environment configuration
 type Config struct {
-	Broker              string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
-	OrderReceivedTopic  string `env:"KAFKA_ORDER_RECEIVED" envDefault:"order-received"`
-	OrderConfirmedTopic string `env:"KAFKA_ORDER_CONFIRMED" envDefault:"order-confirmed"`
-	ErrorTopic          string `env:"KAFKA_ERROR" envDefault:"error"`
+	Broker                 string        `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
+	OrderReceivedTopic     string        `env:"KAFKA_ORDER_RECEIVED" envDefault:"order-received"`
+	OrderConfirmedTopic    string        `env:"KAFKA_ORDER_CONFIRMED" envDefault:"order-confirmed"`
+	OrderRejectedTopic     string        `env:"KAFKA_ORDER_REJECTED" envDefault:"order-rejected"`
+	ErrorTopic             string        `env:"KAFKA_ERROR" envDefault:"error"`
+	OrderNotificationTopic string        `env:"KAFKA_ORDER_NOTIFICATION" envDefault:"order-notification"`
+	OrderCancelledTopic    string        `env:"KAFKA_ORDER_CANCELLED" envDefault:"order-cancelled"`
+	CancellationReplyTopic string        `env:"KAFKA_CANCELLATION_REPLY" envDefault:"order-cancellation-reply"`
+	CompensationTopic      string        `env:"KAFKA_ORDER_COMPENSATION" envDefault:"order-compensation"`
+	DeadLetterTopic        string        `env:"KAFKA_DEAD_LETTER" envDefault:"inventory-dlq"`
+	MaxAttempts            int           `env:"KAFKA_MAX_ATTEMPTS" envDefault:"5"`
+	ShutdownTimeout        time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter         string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//store of processed orders: "memory", "bolt" to keep them across restarts, or
+	//"redis" to share them between replicas (DB_PATH is then the server URL)
+	StoreBackend string        `env:"DB_BACKEND" envDefault:"memory"`
+	StorePath    string        `env:"DB_PATH" envDefault:"inventory.db"`
+	StoreTTL     time.Duration `env:"DB_TTL" envDefault:"0s"`
+	//quantities on hand at startup, a JSON object of item ID to quantity; empty for no stock
+	StockFile string `env:"STOCK_FILE" envDefault:"stock.json"`
+	//reservations of orders neither shipped nor failed by then are released; 0 keeps them
+	ReservationTimeout time.Duration `env:"RESERVATION_TIMEOUT" envDefault:"30m"`
+	//consume and produce in Kafka transactions (exactly-once) when set; unique per instance
+	TransactionalID string `env:"KAFKA_TRANSACTIONAL_ID"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -34,46 +58,101 @@ type AppDependencies struct {
 
 type KafkaProducers struct {
 	OrderConfirmedProducer *kafka.KafkaProducer
+	OrderRejectedProducer  *kafka.KafkaProducer
+	NotificationProducer   *kafka.KafkaProducer
 	ErrorProducer          *kafka.KafkaProducer
 }
 
 // ProcessMessage processes the consumed Kafka message
-func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) func(key, value []byte) error {
-	return func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+func ProcessMessageWrapper(db db.Store, stock *Stock, validator *schemas.Validator, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
 
 		var event *events.Event
 		var order *events.Order
 		var err error
-		context := context.Background()
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
 
+		// Validate the event against its schema; invalid events are reported on the error topic
+		if err := validator.ValidateEvent(event); err != nil {
+			return errors.HandleError(ctx, event, producers.ErrorProducer, err.Error())
+		}
+
 		// Unmarshal the order
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		if order, err = event.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
 
 		// Enforce order idempotence
 		// idea is that order ids are unique, but they are embedded in the order object
-		// using an in memory store, but would want a real db for this
-		if db.Exists(order.OrderID) {
+		// the store is in memory unless DB_BACKEND selects a persistent one
+		// Claiming the ID checks and records it in one step, so concurrent
+		// deliveries of the same order can't both pass
+		claimed, err := db.AddIfAbsent(order.OrderID)
+		if err != nil {
+			log.Printf("Failed to record %s: %v\n", order.OrderID, err)
+			return err
+		}
+		if !claimed {
 			errorString := fmt.Sprintf("Order %s is a duplicate", order.OrderID)
-			return errors.HandleError(context, event, producers.ErrorProducer, errorString)
+			return errors.HandleDuplicate(ctx, event, producers.ErrorProducer, errorString)
 		}
-		db.Add(order.OrderID)
+		// Release the claim if this attempt is retried or its transaction
+		// aborts, so the redelivery isn't mistaken for a duplicate
+		kafka.OnAbort(ctx, func() {
+			if err := db.Delete(order.OrderID); err != nil {
+				log.Printf("Failed to release %s: %v\n", order.OrderID, err)
+			}
+		})
 		log.Printf("Order %s is unique\n", order.OrderID)
 
+		// An order cancelled before it got here is dropped without reserving
+		cancelled, err := db.Exists(cancelledKey(order.OrderID))
+		if err != nil {
+			log.Printf("Failed to look up cancellation of %s: %v\n", order.OrderID, err)
+			return err
+		}
+		if cancelled {
+			log.Printf("Order %s was cancelled, not confirming it\n", order.OrderID)
+			return nil
+		}
+
+		// Reserve the stock of every item, or reject the order if any is short
+		shortages, err := stock.Reserve(order.OrderID, order.Items)
+		if err != nil {
+			log.Printf("Failed to reserve stock for %s: %v\n", order.OrderID, err)
+			return err
+		}
+		if len(shortages) > 0 {
+			log.Printf("Order %s is out of stock: %+v\n", order.OrderID, shortages)
+			rejectedEvent, err := events.NewRejectionEvent(order, events.RejectedOutOfStock, shortages)
+			if err != nil {
+				return errors.HandleError(ctx, event, producers.ErrorProducer, "Failed to create OrderRejected event")
+			}
+			if err := producers.OrderRejectedProducer.Publish(ctx, rejectedEvent); err != nil {
+				log.Printf("Failed to produce OrderRejected event: %v\n", err)
+				return fmt.Errorf("Failed to produce OrderRejected event: %v", err)
+			}
+			log.Printf("Published OrderRejected event: %v\n", rejectedEvent)
+			return nil
+		}
+		// Give the stock back if the order isn't confirmed after all
+		kafka.OnAbort(ctx, func() {
+			releaseStock(stock, order.OrderID)
+		})
+
 		// Publish a new OrderConfirmed event to Kafka
-		confirmedEvent := events.NewEvent(events.OrderConfirmed, event.EventBody)
-		if err := producers.OrderConfirmedProducer.Publish(context, confirmedEvent); err != nil {
+		confirmedEvent := events.NewEventFrom(events.OrderConfirmed, event)
+		if err := producers.OrderConfirmedProducer.Publish(ctx, confirmedEvent); err != nil {
+			releaseStock(stock, order.OrderID)
 			errorString := fmt.Sprintf("Failed to produce OrderConfirmed event: %v\n", err)
-			return errors.HandleError(context, event, producers.ErrorProducer, errorString)
+			return errors.HandleError(ctx, event, producers.ErrorProducer, errorString)
 		}
 		log.Printf("Published OrderConfirmed event: %v\n", confirmedEvent)
 
@@ -81,6 +160,336 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 	}
 }
 
+// CancelMessageWrapper records cancelled orders. The cancellation is
+// confirmed, and the stock released, once the warehouse and the shipper have
+// both stopped the order; see AnswerMessageWrapper
+func CancelMessageWrapper(db db.Store, stock *Stock, cancellations *Cancellations, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var cancellation *events.Cancellation
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+		if event.EventName != events.OrderStatus[events.OrderCancelled] {
+			return nil
+		}
+		// Unmarshal the cancellation
+		if cancellation, err = event.Cancellation(); err != nil {
+			log.Printf("Failed to unmarshal cancellation: %v\n", err)
+			return err
+		}
+		orderID := cancellation.OrderID
+
+		// Record the cancellation, so the order is dropped if it hasn't been
+		// received yet; a redelivered cancellation is ignored
+		claimed, err := db.AddIfAbsent(cancelledKey(orderID))
+		if err != nil {
+			log.Printf("Failed to record cancellation of %s: %v\n", orderID, err)
+			return err
+		}
+		if !claimed {
+			log.Printf("Cancellation of order %s is a duplicate\n", orderID)
+			return nil
+		}
+		kafka.OnAbort(ctx, func() {
+			if err := db.Delete(cancelledKey(orderID)); err != nil {
+				log.Printf("Failed to release cancellation of %s: %v\n", orderID, err)
+			}
+		})
+
+		decision, err := cancellations.Request(cancellation.Order)
+		if err != nil {
+			log.Printf("Failed to record cancellation of %s: %v\n", orderID, err)
+			return err
+		}
+		if decision == nil {
+			log.Printf("Order %s cancelled, waiting for the warehouse and the shipper to stop it\n", orderID)
+			return nil
+		}
+		return confirmCancellation(ctx, db, stock, cancellations, producers, decision)
+	}
+}
+
+// AnswerMessageWrapper records the answers of the warehouse and the shipper
+// to cancellations, confirming each cancellation once both have answered
+func AnswerMessageWrapper(db db.Store, stock *Stock, cancellations *Cancellations, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var reply *events.CancellationReply
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+		if event.EventName != events.OrderStatus[events.CancellationAnswered] {
+			return nil
+		}
+		// Unmarshal the reply
+		if reply, err = event.CancellationReply(); err != nil {
+			log.Printf("Failed to unmarshal cancellation reply: %v\n", err)
+			return err
+		}
+		if reply.Request != events.OrderStatus[events.OrderCancelled] {
+			return nil
+		}
+
+		decision, err := cancellations.Answer(reply.OrderID, reply.Service, reply.Accepted)
+		if err != nil {
+			log.Printf("Failed to record the answer of %s to the cancellation of %s: %v\n", reply.Service, reply.OrderID, err)
+			return err
+		}
+		if decision == nil {
+			log.Printf("Order %s: %s answered the cancellation (accepted: %t)\n", reply.OrderID, reply.Service, reply.Accepted)
+			return nil
+		}
+		return confirmCancellation(ctx, db, stock, cancellations, producers, decision)
+	}
+}
+
+// confirmCancellation acts on the decision on a cancellation: unless a
+// service refused it or the order has gone too far, the cancellation is
+// confirmed to the customer and the order's stock released
+func confirmCancellation(ctx context.Context, db db.Store, stock *Stock, cancellations *Cancellations,
+	producers *KafkaProducers, decision *Decision) error {
+	orderID := decision.Order.OrderID
+
+	// Decide again on a retry
+	kafka.OnAbort(ctx, func() {
+		if err := cancellations.Reopen(orderID); err != nil {
+			log.Printf("Failed to reopen cancellation of %s: %v\n", orderID, err)
+		}
+	})
+
+	if !decision.Accepted() {
+		log.Printf("Order %s can no longer be cancelled: refused by %v\n", orderID, decision.Refused)
+		return nil
+	}
+
+	// The order can be cancelled while it holds stock, i.e. until it ships,
+	// or if inventory hasn't seen it yet. Both are kept in the shared
+	// store, so this holds whichever replica reserved the stock
+	received, err := db.Exists(orderID)
+	if err != nil {
+		log.Printf("Failed to look up %s: %v\n", orderID, err)
+		return err
+	}
+	holds, err := stock.Holds(orderID)
+	if err != nil {
+		log.Printf("Failed to look up the reservation of %s: %v\n", orderID, err)
+		return err
+	}
+	if received && !holds {
+		log.Printf("Order %s can no longer be cancelled: it has shipped, or was rejected or failed\n", orderID)
+		return nil
+	}
+
+	// Confirm the cancellation to the customer
+	notificationEvent, err := events.NewNotification(events.CancellationConfirmed, &decision.Order).ToEvent()
+	if err != nil {
+		log.Printf("Failed to create Notification event: %v\n", err)
+		return err
+	}
+	if err := producers.NotificationProducer.Publish(ctx, notificationEvent); err != nil {
+		log.Printf("Failed to produce Notification event: %v\n", err)
+		return fmt.Errorf("Failed to produce Notification event: %v", err)
+	}
+
+	// Release the stock only once the cancellation is announced, so a
+	// retry finds the reservation again
+	released, err := stock.Release(orderID)
+	if err != nil {
+		log.Printf("Failed to release the stock of %s: %v\n", orderID, err)
+		return err
+	}
+	if released {
+		log.Printf("Order %s cancelled, stock released\n", orderID)
+	} else {
+		log.Printf("Order %s cancelled before it was received\n", orderID)
+	}
+	return nil
+}
+
+// CompensationMessageWrapper releases the stock of orders the orchestrator
+// compensates with a ReleaseStock command
+func CompensationMessageWrapper(stock *Stock) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.ReleaseStock] {
+			return nil
+		}
+
+		var event *events.Event
+		var compensation *events.Compensation
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+		if event.EventName != events.OrderStatus[events.ReleaseStock] {
+			return nil
+		}
+		// Unmarshal the command
+		if compensation, err = event.Compensation(); err != nil {
+			log.Printf("Failed to unmarshal compensation: %v\n", err)
+			return err
+		}
+
+		released, err := stock.Release(compensation.OrderID)
+		if err != nil {
+			log.Printf("Failed to release the stock of %s: %v\n", compensation.OrderID, err)
+			return err
+		}
+		if released {
+			log.Printf("Released stock of order %s: %s\n", compensation.OrderID, compensation.Reason)
+		} else {
+			log.Printf("Order %s holds no stock to release\n", compensation.OrderID)
+		}
+		return nil
+	}
+}
+
+// cancelledKey is the store key recording that an order was cancelled
+func cancelledKey(orderID string) string {
+	return "cancelled:" + orderID
+}
+
+// ReleaseMessageWrapper releases the stock reserved for orders that failed
+// after inventory confirmed them, as reported on the error topic
+func ReleaseMessageWrapper(stock *Stock) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.Error] {
+			return nil
+		}
+
+		var event *events.Event
+		var report *events.ErrorReport
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+		if event.EventName != events.OrderStatus[events.Error] {
+			return nil
+		}
+		// Unmarshal the error report
+		if report, err = event.ErrorReport(); err != nil {
+			log.Printf("Failed to unmarshal error report: %v\n", err)
+			return err
+		}
+
+		// A redelivered event skipped as a duplicate says nothing about the order
+		if !report.Failure() {
+			return nil
+		}
+		// Only the warehouse and the shipper fail orders holding stock; errors
+		// about OrderReceived events are inventory's own
+		failedEvent := report.FailedEvent.EventName
+		if failedEvent != events.OrderStatus[events.OrderConfirmed] && failedEvent != events.OrderStatus[events.OrderPickedPacked] {
+			return nil
+		}
+
+		orderID := event.CorrelationId
+		if orderID == "" {
+			order, err := report.FailedEvent.Order()
+			if err != nil {
+				log.Printf("Failed to unmarshal order: %v\n", err)
+				return err
+			}
+			orderID = order.OrderID
+		}
+		released, err := stock.Release(orderID)
+		if err != nil {
+			log.Printf("Failed to release the stock of %s: %v\n", orderID, err)
+			return err
+		}
+		if released {
+			log.Printf("Released stock of order %s after %s failed: %s\n", orderID, failedEvent, report.ErrorMessage)
+		}
+		return nil
+	}
+}
+
+// FulfilMessageWrapper takes the stock reserved for shipped orders off hand
+func FulfilMessageWrapper(stock *Stock) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.NotificationEvent] {
+			return nil
+		}
+
+		var event *events.Event
+		var notification *events.Notification
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+		if event.EventName != events.OrderStatus[events.NotificationEvent] {
+			return nil
+		}
+		// Unmarshal the Notification
+		if notification, err = event.Notification(); err != nil {
+			log.Printf("Failed to unmarshal notification: %v\n", err)
+			return err
+		}
+		if notification.Type != int(events.OrderShipped) {
+			return nil
+		}
+
+		fulfilled, err := stock.Fulfil(notification.OrderID)
+		if err != nil {
+			log.Printf("Failed to take the stock of %s off hand: %v\n", notification.OrderID, err)
+			return err
+		}
+		if fulfilled {
+			log.Printf("Order %s shipped, stock taken off hand\n", notification.OrderID)
+		} else {
+			log.Printf("Order %s shipped without a reservation; stock on hand is not reduced\n", notification.OrderID)
+		}
+		return nil
+	}
+}
+
+// releaseStock gives back the stock of an order whose confirmation failed
+func releaseStock(stock *Stock, orderID string) {
+	if _, err := stock.Release(orderID); err != nil {
+		log.Printf("Failed to release the stock of %s: %v\n", orderID, err)
+	}
+}
+
+// expireReservations releases reservations older than timeout until ctx is
+// cancelled. Every replica runs it; the store lets only one release each
+// reservation
+func expireReservations(ctx context.Context, stock *Stock, timeout time.Duration) {
+	ticker := time.NewTicker(min(timeout, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := stock.ReleaseExpired(now.Add(-timeout))
+			if err != nil {
+				log.Printf("Failed to release expired reservations: %v\n", err)
+			}
+			for _, orderID := range expired {
+				log.Printf("Released stock of order %s, reserved over %v ago\n", orderID, timeout)
+			}
+		}
+	}
+}
+
 func main() {
 	// Load configuration
 	var cfg Config
@@ -88,37 +497,192 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create "database" for in-memory idempotence check
-	db := db.NewSimpleDatabase()
+	// Read and write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the event schemas used to validate published and consumed events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Open the store of processed orders used for the idempotence check,
+	// which also holds the stock levels and reservations
+	db, err := db.Open(cfg.StoreBackend, cfg.StorePath, db.WithKeyPrefix("inventory:"), db.WithTTL(cfg.StoreTTL))
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
+
+	// Load the stock levels orders are reserved against, unless another
+	// replica or an earlier run already did
+	stock := NewStock(db)
+	cancellations := NewCancellations(db)
+	if cfg.StockFile != "" {
+		loaded, err := LoadStock(stock, cfg.StockFile)
+		if err != nil {
+			log.Fatalf("Failed to load stock: %v", err)
+		}
+		if !loaded {
+			log.Printf("Stock is already in the store, %s not loaded\n", cfg.StockFile)
+		}
+	}
 
 	// Create Kafka producers
 	producers := KafkaProducers{
 		OrderConfirmedProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.OrderConfirmedTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderConfirmedTopic,
+			Validator:  validator,
+			Source:     "inventory",
+		}),
+		OrderRejectedProducer: kafka.NewProducer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderRejectedTopic,
+			Validator:  validator,
+			Source:     "inventory",
+		}),
+		NotificationProducer: kafka.NewProducer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderNotificationTopic,
+			Validator:  validator,
+			Source:     "inventory",
 		}),
 		ErrorProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.ErrorTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.ErrorTopic,
+			Validator:  validator,
+			Source:     "inventory",
 		}),
 	}
-	defer producers.OrderConfirmedProducer.Close()
-	defer producers.ErrorProducer.Close()
 
 	// Define Kafka configuration
 	kafkaConfigConsumer := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.OrderReceivedTopic,
-		GroupID: "inventory-group",
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderReceivedTopic,
+		GroupID:    "inventory-group",
+		// Commit only after the order has been processed so a crash mid-handler
+		// redelivers it instead of dropping it
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+		TransactionalID: cfg.TransactionalID,
 	}
 
-	// Create KafkaConsumer instance
-	consumer := kafka.NewConsumer(kafkaConfigConsumer)
-	defer consumer.Close()
+	// Create the consumer; with a transactional ID, the events published for
+	// an order are committed atomically with its offset
+	var consumer kafka.Consumer
+	if cfg.TransactionalID != "" {
+		if consumer, err = kafka.NewTransactionalConsumer(kafkaConfigConsumer); err != nil {
+			log.Fatalf("Failed to create transactional consumer: %v", err)
+		}
+	} else {
+		consumer = kafka.NewConsumer(kafkaConfigConsumer)
+	}
 
-	// Set up a context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Consumers releasing, fulfilling, cancelling and compensating
+	// reservations, and collecting the answers to cancellations, each in its
+	// own group as they read other topics
+	releaseConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.ErrorTopic,
+		GroupID:    "inventory-release-group",
+		// Retry while the store can't be reached rather than skip the order
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+	})
+	fulfilConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderNotificationTopic,
+		GroupID:    "inventory-fulfil-group",
+		// Retry while the store can't be reached rather than skip the order
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+	})
+	cancelConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderCancelledTopic,
+		GroupID:    "inventory-cancel-group",
+		// Retry cancellations whose notification couldn't be published
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+	})
+	answerConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.CancellationReplyTopic,
+		GroupID:    "inventory-answer-group",
+		// Retry cancellations whose notification couldn't be published
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+	})
+	compensationConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.CompensationTopic,
+		GroupID:    "inventory-compensation-group",
+		// Retry while the store can't be reached rather than skip the order
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+	})
+
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each order; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "inventory", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+	coordinator.OnShutdown("Database", func(context.Context) error {
+		return db.Close()
+	})
 
 	// Start REST server in a goroutine
 	router := gin.Default()
@@ -128,36 +692,156 @@ func main() {
 		c.String(http.StatusOK, "ok")
 	})
 
+	// stock endpoints
+	router.GET("/stock", getStock(stock))
+	router.GET("/stock/:itemId", getStockItem(stock))
+	router.PUT("/stock/:itemId", putStockItem(stock))
+	router.POST("/stock/:itemId/adjust", adjustStockItem(stock))
+
 	// /shutdown endpoint
 	router.POST("/shutdown", func(c *gin.Context) {
 		log.Println("Shutdown request received")
-		cancel() // Signal the Kafka consumer to stop
+		coordinator.Cancel() // Signal the Kafka consumer to stop
 		c.String(http.StatusOK, "Shutting down")
 	})
 
-	// Start the REST server
-	go func() {
-		if err := router.Run(":8080"); err != nil {
-			log.Fatalf("Failed to start REST server: %v\n", err)
-		}
-	}()
-
-	// Handle graceful shutdown signals
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Println("Received shutdown signal")
-		cancel()
-	}()
+	// Start the REST server. Shutdown hooks run in reverse order once the
+	// consumer has finished its current message: producers are flushed, the
+	// consumer is closed and the REST server stops last.
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+	coordinator.OnShutdown("Kafka consumer", func(context.Context) error {
+		return consumer.Close()
+	})
+	coordinator.OnShutdown("Release consumer", func(context.Context) error {
+		return releaseConsumer.Close()
+	})
+	coordinator.OnShutdown("Fulfil consumer", func(context.Context) error {
+		return fulfilConsumer.Close()
+	})
+	coordinator.OnShutdown("Cancel consumer", func(context.Context) error {
+		return cancelConsumer.Close()
+	})
+	coordinator.OnShutdown("Answer consumer", func(context.Context) error {
+		return answerConsumer.Close()
+	})
+	coordinator.OnShutdown("Compensation consumer", func(context.Context) error {
+		return compensationConsumer.Close()
+	})
+	coordinator.OnShutdown("OrderConfirmedProducer", func(context.Context) error {
+		return producers.OrderConfirmedProducer.Close()
+	})
+	coordinator.OnShutdown("OrderRejectedProducer", func(context.Context) error {
+		return producers.OrderRejectedProducer.Close()
+	})
+	coordinator.OnShutdown("NotificationProducer", func(context.Context) error {
+		return producers.NotificationProducer.Close()
+	})
+	coordinator.OnShutdown("ErrorProducer", func(context.Context) error {
+		return producers.ErrorProducer.Close()
+	})
 
 	// Start consuming Kafka messages
-	go func() {
+	coordinator.Go("Kafka consumer", func(ctx context.Context) {
 		log.Println("Starting Kafka consumer...")
-		consumer.Consume(ctx, ProcessMessageWrapper(db, &producers))
-	}()
+		consumer.Consume(ctx, ProcessMessageWrapper(db, stock, validator, &producers))
+	})
+	coordinator.Go("Release consumer", func(ctx context.Context) {
+		releaseConsumer.Consume(ctx, ReleaseMessageWrapper(stock))
+	})
+	coordinator.Go("Fulfil consumer", func(ctx context.Context) {
+		fulfilConsumer.Consume(ctx, FulfilMessageWrapper(stock))
+	})
+	coordinator.Go("Cancel consumer", func(ctx context.Context) {
+		cancelConsumer.Consume(ctx, CancelMessageWrapper(db, stock, cancellations, &producers))
+	})
+	coordinator.Go("Answer consumer", func(ctx context.Context) {
+		answerConsumer.Consume(ctx, AnswerMessageWrapper(db, stock, cancellations, &producers))
+	})
+	coordinator.Go("Compensation consumer", func(ctx context.Context) {
+		compensationConsumer.Consume(ctx, CompensationMessageWrapper(stock))
+	})
+	if cfg.ReservationTimeout > 0 {
+		coordinator.Go("Reservation expiry", func(ctx context.Context) {
+			expireReservations(ctx, stock, cfg.ReservationTimeout)
+		})
+	}
+
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
+}
+
+// getStock handles the GET /stock route
+func getStock(stock *Stock) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		levels, err := stock.Levels()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, levels)
+	}
+}
+
+// getStockItem handles the GET /stock/:itemId route
+func getStockItem(stock *Stock) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		level, ok, err := stock.Level(c.Param("itemId"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Item %s is not stocked", c.Param("itemId"))})
+			return
+		}
+		c.JSON(http.StatusOK, level)
+	}
+}
+
+// putStockItem handles the PUT /stock/:itemId route
+// expects a JSON payload of {"onHand": n}
+func putStockItem(stock *Stock) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			OnHand *int `json:"onHand" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		level, err := stock.SetOnHand(c.Param("itemId"), *request.OnHand)
+		respondStockChange(c, level, err)
+	}
+}
 
-	// Wait for the context to be canceled (e.g., via /shutdown or signal)
-	<-ctx.Done()
-	log.Println("Service is shutting down...")
+// adjustStockItem handles the POST /stock/:itemId/adjust route
+// expects a JSON payload of {"delta": n}, negative to remove stock
+func adjustStockItem(stock *Stock) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request struct {
+			Delta *int `json:"delta" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		level, err := stock.Adjust(c.Param("itemId"), *request.Delta)
+		respondStockChange(c, level, err)
+	}
+}
+
+func respondStockChange(c *gin.Context, level StockLevel, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, level)
+	case goerrors.Is(err, ErrNegativeStock):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "stock": level})
+	case goerrors.Is(err, ErrBelowReserved):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "stock": level})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+)
+
+// errorMessage returns a message of the error topic reporting that the
+// OrderConfirmed event of orderID failed or was a duplicate.
+func errorMessage(t *testing.T, orderID string, duplicate bool) *kafka.Message {
+	t.Helper()
+	order := events.Order{OrderID: orderID, CustomerID: "CUST-1", TotalAmount: 1,
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+	confirmed, err := order.ToEvent(events.OrderConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEvent := events.NewErrorEvent
+	if duplicate {
+		newEvent = events.NewDuplicateEvent
+	}
+	report, err := newEvent(confirmed, "Notification "+orderID+" is a duplicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kafka.Message{Topic: "order-error", Value: value}
+}
+
+func TestReleaseIgnoresDuplicateReports(t *testing.T) {
+	stock := stockOf(t, db.NewSimpleDatabase(), map[string]int{"ITEM-1": 1})
+	if shortages, err := stock.Reserve("ORD-1", []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1}}); err != nil || len(shortages) > 0 {
+		t.Fatalf("Reserve = %+v, %v", shortages, err)
+	}
+	release := ReleaseMessageWrapper(stock)
+
+	// The warehouse saw OrderConfirmed again and skipped it; the order is fine
+	if err := release(context.Background(), errorMessage(t, "ORD-1", true)); err != nil {
+		t.Fatal(err)
+	}
+	if holds, err := stock.Holds("ORD-1"); err != nil || !holds {
+		t.Fatalf("Holds after a duplicate report = %v, %v; want true", holds, err)
+	}
+
+	// Pick & pack failing releases the stock
+	if err := release(context.Background(), errorMessage(t, "ORD-1", false)); err != nil {
+		t.Fatal(err)
+	}
+	if holds, err := stock.Holds("ORD-1"); err != nil || holds {
+		t.Fatalf("Holds after a failure = %v, %v; want false", holds, err)
+	}
+	assertLevel(t, stock, "ITEM-1", 1, 0)
+}
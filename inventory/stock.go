@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+var (
+	// ErrNegativeStock is returned for a change that would leave less than
+	// nothing on hand.
+	ErrNegativeStock = errors.New("stock on hand cannot be negative")
+	// ErrBelowReserved is returned for a change that would leave less on hand
+	// than is reserved for orders.
+	ErrBelowReserved = errors.New("stock on hand cannot drop below the reserved quantity")
+)
+
+// stockKey is the store key holding the stock levels and reservations.
+const stockKey = "stock:state"
+
+// StockLevel is the stock of one item. Reserved units are on hand but held
+// for accepted orders.
+type StockLevel struct {
+	ItemID   string `json:"itemId"`
+	OnHand   int    `json:"onHand"`
+	Reserved int    `json:"reserved"`
+}
+
+// Available returns the units that can still be reserved.
+func (l StockLevel) Available() int {
+	return l.OnHand - l.Reserved
+}
+
+// MarshalJSON adds the available quantity.
+func (l StockLevel) MarshalJSON() ([]byte, error) {
+	type level StockLevel // no methods, so no recursion
+	return json.Marshal(struct {
+		level
+		Available int `json:"available"`
+	}{level(l), l.Available()})
+}
+
+// Stock holds the stock levels keyed by item ID, and the reservations made
+// for each order, in a db.ValueStore. Every change is a compare-and-swap of
+// the whole state, retried when another change got in first, so replicas
+// sharing a Redis store see the same stock and never reserve a unit twice,
+// and reservations outlive a restart with a persistent store.
+type Stock struct {
+	store db.ValueStore
+}
+
+// stockState is what Stock keeps in the store.
+type stockState struct {
+	Levels       map[string]*storedLevel `json:"levels"`
+	Reservations map[string]*reservation `json:"reservations"` // by order ID
+}
+
+type storedLevel struct {
+	OnHand   int `json:"onHand"`
+	Reserved int `json:"reserved"`
+}
+
+// reservation is the stock held for one order.
+type reservation struct {
+	Items      map[string]int `json:"items"` // item ID -> quantity
+	ReservedAt time.Time      `json:"reservedAt"`
+}
+
+// NewStock creates a Stock kept in store. Until stock is set, every item is
+// out of stock.
+func NewStock(store db.ValueStore) *Stock {
+	return &Stock{store: store}
+}
+
+// LoadStock reads the quantities on hand in the JSON file at path, an object
+// mapping item IDs to quantities, into stock, unless stock has been set up
+// before, by another replica or before a restart. It reports whether it did.
+func LoadStock(stock *Stock, path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var onHand map[string]int
+	if err := json.Unmarshal(data, &onHand); err != nil {
+		return false, fmt.Errorf("decoding %s: %w", path, err)
+	}
+
+	state := newStockState()
+	for itemID, quantity := range onHand {
+		if quantity < 0 {
+			return false, fmt.Errorf("%s: item %s: %w", path, itemID, ErrNegativeStock)
+		}
+		state.Levels[itemID] = &storedLevel{OnHand: quantity}
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	return stock.store.CompareAndSwap(stockKey, "", string(encoded))
+}
+
+// Reserve reserves the items of an order, all or nothing. If any item is
+// short, nothing is reserved and the shortages are returned. Reserving for an
+// order that already holds a reservation changes nothing.
+func (s *Stock) Reserve(orderID string, items []events.OrderItem) ([]events.StockShortage, error) {
+	// An item may be listed more than once
+	requested := map[string]int{}
+	for _, item := range items {
+		requested[item.ItemID] += item.Quantity
+	}
+
+	var shortages []events.StockShortage
+	err := s.update(func(state *stockState) (bool, error) {
+		shortages = nil
+		if _, ok := state.Reservations[orderID]; ok {
+			return false, nil
+		}
+
+		for itemID, quantity := range requested {
+			available := state.level(itemID).Available()
+			if quantity > available {
+				shortages = append(shortages, events.StockShortage{ItemID: itemID, Requested: quantity, Available: available})
+			}
+		}
+		if len(shortages) > 0 {
+			sort.Slice(shortages, func(i, j int) bool { return shortages[i].ItemID < shortages[j].ItemID })
+			return false, nil
+		}
+
+		for itemID, quantity := range requested {
+			if level, ok := state.Levels[itemID]; ok {
+				level.Reserved += quantity
+			}
+		}
+		state.Reservations[orderID] = &reservation{Items: requested, ReservedAt: time.Now().UTC()}
+		return true, nil
+	})
+	return shortages, err
+}
+
+// Release gives back the stock reserved for an order, and reports whether
+// there was a reservation.
+func (s *Stock) Release(orderID string) (bool, error) {
+	var released bool
+	err := s.update(func(state *stockState) (bool, error) {
+		released = state.release(orderID, false)
+		return released, nil
+	})
+	return released, err
+}
+
+// Holds reports whether stock is reserved for an order.
+func (s *Stock) Holds(orderID string) (bool, error) {
+	state, _, err := s.load()
+	if err != nil {
+		return false, err
+	}
+	_, ok := state.Reservations[orderID]
+	return ok, nil
+}
+
+// Fulfil takes the stock reserved for an order off hand once the order has
+// left the warehouse, and reports whether there was a reservation.
+func (s *Stock) Fulfil(orderID string) (bool, error) {
+	var fulfilled bool
+	err := s.update(func(state *stockState) (bool, error) {
+		fulfilled = state.release(orderID, true)
+		return fulfilled, nil
+	})
+	return fulfilled, err
+}
+
+// ReleaseExpired releases the reservations made before cutoff and returns the
+// IDs of their orders.
+func (s *Stock) ReleaseExpired(cutoff time.Time) ([]string, error) {
+	var expired []string
+	err := s.update(func(state *stockState) (bool, error) {
+		expired = nil
+		for orderID, r := range state.Reservations {
+			if r.ReservedAt.Before(cutoff) {
+				state.release(orderID, false)
+				expired = append(expired, orderID)
+			}
+		}
+		return len(expired) > 0, nil
+	})
+	sort.Strings(expired)
+	return expired, err
+}
+
+// Levels returns the stock levels of all known items, ordered by item ID.
+func (s *Stock) Levels() ([]StockLevel, error) {
+	state, _, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	levels := make([]StockLevel, 0, len(state.Levels))
+	for itemID := range state.Levels {
+		levels = append(levels, state.level(itemID))
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].ItemID < levels[j].ItemID })
+	return levels, nil
+}
+
+// Level returns the stock level of an item, and whether the item is known.
+func (s *Stock) Level(itemID string) (StockLevel, bool, error) {
+	state, _, err := s.load()
+	if err != nil {
+		return StockLevel{ItemID: itemID}, false, err
+	}
+	_, ok := state.Levels[itemID]
+	return state.level(itemID), ok, nil
+}
+
+// SetOnHand sets the quantity on hand of an item, e.g. after a stock take.
+func (s *Stock) SetOnHand(itemID string, onHand int) (StockLevel, error) {
+	return s.setOnHand(itemID, func(int) int { return onHand })
+}
+
+// Adjust changes the quantity on hand of an item by delta, e.g. for a
+// delivery or a write-off.
+func (s *Stock) Adjust(itemID string, delta int) (StockLevel, error) {
+	return s.setOnHand(itemID, func(current int) int { return current + delta })
+}
+
+// setOnHand updates or adds an item, with its new quantity on hand computed
+// from the current one.
+func (s *Stock) setOnHand(itemID string, onHand func(current int) int) (StockLevel, error) {
+	var level StockLevel
+	err := s.update(func(state *stockState) (bool, error) {
+		level = state.level(itemID)
+		quantity := onHand(level.OnHand)
+		if quantity < 0 {
+			return false, ErrNegativeStock
+		}
+		if quantity < level.Reserved {
+			return false, ErrBelowReserved
+		}
+
+		level.OnHand = quantity
+		state.Levels[itemID] = &storedLevel{OnHand: level.OnHand, Reserved: level.Reserved}
+		return true, nil
+	})
+	return level, err
+}
+
+// update applies change to the current state and stores the result, starting
+// again from the new state if another change was stored in the meantime.
+// change reports whether it changed anything; if not, or if it fails, nothing
+// is stored.
+func (s *Stock) update(change func(state *stockState) (bool, error)) error {
+	for {
+		state, current, err := s.load()
+		if err != nil {
+			return err
+		}
+		changed, err := change(state)
+		if err != nil || !changed {
+			return err
+		}
+
+		encoded, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		swapped, err := s.store.CompareAndSwap(stockKey, current, string(encoded))
+		if err != nil {
+			return fmt.Errorf("storing stock: %w", err)
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// load returns the stored state, and its encoding for CompareAndSwap.
+func (s *Stock) load() (*stockState, string, error) {
+	current, _, err := s.store.Get(stockKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("loading stock: %w", err)
+	}
+	state := newStockState()
+	if current != "" {
+		if err := json.Unmarshal([]byte(current), state); err != nil {
+			return nil, "", fmt.Errorf("decoding stock: %w", err)
+		}
+	}
+	return state, current, nil
+}
+
+func newStockState() *stockState {
+	return &stockState{
+		Levels:       map[string]*storedLevel{},
+		Reservations: map[string]*reservation{},
+	}
+}
+
+// level returns the stock level of an item; unknown items have none.
+func (s *stockState) level(itemID string) StockLevel {
+	level := StockLevel{ItemID: itemID}
+	if stored, ok := s.Levels[itemID]; ok {
+		level.OnHand, level.Reserved = stored.OnHand, stored.Reserved
+	}
+	return level
+}
+
+// release drops the reservation of an order, also taking its stock off hand
+// if fulfilled.
+func (s *stockState) release(orderID string, fulfilled bool) bool {
+	r, ok := s.Reservations[orderID]
+	if !ok {
+		return false
+	}
+	for itemID, quantity := range r.Items {
+		level, ok := s.Levels[itemID]
+		if !ok {
+			continue // nothing of it was reserved
+		}
+		level.Reserved -= quantity
+		if fulfilled {
+			level.OnHand -= quantity
+		}
+	}
+	delete(s.Reservations, orderID)
+	return true
+}
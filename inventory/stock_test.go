@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// stockOf returns a Stock in store with the given quantities on hand.
+func stockOf(t *testing.T, store db.ValueStore, onHand map[string]int) *Stock {
+	t.Helper()
+	stock := NewStock(store)
+	for itemID, quantity := range onHand {
+		if _, err := stock.SetOnHand(itemID, quantity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stock
+}
+
+func assertLevel(t *testing.T, stock *Stock, itemID string, onHand, reserved int) {
+	t.Helper()
+	level, _, err := stock.Level(itemID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level.OnHand != onHand || level.Reserved != reserved {
+		t.Fatalf("%s: %d on hand, %d reserved; want %d, %d", itemID, level.OnHand, level.Reserved, onHand, reserved)
+	}
+}
+
+func TestReserveAllOrNothing(t *testing.T) {
+	stock := stockOf(t, db.NewSimpleDatabase(), map[string]int{"ITEM-1": 5, "ITEM-2": 1})
+
+	shortages, err := stock.Reserve("ORD-1", []events.OrderItem{{ItemID: "ITEM-1", Quantity: 2}, {ItemID: "ITEM-2", Quantity: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shortages) != 1 || shortages[0] != (events.StockShortage{ItemID: "ITEM-2", Requested: 2, Available: 1}) {
+		t.Fatalf("shortages %+v", shortages)
+	}
+	assertLevel(t, stock, "ITEM-1", 5, 0)
+
+	// An item listed twice counts in full
+	items := []events.OrderItem{{ItemID: "ITEM-1", Quantity: 2}, {ItemID: "ITEM-1", Quantity: 1}}
+	if shortages, err := stock.Reserve("ORD-2", items); err != nil || len(shortages) > 0 {
+		t.Fatalf("Reserve = %+v, %v", shortages, err)
+	}
+	// Reserving again for the same order changes nothing
+	if shortages, err := stock.Reserve("ORD-2", items); err != nil || len(shortages) > 0 {
+		t.Fatalf("Reserve again = %+v, %v", shortages, err)
+	}
+	assertLevel(t, stock, "ITEM-1", 5, 3)
+
+	if _, err := stock.SetOnHand("ITEM-1", 2); !errors.Is(err, ErrBelowReserved) {
+		t.Fatalf("SetOnHand below the reservations: %v", err)
+	}
+	if _, err := stock.Adjust("ITEM-1", -6); !errors.Is(err, ErrNegativeStock) {
+		t.Fatalf("Adjust below zero: %v", err)
+	}
+
+	if fulfilled, err := stock.Fulfil("ORD-2"); err != nil || !fulfilled {
+		t.Fatalf("Fulfil = %v, %v", fulfilled, err)
+	}
+	assertLevel(t, stock, "ITEM-1", 2, 0)
+	if released, err := stock.Release("ORD-2"); err != nil || released {
+		t.Fatalf("Release after Fulfil = %v, %v; want false", released, err)
+	}
+}
+
+func TestReplicasNeverOversell(t *testing.T) {
+	store := db.NewSimpleDatabase()
+	stockOf(t, store, map[string]int{"ITEM-1": 10})
+	replicas := []*Stock{NewStock(store), NewStock(store), NewStock(store)}
+
+	var mu sync.Mutex
+	reserved := 0
+	var wg sync.WaitGroup
+	for i := range 25 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			orderID := fmt.Sprintf("ORD-%d", i)
+			shortages, err := replicas[i%len(replicas)].Reserve(orderID, []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1}})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(shortages) == 0 {
+				mu.Lock()
+				reserved++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if reserved != 10 {
+		t.Fatalf("%d orders reserved 10 units", reserved)
+	}
+	assertLevel(t, replicas[0], "ITEM-1", 10, 10)
+
+	// Any replica can release what another reserved
+	for i := range 25 {
+		if _, err := replicas[(i+1)%len(replicas)].Release(fmt.Sprintf("ORD-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertLevel(t, replicas[0], "ITEM-1", 10, 0)
+}
+
+func TestReservationsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "inventory.db")
+	stockFile := filepath.Join(dir, "stock.json")
+	if err := os.WriteFile(stockFile, []byte(`{"ITEM-1": 3}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := db.Open(db.BackendBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stock := NewStock(store)
+	if loaded, err := LoadStock(stock, stockFile); err != nil || !loaded {
+		t.Fatalf("LoadStock = %v, %v", loaded, err)
+	}
+	if shortages, err := stock.Reserve("ORD-1", []events.OrderItem{{ItemID: "ITEM-1", Quantity: 2}}); err != nil || len(shortages) > 0 {
+		t.Fatalf("Reserve = %+v, %v", shortages, err)
+	}
+	store.Close()
+
+	store, err = db.Open(db.BackendBolt, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	stock = NewStock(store)
+	// The stock file doesn't overwrite the stock after a restart
+	if loaded, err := LoadStock(stock, stockFile); err != nil || loaded {
+		t.Fatalf("LoadStock after restart = %v, %v; want false", loaded, err)
+	}
+	if holds, err := stock.Holds("ORD-1"); err != nil || !holds {
+		t.Fatalf("Holds after restart = %v, %v", holds, err)
+	}
+	assertLevel(t, stock, "ITEM-1", 3, 2)
+}
@@ -0,0 +1,110 @@
+package kafka
+
+import (
+	"encoding/json"
+
+	"github.com/hamba/avro/v2"
+	"github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// AvroEventSchema is the Avro schema events are written with. The body is
+// carried as JSON text because its shape depends on the event name.
+const AvroEventSchema = `{
+  "type": "record",
+  "name": "Event",
+  "namespace": "com.tankcdr.ppe.events",
+  "fields": [
+    {"name": "eventId", "type": "string"},
+    {"name": "eventName", "type": "string"},
+    {"name": "envelopeVersion", "type": "int", "default": 1},
+    {"name": "schemaVersion", "type": "int", "default": 1},
+    {"name": "timestamp", "type": "string"},
+    {"name": "correlationId", "type": "string", "default": ""},
+    {"name": "eventBody", "type": "string"},
+    {"name": "errorMessage", "type": ["null", "string"], "default": null}
+  ]
+}`
+
+// avroEvent is the Avro form of events.Event.
+type avroEvent struct {
+	EventId         string  `avro:"eventId"`
+	EventName       string  `avro:"eventName"`
+	EnvelopeVersion int     `avro:"envelopeVersion"`
+	SchemaVersion   int     `avro:"schemaVersion"`
+	Timestamp       string  `avro:"timestamp"`
+	CorrelationId   string  `avro:"correlationId"`
+	EventBody       string  `avro:"eventBody"`
+	ErrorMessage    *string `avro:"errorMessage"`
+}
+
+// AvroSerializer writes events as Avro in the Confluent wire format,
+// registering AvroEventSchema under the "<topic>-value" subject.
+type AvroSerializer struct {
+	schema avro.Schema
+	cache  *schemaCache[avro.Schema]
+}
+
+// NewAvroSerializer creates an AvroSerializer backed by registry.
+func NewAvroSerializer(registry SchemaRegistry) (*AvroSerializer, error) {
+	schema, err := avro.Parse(AvroEventSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AvroSerializer{
+		schema: schema,
+		cache: newSchemaCache(registry, Schema{Type: SchemaTypeAvro, Definition: AvroEventSchema}, func(s Schema) (avro.Schema, error) {
+			return avro.Parse(s.Definition)
+		}),
+	}, nil
+}
+
+func (s *AvroSerializer) Serialize(topic string, event *events.Event) ([]byte, error) {
+	id, err := s.cache.id(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := avro.Marshal(s.schema, &avroEvent{
+		EventId:         event.EventId,
+		EventName:       event.EventName,
+		EnvelopeVersion: event.EnvelopeVersion,
+		SchemaVersion:   event.SchemaVersion,
+		Timestamp:       event.Timestamp,
+		CorrelationId:   event.CorrelationId,
+		EventBody:       string(event.EventBody),
+		ErrorMessage:    event.ErrorMessage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeWire(id, payload), nil
+}
+
+// Deserialize decodes data with the schema it was written with, as recorded
+// in the registry.
+func (s *AvroSerializer) Deserialize(topic string, data []byte) (*events.Event, error) {
+	id, payload, err := decodeWire(data)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := s.cache.writer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded avroEvent
+	if err := avro.Unmarshal(writer, payload, &decoded); err != nil {
+		return nil, err
+	}
+	return &events.Event{
+		EventId:         decoded.EventId,
+		EventName:       decoded.EventName,
+		EnvelopeVersion: decoded.EnvelopeVersion,
+		SchemaVersion:   decoded.SchemaVersion,
+		Timestamp:       decoded.Timestamp,
+		CorrelationId:   decoded.CorrelationId,
+		EventBody:       json.RawMessage(decoded.EventBody),
+		ErrorMessage:    decoded.ErrorMessage,
+	}, nil
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeBroker is an in-process stand-in for Kafka: single-partition topics
+// holding every message written, and the committed offset of each consumer
+// group.
+type fakeBroker struct {
+	mu        sync.Mutex
+	changed   chan struct{} // closed and replaced to wake up blocked readers
+	topics    map[string][]kafka.Message
+	committed map[string]int64 // group/topic → next offset to read
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		changed:   make(chan struct{}),
+		topics:    map[string][]kafka.Message{},
+		committed: map[string]int64{},
+	}
+}
+
+// produce appends one message per value to topic, keyed by the value.
+func (b *fakeBroker) produce(topic string, values ...string) {
+	msgs := make([]kafka.Message, len(values))
+	for i, value := range values {
+		msgs[i] = kafka.Message{Key: []byte(value), Value: []byte(value)}
+	}
+	b.write(topic, msgs...)
+}
+
+func (b *fakeBroker) write(topic string, msgs ...kafka.Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, msg := range msgs {
+		msg.Topic = topic
+		msg.Offset = int64(len(b.topics[topic]))
+		b.topics[topic] = append(b.topics[topic], msg)
+	}
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// messages returns what topic holds.
+func (b *fakeBroker) messages(topic string) []kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kafka.Message(nil), b.topics[topic]...)
+}
+
+// committedOffset returns the next offset group will read from topic.
+func (b *fakeBroker) committedOffset(group, topic string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.committed[group+"/"+topic]
+}
+
+// consumer returns a KafkaConsumer configured by config that reads from and
+// dead-letters to the broker instead of a real one.
+func (b *fakeBroker) consumer(config KafkaConfig) (*KafkaConsumer, *fakeReader) {
+	config.Brokers = []string{"fake:9092"} // never dialled; the reader is replaced
+	consumer := NewConsumer(config)
+	consumer.reader.Close()
+	reader := &fakeReader{broker: b, topic: config.Topic, group: config.GroupID, closed: make(chan struct{})}
+	reader.position = b.committedOffset(reader.group, reader.topic)
+	consumer.reader = reader
+	if consumer.deadLetterWriter != nil {
+		consumer.deadLetterWriter.Close()
+		consumer.deadLetterWriter = &fakeWriter{broker: b, topic: config.DeadLetterTopic}
+	}
+	return consumer, reader
+}
+
+// fakeReader reads a topic of a fakeBroker as a member of a consumer group.
+type fakeReader struct {
+	broker    *fakeBroker
+	topic     string
+	group     string
+	mu        sync.Mutex
+	position  int64
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return kafka.Message{}, err
+		}
+		r.broker.mu.Lock()
+		r.mu.Lock()
+		msgs, position, changed := r.broker.topics[r.topic], r.position, r.broker.changed
+		if position < int64(len(msgs)) {
+			r.position++
+		}
+		r.mu.Unlock()
+		r.broker.mu.Unlock()
+
+		if position < int64(len(msgs)) {
+			return msgs[position], nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-r.closed:
+			return kafka.Message{}, io.EOF
+		case <-changed:
+		}
+	}
+}
+
+func (r *fakeReader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	msg, err := r.FetchMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+	return msg, r.CommitMessages(ctx, msg)
+}
+
+func (r *fakeReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+	for _, msg := range msgs {
+		r.broker.committed[r.group+"/"+r.topic] = msg.Offset + 1
+	}
+	return nil
+}
+
+// rebalance simulates the partition being revoked and assigned again: the
+// reader goes back to the group's committed offset, redelivering whatever
+// was fetched but not committed.
+func (r *fakeReader) rebalance() {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.position = r.broker.committed[r.group+"/"+r.topic]
+	close(r.broker.changed)
+	r.broker.changed = make(chan struct{})
+}
+
+func (r *fakeReader) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return nil
+}
+
+// fakeWriter writes to a topic of a fakeBroker.
+type fakeWriter struct {
+	broker *fakeBroker
+	topic  string
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.broker.write(w.topic, msgs...)
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
@@ -1,7 +1,37 @@
 package kafka
 
+import "github.com/segmentio/kafka-go"
+
+// Header is a Kafka message header.
+type Header = kafka.Header
+
 type KafkaConfig struct {
 	Brokers []string
 	Topic   string
 	GroupID string // Used for consumers
+	// ManualCommit commits a consumer's offset only after its handler succeeds (at-least-once).
+	// When false the offset is committed as soon as the message is read (at-most-once).
+	ManualCommit bool
+	// Workers above 1 makes a consumer handle messages concurrently, keeping messages with
+	// the same key in order. It implies ManualCommit.
+	Workers int
+	// Retry controls how a consumer retries a message whose handler fails.
+	Retry RetryPolicy
+	// DeadLetterTopic receives messages that still fail once Retry is exhausted (consumers).
+	// When empty such messages are logged and skipped.
+	DeadLetterTopic string
+	// Validator, when set, checks every event before a producer publishes it.
+	Validator EventValidator
+	// Serializer encodes events for producers and decodes them for consumers.
+	// Defaults to JSONSerializer.
+	Serializer Serializer
+	// Source names the service a producer publishes for, in the x-source-service header.
+	Source string
+	// TransactionalID identifies a TransactionalConsumer instance to the broker.
+	TransactionalID string
+}
+
+// EventValidator checks a serialized event, e.g. against its JSON schema.
+type EventValidator interface {
+	Validate(event []byte) error
 }
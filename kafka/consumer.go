@@ -2,43 +2,252 @@ package kafka
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"time"
 
 	"github.com/segmentio/kafka-go"
 )
 
+// commitTimeout bounds an offset commit, which may outlive the consume context.
+const commitTimeout = 10 * time.Second
+
+// messageReader is the part of *kafka.Reader a KafkaConsumer uses.
+type messageReader interface {
+	ReadMessage(ctx context.Context) (kafka.Message, error)
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// messageWriter is the part of *kafka.Writer a KafkaConsumer or KafkaProducer
+// uses.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
 type KafkaConsumer struct {
-	reader *kafka.Reader
+	reader           messageReader
+	deadLetterWriter messageWriter
+	groupID          string
+	manualCommit     bool
+	workers          int
+	retry            RetryPolicy
+	serializer       Serializer
 }
 
 // NewConsumer creates a new KafkaConsumer instance.
 func NewConsumer(config KafkaConfig) *KafkaConsumer {
-	return &KafkaConsumer{
+	consumer := &KafkaConsumer{
 		reader: kafka.NewReader(kafka.ReaderConfig{
 			Brokers:     config.Brokers,
 			Topic:       config.Topic,
 			GroupID:     config.GroupID,
 			StartOffset: kafka.FirstOffset, // Change to kafka.LastOffset if needed
+			// Skip messages of aborted transactions (see NewTransactionalConsumer)
+			IsolationLevel: kafka.ReadCommitted,
 		}),
+		groupID:      config.GroupID,
+		manualCommit: config.ManualCommit || config.Workers > 1,
+		workers:      config.Workers,
+		retry:        config.Retry,
+		serializer:   config.Serializer,
+	}
+
+	if config.DeadLetterTopic != "" {
+		consumer.deadLetterWriter = kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  config.Brokers,
+			Topic:    config.DeadLetterTopic,
+			Balancer: &kafka.Hash{},
+		})
 	}
+
+	return consumer
 }
 
-// Consume starts consuming messages and calls the handler for each message.
-func (c *KafkaConsumer) Consume(ctx context.Context, handler func(key, value []byte) error) {
+// Consume starts consuming messages and calls the handler for each message,
+// along with its headers, topic, partition, offset and timestamp. It returns
+// once ctx is cancelled or the consumer is closed; a message that is
+// being handled at that point is finished first.
+//
+// A failing handler is retried according to the consumer's RetryPolicy. Once
+// the attempts are used up the message is forwarded to the dead-letter topic,
+// if one is configured, or logged and skipped.
+//
+// By default the offset is committed when the message is read, so a crash
+// mid-handler loses the message. With ManualCommit set the offset is committed
+// only once the message has been dealt with (handled, dead-lettered or given
+// up on), and a crash before the commit means the message is delivered again
+// after a restart or rebalance. This is at-least-once delivery, so handlers
+// must tolerate seeing a message twice. Errors wrapped with Handled are logged
+// and committed without a retry.
+//
+// With more than one worker, messages are handled concurrently: those sharing
+// a key (the order ID) are still processed one at a time in offset order, and
+// offsets are committed manually once every earlier message of the partition
+// has completed.
+func (c *KafkaConsumer) Consume(ctx context.Context, handler Handler) {
+	if c.workers > 1 {
+		c.consumeConcurrently(ctx, handler)
+		return
+	}
+	if c.manualCommit {
+		c.consumeManual(ctx, handler)
+		return
+	}
+
 	for {
 		msg, err := c.reader.ReadMessage(ctx)
 		if err != nil {
+			if c.stopped(ctx, err) {
+				return
+			}
 			log.Printf("Error reading message: %v\n", err)
 			continue
 		}
 
-		if err := handler(msg.Key, msg.Value); err != nil {
+		if err := c.process(ctx, msg, handler); err != nil {
 			log.Printf("Error handling message: %v\n", err)
 		}
 	}
 }
 
+// consumeManual fetches messages without committing them and commits each
+// offset only after the message has been processed.
+func (c *KafkaConsumer) consumeManual(ctx context.Context, handler Handler) {
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if c.stopped(ctx, err) {
+				return
+			}
+			log.Printf("Error fetching message: %v\n", err)
+			continue
+		}
+
+		// Leave the offset uncommitted if processing was cut short, so the
+		// message is redelivered rather than covered by a later commit.
+		if err := c.process(ctx, msg, handler); err != nil {
+			log.Printf("Stopped processing message %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+			return
+		}
+
+		if err := c.commit(ctx, msg); err != nil {
+			log.Printf("Error committing offset %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+		}
+	}
+}
+
+// commit commits the offset of msg. It goes ahead even if shutdown started
+// while the message was being handled, so the finished message isn't
+// redelivered.
+func (c *KafkaConsumer) commit(ctx context.Context, msg kafka.Message) error {
+	commitCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+	defer cancel()
+	return c.reader.CommitMessages(commitCtx, msg)
+}
+
+// process runs the handler for msg under the retry policy and dead-letters the
+// message if it keeps failing. It returns an error only if ctx was cancelled
+// before the message was dealt with.
+func (c *KafkaConsumer) process(ctx context.Context, msg kafka.Message, handler Handler) error {
+	for attempt := 1; ; attempt++ {
+		err := c.handle(ctx, msg, handler)
+		if err == nil {
+			return nil
+		}
+		if IsHandled(err) {
+			log.Printf("Handled error for message %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+			return nil
+		}
+
+		if c.retry.exhausted(attempt, c.manualCommit) {
+			if c.deadLetterWriter != nil {
+				return c.deadLetter(ctx, msg, attempt, err)
+			}
+			log.Printf("Giving up on message %s/%d@%d after %d attempts: %v\n",
+				msg.Topic, msg.Partition, msg.Offset, attempt, err)
+			return nil
+		}
+
+		wait := c.retry.backoff(attempt)
+		log.Printf("Error handling message %s/%d@%d (attempt %d), retrying in %v: %v\n",
+			msg.Topic, msg.Partition, msg.Offset, attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// stopped reports whether a read error means the consumer should stop: the
+// context was cancelled or the reader was closed.
+func (c *KafkaConsumer) stopped(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, io.EOF)
+}
+
+// handle passes msg to the handler.
+func (c *KafkaConsumer) handle(ctx context.Context, msg kafka.Message, handler Handler) error {
+	message, err := decodeMessage(c.serializer, msg)
+	if err != nil {
+		return err
+	}
+	return runHandler(context.WithoutCancel(ctx), message, c.groupID, handler)
+}
+
+// decodeMessage converts msg for a Handler. Handlers always receive the JSON
+// envelope, so messages in another format are converted first.
+func decodeMessage(serializer Serializer, msg kafka.Message) (*Message, error) {
+	value := msg.Value
+	if serializer != nil {
+		event, err := serializer.Deserialize(msg.Topic, msg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deserialize message: %w", err)
+		}
+		if value, err = json.Marshal(event); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Message{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Time:      msg.Time,
+		Key:       msg.Key,
+		Value:     value,
+		Headers:   msg.Headers,
+	}, nil
+}
+
+// runHandler runs handler for message inside a consumer span. The OnAbort
+// hooks the handler registers run right away if it fails, and are otherwise
+// left to the transaction, if there is one.
+func runHandler(ctx context.Context, message *Message, groupID string, handler Handler) error {
+	ctx, span := startProcessSpan(ctx, message, groupID)
+	a := &attempt{}
+	err := handler(context.WithValue(ctx, attemptKey{}, a), message)
+	endSpan(span, err)
+
+	if err != nil && !IsHandled(err) {
+		runHooks(a.onAbort)
+	} else if tx := transactionFromContext(ctx); tx != nil {
+		tx.onAbort = append(tx.onAbort, a.onAbort...)
+	}
+	return err
+}
+
 // Close closes the Kafka consumer.
 func (c *KafkaConsumer) Close() error {
+	if c.deadLetterWriter != nil {
+		if err := c.deadLetterWriter.Close(); err != nil {
+			log.Printf("Failed to close dead-letter writer: %v\n", err)
+		}
+	}
 	return c.reader.Close()
 }
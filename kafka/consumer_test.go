@@ -0,0 +1,232 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds each consumer run against the fake broker.
+const testTimeout = 10 * time.Second
+
+// consumeUntil runs consumer until handler calls stop, failing the test if
+// that takes longer than testTimeout.
+func consumeUntil(t *testing.T, consumer *KafkaConsumer, handler func(msg *Message, stop func()) error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	consumer.Consume(ctx, func(_ context.Context, msg *Message) error {
+		return handler(msg, cancel)
+	})
+	consumer.Close()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Fatal("consumer timed out")
+	}
+}
+
+// recorder collects the values a handler has seen.
+type recorder struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (r *recorder) add(value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, value)
+}
+
+func (r *recorder) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.values)
+}
+
+func assertValues(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if !slices.Equal(got, want) {
+		t.Fatalf("%s: got %q, want %q", what, got, want)
+	}
+}
+
+func TestManualCommitRedeliversUnfinishedMessage(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "a", "b", "c")
+	config := KafkaConfig{Topic: "orders", GroupID: "manual", ManualCommit: true}
+
+	// The consumer stops while b is failing, so b is never committed
+	var first recorder
+	consumer, _ := broker.consumer(config)
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		first.add(string(msg.Value))
+		if string(msg.Value) == "b" {
+			stop()
+			return errors.New("crashed mid-handler")
+		}
+		return nil
+	})
+	assertValues(t, "first run", first.seen(), "a", "b")
+	if offset := broker.committedOffset("manual", "orders"); offset != 1 {
+		t.Fatalf("committed offset %d after the first run, want 1", offset)
+	}
+
+	// A restarted consumer in the same group starts again from b
+	var second recorder
+	consumer, _ = broker.consumer(config)
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		second.add(string(msg.Value))
+		if string(msg.Value) == "c" {
+			stop()
+		}
+		return nil
+	})
+	assertValues(t, "after restart", second.seen(), "b", "c")
+}
+
+func TestAutoCommitLosesUnfinishedMessage(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "a", "b")
+	config := KafkaConfig{Topic: "orders", GroupID: "auto"}
+
+	consumer, _ := broker.consumer(config)
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		stop()
+		return errors.New("crashed mid-handler")
+	})
+
+	// The offset was committed when a was read, so a restart goes on with b
+	var after recorder
+	consumer, _ = broker.consumer(config)
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		after.add(string(msg.Value))
+		stop()
+		return nil
+	})
+	assertValues(t, "after restart", after.seen(), "b")
+}
+
+func TestRetryThenDeadLetter(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "bad", "good")
+	consumer, _ := broker.consumer(KafkaConfig{
+		Topic:           "orders",
+		GroupID:         "retrying",
+		ManualCommit:    true,
+		Retry:           RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+		DeadLetterTopic: "orders-dlq",
+	})
+
+	var calls recorder
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		calls.add(string(msg.Value))
+		if string(msg.Value) == "bad" {
+			return errors.New("cannot handle bad")
+		}
+		stop()
+		return nil
+	})
+	assertValues(t, "handler calls", calls.seen(), "bad", "bad", "bad", "good")
+
+	dead := broker.messages("orders-dlq")
+	if len(dead) != 1 || string(dead[0].Value) != "bad" || string(dead[0].Key) != "bad" {
+		t.Fatalf("dead-lettered %v, want only bad", dead)
+	}
+	headers := map[string]string{}
+	for _, h := range dead[0].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	for key, want := range map[string]string{
+		HeaderDLQAttempts:        "3",
+		HeaderDLQError:           "cannot handle bad",
+		HeaderDLQSourceTopic:     "orders",
+		HeaderDLQSourcePartition: "0",
+		HeaderDLQSourceOffset:    "0",
+		HeaderDLQConsumerGroup:   "retrying",
+	} {
+		if headers[key] != want {
+			t.Errorf("header %s = %q, want %q", key, headers[key], want)
+		}
+	}
+
+	// Both messages were committed: the dead-lettered one and the handled one
+	if offset := broker.committedOffset("retrying", "orders"); offset != 2 {
+		t.Fatalf("committed offset %d, want 2", offset)
+	}
+}
+
+func TestGiveUpWithoutDeadLetterTopic(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "bad", "good")
+	consumer, _ := broker.consumer(KafkaConfig{
+		Topic:        "orders",
+		GroupID:      "giving-up",
+		ManualCommit: true,
+		Retry:        RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	})
+
+	var calls recorder
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		calls.add(string(msg.Value))
+		if string(msg.Value) == "bad" {
+			return errors.New("cannot handle bad")
+		}
+		stop()
+		return nil
+	})
+	assertValues(t, "handler calls", calls.seen(), "bad", "bad", "good")
+	if offset := broker.committedOffset("giving-up", "orders"); offset != 2 {
+		t.Fatalf("committed offset %d, want 2", offset)
+	}
+}
+
+func TestHandledErrorIsNotRetried(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "duplicate", "fresh")
+	consumer, _ := broker.consumer(KafkaConfig{
+		Topic:           "orders",
+		GroupID:         "handled",
+		ManualCommit:    true,
+		Retry:           RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+		DeadLetterTopic: "orders-dlq",
+	})
+
+	var calls recorder
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		calls.add(string(msg.Value))
+		if string(msg.Value) == "duplicate" {
+			return Handled(errors.New("already processed"))
+		}
+		stop()
+		return nil
+	})
+	assertValues(t, "handler calls", calls.seen(), "duplicate", "fresh")
+	if dead := broker.messages("orders-dlq"); len(dead) != 0 {
+		t.Fatalf("dead-lettered %d messages, want none", len(dead))
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		5: time.Second,
+		9: time.Second,
+	} {
+		if got := policy.backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	if !(RetryPolicy{}).exhausted(1, false) {
+		t.Error("a policy without MaxAttempts should make a single attempt without ManualCommit")
+	}
+	if (RetryPolicy{}).exhausted(100, true) {
+		t.Error("a policy without MaxAttempts should retry until success with ManualCommit")
+	}
+}
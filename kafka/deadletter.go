@@ -0,0 +1,94 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers added to a message when it is forwarded to a dead-letter topic.
+// The original key, value and headers are kept as they were.
+const (
+	HeaderDLQAttempts        = "x-dlq-attempts"
+	HeaderDLQError           = "x-dlq-error"
+	HeaderDLQSourceTopic     = "x-dlq-source-topic"
+	HeaderDLQSourcePartition = "x-dlq-source-partition"
+	HeaderDLQSourceOffset    = "x-dlq-source-offset"
+	HeaderDLQConsumerGroup   = "x-dlq-consumer-group"
+	HeaderDLQFailedAt        = "x-dlq-failed-at"
+)
+
+// Headers added to a dead-lettered message when it is replayed into its
+// source topic. HeaderReplayCount survives later dead-letterings, so a message
+// that keeps failing can be recognised as a replay loop.
+const (
+	HeaderReplayCount = "x-replay-count"
+	HeaderReplayedAt  = "x-replayed-at"
+	HeaderReplayedBy  = "x-replayed-by"
+)
+
+// deadLetter forwards msg to the dead-letter topic together with the failure
+// metadata. Publishing is retried until it succeeds or ctx is cancelled, since
+// giving up here would lose the message.
+func (c *KafkaConsumer) deadLetter(ctx context.Context, msg kafka.Message, attempts int, cause error) error {
+	dead := deadLetterMessage(msg, c.groupID, attempts, cause)
+
+	for attempt := 1; ; attempt++ {
+		err := c.deadLetterWriter.WriteMessages(ctx, dead)
+		if err == nil {
+			log.Printf("Dead-lettered message %s/%d@%d after %d attempts: %v\n",
+				msg.Topic, msg.Partition, msg.Offset, attempts, cause)
+			return nil
+		}
+
+		wait := c.retry.backoff(attempt)
+		log.Printf("Failed to dead-letter message %s/%d@%d, retrying in %v: %v\n",
+			msg.Topic, msg.Partition, msg.Offset, wait, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("dead-lettering message %s/%d@%d: %w", msg.Topic, msg.Partition, msg.Offset, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deadLetterMessage returns the message forwarded to a dead-letter topic for
+// msg: the original key, value and headers plus the failure metadata.
+func deadLetterMessage(msg kafka.Message, groupID string, attempts int, cause error) kafka.Message {
+	headers := make([]kafka.Header, 0, len(msg.Headers)+7)
+	for _, h := range msg.Headers {
+		if !isDLQHeader(h.Key) {
+			headers = append(headers, h)
+		}
+	}
+	headers = append(headers,
+		kafka.Header{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: HeaderDLQError, Value: []byte(cause.Error())},
+		kafka.Header{Key: HeaderDLQSourceTopic, Value: []byte(msg.Topic)},
+		kafka.Header{Key: HeaderDLQSourcePartition, Value: []byte(strconv.Itoa(msg.Partition))},
+		kafka.Header{Key: HeaderDLQSourceOffset, Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		kafka.Header{Key: HeaderDLQConsumerGroup, Value: []byte(groupID)},
+		kafka.Header{Key: HeaderDLQFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+	)
+
+	return kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
+
+// isDLQHeader reports whether key is failure metadata from an earlier
+// dead-lettering, which is replaced rather than duplicated.
+func isDLQHeader(key string) bool {
+	switch key {
+	case HeaderDLQAttempts, HeaderDLQError, HeaderDLQSourceTopic, HeaderDLQSourcePartition,
+		HeaderDLQSourceOffset, HeaderDLQConsumerGroup, HeaderDLQFailedAt:
+		return true
+	}
+	return false
+}
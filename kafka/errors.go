@@ -0,0 +1,27 @@
+package kafka
+
+import "errors"
+
+// handledError marks a handler error that has already been dealt with.
+type handledError struct {
+	err error
+}
+
+func (e *handledError) Error() string { return e.err.Error() }
+func (e *handledError) Unwrap() error { return e.err }
+
+// Handled wraps err to tell the consumer the failure has already been dealt
+// with by the handler (for example by publishing to the error topic), so the
+// message should be committed rather than retried.
+func Handled(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &handledError{err: err}
+}
+
+// IsHandled reports whether err was wrapped with Handled.
+func IsHandled(err error) bool {
+	var h *handledError
+	return errors.As(err, &h)
+}
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"context"
+	"time"
+)
+
+// Headers set on every event a KafkaProducer publishes, so consumers can route
+// or filter messages without decoding them.
+const (
+	HeaderEventName     = "x-event-name"
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderSource        = "x-source-service"
+	HeaderCorrelationID = "x-correlation-id"
+	// HeaderTraceParent carries the W3C trace context of the publish span,
+	// when tracing is set up (see the tracing package).
+	HeaderTraceParent = "traceparent"
+)
+
+// Message is a consumed Kafka message as passed to a Handler.
+type Message struct {
+	Topic     string
+	Partition int
+	Offset    int64
+	Time      time.Time
+	Key       []byte
+	// Value is the event as a JSON envelope, whatever the format on the topic.
+	Value   []byte
+	Headers []Header
+}
+
+// Handler processes a consumed message. The context carries the consumer span
+// of the message and is not cancelled when the consumer stops, so a message
+// that is being handled can finish.
+type Handler func(ctx context.Context, msg *Message) error
+
+// Header returns the value of the last header named key, or "" if the message
+// has none.
+func (m *Message) Header(key string) string {
+	for i := len(m.Headers) - 1; i >= 0; i-- {
+		if m.Headers[i].Key == key {
+			return string(m.Headers[i].Value)
+		}
+	}
+	return ""
+}
+
+// EventName returns the event name from the message headers. It is empty for
+// messages published without headers.
+func (m *Message) EventName() string {
+	return m.Header(HeaderEventName)
+}
+
+// Consumer consumes a topic, calling a Handler for each message. It is
+// implemented by KafkaConsumer and TransactionalConsumer.
+type Consumer interface {
+	Consume(ctx context.Context, handler Handler)
+	Close() error
+}
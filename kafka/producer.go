@@ -4,27 +4,76 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/tankcdr/ppe-kafka-go/events"
+	"go.opentelemetry.io/otel"
 )
 
 type KafkaProducer struct {
-	writer *kafka.Writer
+	writer     messageWriter
+	topic      string
+	validator  EventValidator
+	serializer Serializer
+	source     string
+}
+
+// PublishOption customises a single Publish call.
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	key string
+}
+
+// WithKey sets the partition key explicitly instead of deriving it from the event.
+func WithKey(key string) PublishOption {
+	return func(o *publishOptions) {
+		o.key = key
+	}
 }
 
 // NewProducer creates a new KafkaProducer instance.
+// Messages are assigned to partitions by hashing their key, so every message
+// with the same key lands on the same partition and keeps its order.
 func NewProducer(config KafkaConfig) *KafkaProducer {
 	return &KafkaProducer{
 		writer: kafka.NewWriter(kafka.WriterConfig{
-			Brokers: config.Brokers,
-			Topic:   config.Topic,
+			Brokers:  config.Brokers,
+			Topic:    config.Topic,
+			Balancer: &kafka.Hash{},
 		}),
+		topic:      config.Topic,
+		validator:  config.Validator,
+		serializer: config.Serializer,
+		source:     config.Source,
 	}
 }
 
 // Publish sends a message to the Kafka topic.
-func (p *KafkaProducer) Publish(ctx context.Context, event *events.Event) error {
+// If the producer has a Validator, an event that fails validation is not sent.
+// The message is keyed by the event's order (see PartitionKey) unless WithKey
+// is given, so all lifecycle events of an order are consumed in order. The
+// event name, schema version, correlation ID, producing service and trace
+// context are sent as headers. Publishing is traced as a producer span, a
+// child of the span in ctx if there is one.
+func (p *KafkaProducer) Publish(ctx context.Context, event *events.Event, opts ...PublishOption) error {
+	var options publishOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.key == "" {
+		options.key = PartitionKey(event)
+	}
+
+	ctx, span := startPublishSpan(ctx, p.topic, options.key, event.EventName)
+	err := p.publish(ctx, event, options.key)
+	endSpan(span, err)
+	return err
+}
+
+// publish validates, encodes and writes event under key.
+func (p *KafkaProducer) publish(ctx context.Context, event *events.Event, key string) error {
 	// Serialize the event to JSON
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
@@ -32,10 +81,37 @@ func (p *KafkaProducer) Publish(ctx context.Context, event *events.Event) error
 		return err
 	}
 
+	// Refuse to publish events that don't match their schema
+	if p.validator != nil {
+		if err := p.validator.Validate(eventJSON); err != nil {
+			log.Printf("Refusing to publish invalid event: %v\n", err)
+			return err
+		}
+	}
+
+	// Encode the event in the configured format, if it isn't JSON
+	value := eventJSON
+	if p.serializer != nil {
+		if value, err = p.serializer.Serialize(p.topic, event); err != nil {
+			log.Printf("Failed to serialize event: %v\n", err)
+			return err
+		}
+	}
+
 	// Create a Kafka message
 	msg := kafka.Message{
-		Key:   []byte(event.EventId), // Use EventId as the key, or maybe the order id?
-		Value: eventJSON,
+		Key:     []byte(key),
+		Value:   value,
+		Headers: p.headers(ctx, event),
+	}
+
+	// Inside a TransactionalConsumer's handler the message is written with the
+	// transaction instead
+	if tx := transactionFromContext(ctx); tx != nil {
+		msg.Topic = p.topic
+		tx.messages = append(tx.messages, msg)
+		log.Printf("Added event to transaction: %s\n", eventJSON)
+		return nil
 	}
 
 	// Publish the message to Kafka
@@ -48,6 +124,58 @@ func (p *KafkaProducer) Publish(ctx context.Context, event *events.Event) error
 	return nil
 }
 
+// headers returns the headers published along with event, including the
+// trace context of the publish span in ctx.
+func (p *KafkaProducer) headers(ctx context.Context, event *events.Event) []kafka.Header {
+	headers := []kafka.Header{
+		{Key: HeaderEventName, Value: []byte(event.EventName)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(event.SchemaVersion))},
+	}
+	if event.CorrelationId != "" {
+		headers = append(headers, kafka.Header{Key: HeaderCorrelationID, Value: []byte(event.CorrelationId)})
+	}
+	if p.source != "" {
+		headers = append(headers, kafka.Header{Key: HeaderSource, Value: []byte(p.source)})
+	}
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier{&headers})
+	return headers
+}
+
+// PartitionKey returns the key an event is published under: its correlation
+// ID, else the orderId found in its body, else (for events unrelated to an
+// order) its own event ID.
+func PartitionKey(event *events.Event) string {
+	if event.CorrelationId != "" {
+		return event.CorrelationId
+	}
+
+	var body struct {
+		OrderID string `json:"orderId"`
+	}
+	if err := json.Unmarshal(event.EventBody, &body); err == nil && body.OrderID != "" {
+		return body.OrderID
+	}
+
+	return event.EventId
+}
+
+// Republish sends an already serialized message, headers included, to the
+// Kafka topic. It is meant for tools that move messages between topics, such
+// as replaying a dead-letter topic, without decoding them.
+func (p *KafkaProducer) Republish(ctx context.Context, key, value []byte, headers []Header) error {
+	msg := kafka.Message{
+		Key:     key,
+		Value:   value,
+		Headers: headers,
+	}
+
+	if err := p.writer.WriteMessages(ctx, msg); err != nil {
+		log.Printf("Failed to republish message: %v\n", err)
+		return err
+	}
+	return nil
+}
+
 // Close closes the Kafka producer.
 func (p *KafkaProducer) Close() error {
 	return p.writer.Close()
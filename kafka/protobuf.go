@@ -0,0 +1,171 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// ProtobufEventSchema is the Protobuf schema events are written with. The body
+// is carried as JSON text because its shape depends on the event name.
+const ProtobufEventSchema = `syntax = "proto3";
+package ppe.events;
+
+message Event {
+  string event_id = 1;
+  string event_name = 2;
+  int32 envelope_version = 3;
+  string timestamp = 4;
+  string correlation_id = 5;
+  string event_body = 6;
+  string error_message = 7;
+  int32 schema_version = 8;
+}
+`
+
+// eventDescriptor describes the Event message of ProtobufEventSchema. It is
+// built in code so no generated package is needed.
+var eventDescriptor = buildEventDescriptor()
+
+func buildEventDescriptor() protoreflect.MessageDescriptor {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:   kind.Enum(),
+		}
+	}
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("ppe/events/event.proto"),
+		Package: proto.String("ppe.events"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Event"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("event_id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("event_name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("envelope_version", 3, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+				field("timestamp", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("correlation_id", 5, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("event_body", 6, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("error_message", 7, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("schema_version", 8, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			},
+		}},
+	}, nil)
+	if err != nil {
+		panic(fmt.Sprintf("invalid event descriptor: %v", err))
+	}
+	return file.Messages().ByName("Event")
+}
+
+// ProtobufSerializer writes events as Protobuf in the Confluent wire format,
+// registering ProtobufEventSchema under the "<topic>-value" subject. After the
+// schema ID the wire format lists the indexes of the message within the
+// schema; Event is the first message, written as the single byte 0.
+//
+// Messages are decoded with the built-in Event descriptor once the registry
+// confirms their schema ID is a Protobuf schema. Protobuf matches fields by
+// number, so messages written by older or newer versions of the schema still
+// decode as long as field numbers aren't reused.
+type ProtobufSerializer struct {
+	cache *schemaCache[struct{}]
+}
+
+// NewProtobufSerializer creates a ProtobufSerializer backed by registry.
+func NewProtobufSerializer(registry SchemaRegistry) *ProtobufSerializer {
+	return &ProtobufSerializer{
+		cache: newSchemaCache(registry, Schema{Type: SchemaTypeProtobuf, Definition: ProtobufEventSchema}, func(Schema) (struct{}, error) {
+			return struct{}{}, nil
+		}),
+	}
+}
+
+func (s *ProtobufSerializer) Serialize(topic string, event *events.Event) ([]byte, error) {
+	id, err := s.cache.id(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(eventDescriptor)
+	fields := eventDescriptor.Fields()
+	msg.Set(fields.ByName("event_id"), protoreflect.ValueOfString(event.EventId))
+	msg.Set(fields.ByName("event_name"), protoreflect.ValueOfString(event.EventName))
+	msg.Set(fields.ByName("envelope_version"), protoreflect.ValueOfInt32(int32(event.EnvelopeVersion)))
+	msg.Set(fields.ByName("schema_version"), protoreflect.ValueOfInt32(int32(event.SchemaVersion)))
+	msg.Set(fields.ByName("timestamp"), protoreflect.ValueOfString(event.Timestamp))
+	msg.Set(fields.ByName("correlation_id"), protoreflect.ValueOfString(event.CorrelationId))
+	msg.Set(fields.ByName("event_body"), protoreflect.ValueOfString(string(event.EventBody)))
+	if event.ErrorMessage != nil {
+		msg.Set(fields.ByName("error_message"), protoreflect.ValueOfString(*event.ErrorMessage))
+	}
+
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Message indexes [0], i.e. the first message in the schema
+	return encodeWire(id, append([]byte{0}, payload...)), nil
+}
+
+func (s *ProtobufSerializer) Deserialize(topic string, data []byte) (*events.Event, error) {
+	id, payload, err := decodeWire(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.cache.writer(id); err != nil {
+		return nil, err
+	}
+	if payload, err = skipMessageIndexes(payload); err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(eventDescriptor)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+
+	fields := eventDescriptor.Fields()
+	event := &events.Event{
+		EventId:         msg.Get(fields.ByName("event_id")).String(),
+		EventName:       msg.Get(fields.ByName("event_name")).String(),
+		EnvelopeVersion: int(msg.Get(fields.ByName("envelope_version")).Int()),
+		SchemaVersion:   int(msg.Get(fields.ByName("schema_version")).Int()),
+		Timestamp:       msg.Get(fields.ByName("timestamp")).String(),
+		CorrelationId:   msg.Get(fields.ByName("correlation_id")).String(),
+		EventBody:       json.RawMessage(msg.Get(fields.ByName("event_body")).String()),
+	}
+	if errorMessage := msg.Get(fields.ByName("error_message")).String(); errorMessage != "" {
+		event.ErrorMessage = &errorMessage
+	}
+	return event, nil
+}
+
+// skipMessageIndexes drops the message index list that follows the schema ID:
+// a zigzag varint count followed by that many zigzag varint indexes, where a
+// count of 0 stands for [0].
+func skipMessageIndexes(payload []byte) ([]byte, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 || count < 0 {
+		return nil, fmt.Errorf("invalid message index count")
+	}
+	payload = payload[n:]
+	for i := int64(0); i < count; i++ {
+		if _, n = binary.Varint(payload); n <= 0 {
+			return nil, fmt.Errorf("invalid message index")
+		}
+		payload = payload[n:]
+	}
+	return payload, nil
+}
@@ -0,0 +1,287 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SchemaType names the format of a registered schema.
+type SchemaType string
+
+const (
+	SchemaTypeAvro     SchemaType = "AVRO"
+	SchemaTypeProtobuf SchemaType = "PROTOBUF"
+)
+
+// Schema is a schema definition as stored in a registry.
+type Schema struct {
+	Type       SchemaType `json:"schemaType"`
+	Definition string     `json:"schema"`
+}
+
+// SchemaRegistry stores schemas under subjects and identifies them by ID,
+// the part of the Confluent Schema Registry API the serializers rely on.
+type SchemaRegistry interface {
+	// Register adds schema to subject and returns its ID. Registering a
+	// schema that is already known returns the existing ID.
+	Register(subject string, schema Schema) (int, error)
+	// Schema returns the schema with the given ID.
+	Schema(id int) (Schema, error)
+}
+
+/****************************************************************************************
+ * HTTP registry
+ * Talks to a Confluent-compatible schema registry
+ ****************************************************************************************/
+
+// HTTPRegistry is a client for a Confluent-compatible schema registry.
+type HTTPRegistry struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPRegistry creates a client for the registry at url, e.g. http://localhost:8081.
+func NewHTTPRegistry(url string) *HTTPRegistry {
+	return &HTTPRegistry{
+		url:    strings.TrimRight(url, "/"),
+		client: http.DefaultClient,
+	}
+}
+
+func (r *HTTPRegistry) Register(subject string, schema Schema) (int, error) {
+	body, err := json.Marshal(schema)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := r.client.Post(r.url+"/subjects/"+subject+"/versions", "application/vnd.schemaregistry.v1+json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := r.decode(resp, &result); err != nil {
+		return 0, fmt.Errorf("registering schema for %s: %w", subject, err)
+	}
+	return result.ID, nil
+}
+
+func (r *HTTPRegistry) Schema(id int) (Schema, error) {
+	resp, err := r.client.Get(fmt.Sprintf("%s/schemas/ids/%d", r.url, id))
+	if err != nil {
+		return Schema{}, err
+	}
+	defer resp.Body.Close()
+
+	var schema Schema
+	if err := r.decode(resp, &schema); err != nil {
+		return Schema{}, fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+	// The registry leaves out the type for Avro, its default
+	if schema.Type == "" {
+		schema.Type = SchemaTypeAvro
+	}
+	return schema, nil
+}
+
+func (r *HTTPRegistry) decode(resp *http.Response, v any) error {
+	if resp.StatusCode != http.StatusOK {
+		var registryErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&registryErr)
+		return fmt.Errorf("registry returned %s: %s", resp.Status, registryErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+/****************************************************************************************
+ * File registry
+ * Local stand-in for a schema registry, kept in a JSON file
+ ****************************************************************************************/
+
+// FileRegistry is a SchemaRegistry kept in a local JSON file. It stands in
+// for a registry server in local development and tests; several processes
+// may read the file, but only one should register schemas.
+type FileRegistry struct {
+	mu    sync.Mutex
+	path  string
+	state fileRegistryState
+}
+
+type fileRegistryState struct {
+	Schemas []registeredSchema `json:"schemas"`
+}
+
+type registeredSchema struct {
+	ID      int    `json:"id"`
+	Subject string `json:"subject"`
+	Schema
+}
+
+// NewFileRegistry opens the registry stored at path, which is created on the
+// first Register if it doesn't exist yet.
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	r := &FileRegistry{path: path}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *FileRegistry) Register(subject string, schema Schema) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.load(); err != nil {
+		return 0, err
+	}
+
+	// Like the registry server, an identical schema keeps a single ID across subjects
+	id := 0
+	for _, s := range r.state.Schemas {
+		if s.Schema == schema {
+			if s.Subject == subject {
+				return s.ID, nil
+			}
+			id = s.ID
+		}
+	}
+	if id == 0 {
+		id = len(r.state.Schemas) + 1
+	}
+
+	r.state.Schemas = append(r.state.Schemas, registeredSchema{ID: id, Subject: subject, Schema: schema})
+	if err := r.save(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (r *FileRegistry) Schema(id int) (Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	find := func() (Schema, bool) {
+		for _, s := range r.state.Schemas {
+			if s.ID == id {
+				return s.Schema, true
+			}
+		}
+		return Schema{}, false
+	}
+
+	if schema, ok := find(); ok {
+		return schema, nil
+	}
+	// Another process may have registered it since the file was read
+	if err := r.load(); err != nil {
+		return Schema{}, err
+	}
+	if schema, ok := find(); ok {
+		return schema, nil
+	}
+	return Schema{}, fmt.Errorf("schema %d not found in %s", id, r.path)
+}
+
+func (r *FileRegistry) load() error {
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &r.state)
+}
+
+func (r *FileRegistry) save() error {
+	data, err := json.MarshalIndent(&r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see a partial file
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+/****************************************************************************************
+ * Schema cache
+ * Shared by the registry-backed serializers
+ ****************************************************************************************/
+
+// schemaCache registers a serializer's schema once per subject and keeps the
+// writer schemas it has resolved by ID, so the registry is only consulted for
+// schemas it hasn't seen yet.
+type schemaCache[T any] struct {
+	registry SchemaRegistry
+	schema   Schema
+	parse    func(Schema) (T, error)
+
+	mu   sync.Mutex
+	ids  map[string]int
+	byID map[int]T
+}
+
+func newSchemaCache[T any](registry SchemaRegistry, schema Schema, parse func(Schema) (T, error)) *schemaCache[T] {
+	return &schemaCache[T]{
+		registry: registry,
+		schema:   schema,
+		parse:    parse,
+		ids:      map[string]int{},
+		byID:     map[int]T{},
+	}
+}
+
+// id returns the ID of the serializer's schema under the subject for topic.
+func (c *schemaCache[T]) id(topic string) (int, error) {
+	subject := subjectFor(topic)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.ids[subject]; ok {
+		return id, nil
+	}
+	id, err := c.registry.Register(subject, c.schema)
+	if err != nil {
+		return 0, err
+	}
+	c.ids[subject] = id
+	return id, nil
+}
+
+// writer returns the parsed schema a message with the given ID was written with.
+func (c *schemaCache[T]) writer(id int) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if parsed, ok := c.byID[id]; ok {
+		return parsed, nil
+	}
+
+	var parsed T
+	schema, err := c.registry.Schema(id)
+	if err != nil {
+		return parsed, err
+	}
+	if schema.Type != c.schema.Type {
+		return parsed, fmt.Errorf("schema %d is %s, expected %s", id, schema.Type, c.schema.Type)
+	}
+	if parsed, err = c.parse(schema); err != nil {
+		return parsed, fmt.Errorf("parsing schema %d: %w", id, err)
+	}
+	c.byID[id] = parsed
+	return parsed, nil
+}
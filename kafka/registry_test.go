@@ -0,0 +1,250 @@
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// newTestRegistryServer serves the part of the Confluent Schema Registry API
+// HTTPRegistry uses, keeping schemas in memory.
+func newTestRegistryServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	var schemas []Schema // ID is the index plus one
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/subjects/") && strings.HasSuffix(r.URL.Path, "/versions"):
+			var schema Schema
+			if err := json.NewDecoder(r.Body).Decode(&schema); err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]any{"error_code": 42201, "message": "Invalid schema"})
+				return
+			}
+			for i, s := range schemas {
+				if s == schema {
+					json.NewEncoder(w).Encode(map[string]int{"id": i + 1})
+					return
+				}
+			}
+			schemas = append(schemas, schema)
+			json.NewEncoder(w).Encode(map[string]int{"id": len(schemas)})
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/schemas/ids/"):
+			id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schemas/ids/"))
+			if err != nil || id < 1 || id > len(schemas) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]any{"error_code": 40403, "message": "Schema not found"})
+				return
+			}
+			schema := schemas[id-1]
+			// Like the real registry, the type is left out for Avro
+			if schema.Type == SchemaTypeAvro {
+				schema.Type = ""
+			}
+			json.NewEncoder(w).Encode(schema)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// registries returns a registry of each kind for the round-trip tests.
+func registries(t *testing.T) map[string]SchemaRegistry {
+	t.Helper()
+	file, err := NewFileRegistry(filepath.Join(t.TempDir(), "registry.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]SchemaRegistry{
+		"file": file,
+		"http": NewHTTPRegistry(newTestRegistryServer(t).URL + "/"),
+	}
+}
+
+func TestRegistryIDs(t *testing.T) {
+	avroSchema := Schema{Type: SchemaTypeAvro, Definition: AvroEventSchema}
+	protoSchema := Schema{Type: SchemaTypeProtobuf, Definition: ProtobufEventSchema}
+
+	for name, registry := range registries(t) {
+		t.Run(name, func(t *testing.T) {
+			avroID, err := registry.Register("orders-value", avroSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			protoID, err := registry.Register("orders-value", protoSchema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if avroID == protoID {
+				t.Fatalf("distinct schemas share ID %d", avroID)
+			}
+			// The same schema keeps its ID, under any subject
+			for _, subject := range []string{"orders-value", "errors-value"} {
+				if id, err := registry.Register(subject, avroSchema); err != nil || id != avroID {
+					t.Fatalf("registering again under %s: got %d, %v; want %d", subject, id, err, avroID)
+				}
+			}
+
+			for id, want := range map[int]Schema{avroID: avroSchema, protoID: protoSchema} {
+				got, err := registry.Schema(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("Schema(%d) = %+v, want %+v", id, got, want)
+				}
+			}
+			if _, err := registry.Schema(99); err == nil {
+				t.Error("Schema(99) succeeded for an unknown ID")
+			}
+		})
+	}
+}
+
+func TestFileRegistrySurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	writer, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reader opened before the schema exists still finds it later
+	reader, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := writer.Register("orders-value", Schema{Type: SchemaTypeAvro, Definition: AvroEventSchema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema, err := reader.Schema(id); err != nil || schema.Definition != AvroEventSchema {
+		t.Fatalf("reader got %+v, %v", schema, err)
+	}
+
+	reopened, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := reopened.Register("orders-value", Schema{Type: SchemaTypeAvro, Definition: AvroEventSchema}); err != nil || again != id {
+		t.Fatalf("registering after reopening: got %d, %v; want %d", again, err, id)
+	}
+}
+
+// testEvent returns an OrderReceived event with every envelope field set.
+func testEvent(t *testing.T) *events.Event {
+	t.Helper()
+	order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", TotalAmount: 51, Currency: "USD",
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 2, Price: 25.5}}}
+	event, err := order.ToEvent(events.OrderReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorMessage := "none really"
+	event.ErrorMessage = &errorMessage
+	return event
+}
+
+func TestSerializersRoundTrip(t *testing.T) {
+	for name, registry := range registries(t) {
+		avroSerializer, err := NewAvroSerializer(registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for format, serializer := range map[string]Serializer{
+			"avro":     avroSerializer,
+			"protobuf": NewProtobufSerializer(registry),
+		} {
+			t.Run(fmt.Sprintf("%s/%s", format, name), func(t *testing.T) {
+				event := testEvent(t)
+				data, err := serializer.Serialize("order-received", event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data[0] != wireMagicByte {
+					t.Fatalf("magic byte %d, want %d", data[0], wireMagicByte)
+				}
+				id, _, err := decodeWire(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if schema, err := registry.Schema(id); err != nil || schema.Type != SchemaType(strings.ToUpper(format)) {
+					t.Fatalf("message written with schema %d = %+v, %v", id, schema, err)
+				}
+
+				decoded, err := serializer.Deserialize("order-received", data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, _ := json.Marshal(event)
+				got, _ := json.Marshal(decoded)
+				if string(got) != string(want) {
+					t.Fatalf("round trip changed the event:\n got %s\nwant %s", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestSerializersRejectForeignMessages(t *testing.T) {
+	registry := registries(t)["file"]
+	avroSerializer, err := NewAvroSerializer(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protobufSerializer := NewProtobufSerializer(registry)
+
+	avroData, err := avroSerializer.Serialize("order-received", testEvent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := protobufSerializer.Deserialize("order-received", avroData); err == nil {
+		t.Error("the Protobuf serializer decoded an Avro message")
+	}
+	for name, data := range map[string][]byte{
+		"JSON":       []byte(`{"eventName": "OrderReceived"}`),
+		"short":      {0, 0, 1},
+		"unknown ID": encodeWire(99, []byte{0}),
+		"bad magic":  append([]byte{1}, avroData[1:]...),
+		"cut off":    avroData[:len(avroData)/2],
+	} {
+		if _, err := avroSerializer.Deserialize("order-received", data); err == nil {
+			t.Errorf("decoded a %s message", name)
+		}
+	}
+}
+
+func TestNewSerializer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "registry.json")
+	for config, want := range map[SerializerConfig]string{
+		{}:                                       "<nil>",
+		{Format: FormatJSON}:                     "<nil>",
+		{Format: FormatAvro, RegistryFile: file}: "*kafka.AvroSerializer",
+		{Format: FormatProtobuf, RegistryURL: newTestRegistryServer(t).URL}: "*kafka.ProtobufSerializer",
+	} {
+		serializer, err := NewSerializer(config)
+		if err != nil {
+			t.Fatalf("NewSerializer(%+v): %v", config, err)
+		}
+		if got := fmt.Sprintf("%T", serializer); got != want {
+			t.Errorf("NewSerializer(%+v) = %s, want %s", config, got, want)
+		}
+	}
+	if _, err := NewSerializer(SerializerConfig{Format: "xml"}); err == nil {
+		t.Error("NewSerializer accepted an unknown format")
+	}
+}
@@ -0,0 +1,64 @@
+package kafka
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Defaults applied to the zero fields of a RetryPolicy.
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+	defaultMultiplier     = 2.0
+)
+
+// RetryPolicy controls how a consumer retries a message whose handler fails.
+//
+// The wait before retry n is InitialBackoff * Multiplier^(n-1), capped at
+// MaxBackoff and spread by +/- Jitter (a fraction between 0 and 1) so that
+// consumers failing together don't retry in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of handler calls for a message. Zero
+	// retries until success when ManualCommit is set and makes a single attempt
+	// otherwise, matching the behaviour of each commit mode without a policy.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// exhausted reports whether no attempts remain after the given attempt.
+func (p RetryPolicy) exhausted(attempt int, manualCommit bool) bool {
+	if p.MaxAttempts <= 0 {
+		return !manualCommit
+	}
+	return attempt >= p.MaxAttempts
+}
+
+// backoff returns how long to wait after the given (1-based) failed attempt.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultMultiplier
+	}
+
+	wait := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if wait > float64(maxBackoff) {
+		wait = float64(maxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		wait += wait * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(wait)
+}
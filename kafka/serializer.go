@@ -0,0 +1,110 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// Serializer converts events to and from the value of a Kafka message.
+// The topic is passed so that schema-based serializers can pick the
+// registry subject.
+type Serializer interface {
+	Serialize(topic string, event *events.Event) ([]byte, error)
+	Deserialize(topic string, data []byte) (*events.Event, error)
+}
+
+// Event formats a SerializerConfig can select.
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// SerializerConfig selects the format of the events on the topics, from the
+// environment when embedded in a service's configuration. Every producer and
+// consumer of a topic must agree on it.
+type SerializerConfig struct {
+	Format string `env:"EVENT_FORMAT" envDefault:"json"`
+	//avro and protobuf register their schema with the registry at RegistryURL,
+	//or in RegistryFile when no URL is given
+	RegistryURL  string `env:"SCHEMA_REGISTRY_URL"`
+	RegistryFile string `env:"SCHEMA_REGISTRY_FILE" envDefault:"registry.json"`
+}
+
+// NewSerializer returns the Serializer config selects, for KafkaConfig.Serializer.
+// It returns nil for JSON, the default.
+func NewSerializer(config SerializerConfig) (Serializer, error) {
+	var registry SchemaRegistry
+	switch config.Format {
+	case "", FormatJSON:
+		return nil, nil
+	case FormatAvro, FormatProtobuf:
+		if config.RegistryURL != "" {
+			registry = NewHTTPRegistry(config.RegistryURL)
+		} else {
+			fileRegistry, err := NewFileRegistry(config.RegistryFile)
+			if err != nil {
+				return nil, fmt.Errorf("opening schema registry file %s: %w", config.RegistryFile, err)
+			}
+			registry = fileRegistry
+		}
+	default:
+		return nil, fmt.Errorf("unknown event format %q (want %s, %s or %s)", config.Format, FormatJSON, FormatAvro, FormatProtobuf)
+	}
+
+	if config.Format == FormatAvro {
+		serializer, err := NewAvroSerializer(registry)
+		if err != nil {
+			return nil, err
+		}
+		return serializer, nil
+	}
+	return NewProtobufSerializer(registry), nil
+}
+
+// JSONSerializer writes events as plain JSON envelopes. It is the default
+// when no Serializer is configured.
+type JSONSerializer struct{}
+
+func (JSONSerializer) Serialize(topic string, event *events.Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (JSONSerializer) Deserialize(topic string, data []byte) (*events.Event, error) {
+	return events.NewEventFromBytes(data)
+}
+
+// Confluent wire format: a zero magic byte, the 4-byte big-endian schema ID
+// and then the encoded payload.
+const (
+	wireMagicByte  byte = 0
+	wireHeaderSize      = 5
+)
+
+// encodeWire prefixes payload with the wire format header for schemaID.
+func encodeWire(schemaID int, payload []byte) []byte {
+	data := make([]byte, wireHeaderSize, wireHeaderSize+len(payload))
+	data[0] = wireMagicByte
+	binary.BigEndian.PutUint32(data[1:], uint32(schemaID))
+	return append(data, payload...)
+}
+
+// decodeWire splits data in the wire format into schema ID and payload.
+func decodeWire(data []byte) (int, []byte, error) {
+	if len(data) < wireHeaderSize {
+		return 0, nil, fmt.Errorf("message too short for the wire format: %d bytes", len(data))
+	}
+	if data[0] != wireMagicByte {
+		return 0, nil, fmt.Errorf("unknown magic byte %d", data[0])
+	}
+	return int(binary.BigEndian.Uint32(data[1:wireHeaderSize])), data[wireHeaderSize:], nil
+}
+
+// subjectFor returns the registry subject for values on topic, following the
+// registry's default topic name strategy.
+func subjectFor(topic string) string {
+	return topic + "-value"
+}
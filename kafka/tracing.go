@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/tankcdr/ppe-kafka-go/kafka"
+
+// headerCarrier lets the OpenTelemetry propagator read and write the trace
+// context (the traceparent header) in Kafka message headers.
+type headerCarrier struct {
+	headers *[]kafka.Header
+}
+
+func (c headerCarrier) Get(key string) string {
+	for i := len(*c.headers) - 1; i >= 0; i-- {
+		if (*c.headers)[i].Key == key {
+			return string((*c.headers)[i].Value)
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	for i := range *c.headers {
+		if (*c.headers)[i].Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, len(*c.headers))
+	for i, h := range *c.headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// startPublishSpan starts the producer span for publishing an event to topic.
+func startPublishSpan(ctx context.Context, topic, key, eventName string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingKafkaMessageKey(key),
+			attribute.String("event.name", eventName),
+		),
+	)
+}
+
+// startProcessSpan starts the consumer span for handling msg. It is a child
+// of the producer span found in the message headers, so an order can be
+// followed across services as one trace.
+func startProcessSpan(ctx context.Context, msg *Message, groupID string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier{&msg.Headers})
+	attributes := []attribute.KeyValue{
+		semconv.MessagingSystemKafka,
+		semconv.MessagingOperationTypeDeliver,
+		semconv.MessagingDestinationName(msg.Topic),
+		semconv.MessagingDestinationPartitionID(strconv.Itoa(msg.Partition)),
+		semconv.MessagingKafkaMessageOffset(int(msg.Offset)),
+		semconv.MessagingKafkaMessageKey(string(msg.Key)),
+	}
+	if groupID != "" {
+		attributes = append(attributes, semconv.MessagingKafkaConsumerGroup(groupID))
+	}
+	if eventName := msg.EventName(); eventName != "" {
+		attributes = append(attributes, attribute.String("event.name", eventName))
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, msg.Topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attributes...),
+	)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
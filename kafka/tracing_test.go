@@ -0,0 +1,198 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/tankcdr/ppe-kafka-go/events"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider and W3C propagator for the test and
+// returns the recorder of the spans it ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+// endedSpan returns the one ended span called name.
+func endedSpan(t *testing.T, recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("%d spans called %q ended, want 1", len(found), name)
+	}
+	return found[0]
+}
+
+// publishTo publishes an OrderReceived event to topic of broker within ctx.
+func publishTo(t *testing.T, ctx context.Context, broker *fakeBroker, topic string) {
+	t.Helper()
+	producer := NewProducer(KafkaConfig{Brokers: []string{"fake:9092"}, Topic: topic})
+	producer.writer.Close()
+	producer.writer = &fakeWriter{broker: broker, topic: topic}
+
+	order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", TotalAmount: 1,
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+	event, err := order.ToEvent(events.OrderReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// traceParent returns the span context in the traceparent header of msg.
+func traceParent(t *testing.T, msg kafka.Message) trace.SpanContext {
+	t.Helper()
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier{&msg.Headers})
+	parent := trace.SpanContextFromContext(ctx)
+	if !parent.IsValid() {
+		t.Fatalf("no traceparent in headers %v", msg.Headers)
+	}
+	return parent
+}
+
+func TestPublishInjectsTraceparent(t *testing.T) {
+	recorder := recordSpans(t)
+	broker := newFakeBroker()
+
+	ctx, handler := otel.Tracer("test").Start(context.Background(), "handler")
+	publishTo(t, ctx, broker, "orders")
+	handler.End()
+
+	publish := endedSpan(t, recorder, "orders publish")
+	if publish.SpanKind() != trace.SpanKindProducer {
+		t.Errorf("publish span kind %v, want producer", publish.SpanKind())
+	}
+	if publish.Parent().SpanID() != handler.SpanContext().SpanID() {
+		t.Errorf("publish span parent %v, want the handler span %v", publish.Parent().SpanID(), handler.SpanContext().SpanID())
+	}
+
+	// The message carries the publish span, so the consumer continues its trace
+	msgs := broker.messages("orders")
+	if len(msgs) != 1 {
+		t.Fatalf("%d messages published, want 1", len(msgs))
+	}
+	parent := traceParent(t, msgs[0])
+	if parent.TraceID() != handler.SpanContext().TraceID() || parent.SpanID() != publish.SpanContext().SpanID() {
+		t.Fatalf("traceparent %v/%v, want %v/%v", parent.TraceID(), parent.SpanID(),
+			handler.SpanContext().TraceID(), publish.SpanContext().SpanID())
+	}
+}
+
+func TestProcessSpanContinuesTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	broker := newFakeBroker()
+	publishTo(t, context.Background(), broker, "orders")
+	publish := endedSpan(t, recorder, "orders publish")
+
+	var handled trace.SpanContext
+	consumer, _ := broker.consumer(KafkaConfig{Topic: "orders", GroupID: "tracing", ManualCommit: true})
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	consumer.Consume(ctx, func(ctx context.Context, msg *Message) error {
+		handled = trace.SpanContextFromContext(ctx)
+		cancel()
+		return nil
+	})
+	consumer.Close()
+
+	process := endedSpan(t, recorder, "orders process")
+	if process.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("process span kind %v, want consumer", process.SpanKind())
+	}
+	if process.Parent().SpanID() != publish.SpanContext().SpanID() || process.SpanContext().TraceID() != publish.SpanContext().TraceID() {
+		t.Errorf("process span is not a child of the publish span")
+	}
+	if len(process.Links()) != 0 {
+		t.Errorf("process span links %v to its own parent", process.Links())
+	}
+	if handled.SpanID() != process.SpanContext().SpanID() {
+		t.Errorf("handler context carries span %v, want the process span %v", handled.SpanID(), process.SpanContext().SpanID())
+	}
+	if process.Status().Code != codes.Unset {
+		t.Errorf("process span status %v after success", process.Status())
+	}
+}
+
+func TestFailedProcessSpansRecordError(t *testing.T) {
+	recorder := recordSpans(t)
+	broker := newFakeBroker()
+	publishTo(t, context.Background(), broker, "orders")
+	publish := endedSpan(t, recorder, "orders publish")
+
+	consumer, _ := broker.consumer(KafkaConfig{
+		Topic:           "orders",
+		GroupID:         "tracing",
+		ManualCommit:    true,
+		Retry:           RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		DeadLetterTopic: "orders-dlq",
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	go func() {
+		// Stop once the message is dead-lettered
+		for ctx.Err() == nil && len(broker.messages("orders-dlq")) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	consumer.Consume(ctx, func(context.Context, *Message) error {
+		return errors.New("cannot handle")
+	})
+	consumer.Close()
+
+	// Every attempt is a span of the producer's trace marked as failed
+	var attempts int
+	for _, span := range recorder.Ended() {
+		if span.Name() != "orders process" {
+			continue
+		}
+		attempts++
+		if span.Parent().SpanID() != publish.SpanContext().SpanID() {
+			t.Errorf("attempt %d is not a child of the publish span", attempts)
+		}
+		if span.Status().Code != codes.Error || span.Status().Description != "cannot handle" {
+			t.Errorf("attempt %d status %+v, want the error", attempts, span.Status())
+		}
+		if events := span.Events(); len(events) != 1 || events[0].Name != "exception" {
+			t.Errorf("attempt %d events %v, want the recorded error", attempts, events)
+		}
+	}
+	if attempts != 2 {
+		t.Fatalf("%d process spans, want one per attempt (2)", attempts)
+	}
+
+	// The dead-lettered message keeps the trace, so a replay continues it
+	dead := broker.messages("orders-dlq")
+	if len(dead) != 1 {
+		t.Fatalf("%d messages dead-lettered, want 1", len(dead))
+	}
+	if parent := traceParent(t, dead[0]); parent.SpanID() != publish.SpanContext().SpanID() {
+		t.Fatalf("dead-lettered traceparent span %v, want the publish span %v", parent.SpanID(), publish.SpanContext().SpanID())
+	}
+}
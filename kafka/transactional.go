@@ -0,0 +1,312 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// transactionBatchSize is the most messages handled in one transaction.
+	// It bounds how long a transaction stays open with slow handlers.
+	transactionBatchSize = 10
+	// transactionTimeout is how long the broker lets a transaction stay open
+	// before aborting it.
+	transactionTimeout = 2 * time.Minute
+)
+
+// TransactionalConsumer runs a consume-transform-produce loop in Kafka
+// transactions. The events a handler publishes, through any KafkaProducer
+// given the handler's context, are written in the same transaction as the
+// offset of the message being handled, so either both become visible or
+// neither does: a crash can't leave an output without its input committed,
+// or the other way round. Consumers of the output topics only see committed
+// events, since every KafkaConsumer reads with the read_committed isolation
+// level.
+//
+// Messages are handled one at a time, up to transactionBatchSize per
+// transaction. A failing handler is retried and dead-lettered as in
+// KafkaConsumer, with the dead-lettered message also part of the transaction.
+// When a transaction aborts, for example because of a rebalance, its messages
+// are handled again; side effects outside Kafka should be deferred with
+// AfterCommit or undone with OnAbort.
+type TransactionalConsumer struct {
+	session         *kgo.GroupTransactSession
+	groupID         string
+	retry           RetryPolicy
+	serializer      Serializer
+	deadLetterTopic string
+}
+
+// transaction collects what handling one message produced, until it is
+// written to Kafka with the message's offset.
+type transaction struct {
+	messages    []kafka.Message
+	afterCommit []func()
+	onAbort     []func()
+}
+
+type transactionKey struct{}
+
+// attempt collects the OnAbort hooks registered during one run of a handler.
+type attempt struct {
+	onAbort []func()
+}
+
+type attemptKey struct{}
+
+// keyHasher partitions keys the same way as KafkaProducer's Hash balancer,
+// FNV-1a taken modulo the partition count as an int32, so an order stays on
+// one partition whichever way it is published.
+var keyHasher = kgo.SaramaCompatHasher(func(key []byte) uint32 {
+	hash := fnv.New32a()
+	hash.Write(key)
+	return hash.Sum32()
+})
+
+// NewTransactionalConsumer creates a TransactionalConsumer. config.TransactionalID
+// must be set and unique to the service instance; a restarted instance with
+// the same ID fences off its previous incarnation. Workers and ManualCommit
+// don't apply.
+func NewTransactionalConsumer(config KafkaConfig) (*TransactionalConsumer, error) {
+	if config.TransactionalID == "" {
+		return nil, errors.New("a transactional consumer needs a TransactionalID")
+	}
+
+	session, err := kgo.NewGroupTransactSession(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.TransactionalID(config.TransactionalID),
+		kgo.TransactionTimeout(transactionTimeout),
+		kgo.ConsumerGroup(config.GroupID),
+		kgo.ConsumeTopics(config.Topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+		kgo.FetchIsolationLevel(kgo.ReadCommitted()),
+		kgo.RequireStableFetchOffsets(),
+		kgo.RecordPartitioner(kgo.StickyKeyPartitioner(keyHasher)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransactionalConsumer{
+		session:         session,
+		groupID:         config.GroupID,
+		retry:           config.Retry,
+		serializer:      config.Serializer,
+		deadLetterTopic: config.DeadLetterTopic,
+	}, nil
+}
+
+// Consume polls messages and handles each batch in a transaction until ctx is
+// cancelled or the consumer is closed. A batch in progress at that point is
+// finished first, unless a message in it is waiting to be retried; then the
+// batch is aborted and handled again after a restart.
+func (c *TransactionalConsumer) Consume(ctx context.Context, handler Handler) {
+	for {
+		fetches := c.session.PollRecords(ctx, transactionBatchSize)
+		if ctx.Err() != nil || fetches.IsClientClosed() {
+			return
+		}
+		for _, fetchErr := range fetches.Errors() {
+			log.Printf("Error fetching from %s/%d: %v\n", fetchErr.Topic, fetchErr.Partition, fetchErr.Err)
+		}
+
+		records := fetches.Records()
+		if len(records) == 0 {
+			continue
+		}
+		if err := c.transact(ctx, records, handler); err != nil {
+			log.Printf("Transaction failed, its messages will be handled again: %v\n", err)
+		}
+	}
+}
+
+// transact handles records and writes what they produced, together with
+// their offsets, in one transaction.
+func (c *TransactionalConsumer) transact(ctx context.Context, records []*kgo.Record, handler Handler) error {
+	if err := c.session.Begin(); err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+
+	// Ending the transaction must not be cut short by shutdown
+	endCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), commitTimeout)
+	defer cancel()
+
+	var batch transaction
+	for _, record := range records {
+		msg := fromRecord(record)
+		tx, err := c.process(ctx, msg, handler)
+		if err != nil {
+			c.abort(endCtx, &batch)
+			return fmt.Errorf("processing message %s/%d@%d: %w", msg.Topic, msg.Partition, msg.Offset, err)
+		}
+		batch.messages = append(batch.messages, tx.messages...)
+		batch.afterCommit = append(batch.afterCommit, tx.afterCommit...)
+		batch.onAbort = append(batch.onAbort, tx.onAbort...)
+	}
+
+	produced := make([]*kgo.Record, len(batch.messages))
+	for i, msg := range batch.messages {
+		produced[i] = toRecord(msg)
+	}
+	if err := c.session.ProduceSync(endCtx, produced...).FirstErr(); err != nil {
+		c.abort(endCtx, &batch)
+		return fmt.Errorf("producing in transaction: %w", err)
+	}
+
+	committed, err := c.session.End(endCtx, kgo.TryCommit)
+	if err != nil {
+		runHooks(batch.onAbort)
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	if !committed {
+		runHooks(batch.onAbort)
+		return errors.New("transaction aborted after a rebalance")
+	}
+
+	for _, fn := range batch.afterCommit {
+		fn()
+	}
+	return nil
+}
+
+// abort ends the current transaction without committing it and runs the
+// OnAbort hooks of batch. The session rewinds to the committed offsets, so the
+// messages are fetched again.
+func (c *TransactionalConsumer) abort(ctx context.Context, batch *transaction) {
+	if _, err := c.session.End(ctx, kgo.TryAbort); err != nil {
+		log.Printf("Failed to abort transaction: %v\n", err)
+	}
+	runHooks(batch.onAbort)
+}
+
+// process runs the handler for msg under the retry policy and returns what it
+// produced, or the dead-lettered message once the attempts are used up. It
+// returns an error only if ctx was cancelled before the message was dealt
+// with.
+func (c *TransactionalConsumer) process(ctx context.Context, msg kafka.Message, handler Handler) (*transaction, error) {
+	for attempt := 1; ; attempt++ {
+		// Whatever a failed attempt published is discarded with its transaction
+		tx := &transaction{}
+		err := c.handle(ctx, msg, handler, tx)
+		if err == nil {
+			return tx, nil
+		}
+		if IsHandled(err) {
+			log.Printf("Handled error for message %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+			return tx, nil
+		}
+
+		if c.retry.exhausted(attempt, true) {
+			if c.deadLetterTopic != "" {
+				dead := deadLetterMessage(msg, c.groupID, attempt, err)
+				dead.Topic = c.deadLetterTopic
+				log.Printf("Dead-lettering message %s/%d@%d after %d attempts: %v\n",
+					msg.Topic, msg.Partition, msg.Offset, attempt, err)
+				return &transaction{messages: []kafka.Message{dead}}, nil
+			}
+			log.Printf("Giving up on message %s/%d@%d after %d attempts: %v\n",
+				msg.Topic, msg.Partition, msg.Offset, attempt, err)
+			return &transaction{}, nil
+		}
+
+		wait := c.retry.backoff(attempt)
+		log.Printf("Error handling message %s/%d@%d (attempt %d), retrying in %v: %v\n",
+			msg.Topic, msg.Partition, msg.Offset, attempt, wait, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// handle passes msg to the handler with tx in its context, so the handler's
+// publishes are collected in tx.
+func (c *TransactionalConsumer) handle(ctx context.Context, msg kafka.Message, handler Handler, tx *transaction) error {
+	message, err := decodeMessage(c.serializer, msg)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(context.WithoutCancel(ctx), transactionKey{}, tx)
+	return runHandler(ctx, message, c.groupID, handler)
+}
+
+// Close leaves the consumer group and closes the connections.
+func (c *TransactionalConsumer) Close() error {
+	c.session.Close()
+	return nil
+}
+
+// transactionFromContext returns the transaction of the handler owning ctx,
+// if it runs in a TransactionalConsumer.
+func transactionFromContext(ctx context.Context) *transaction {
+	tx, _ := ctx.Value(transactionKey{}).(*transaction)
+	return tx
+}
+
+// AfterCommit runs fn once the outcome of the handler owning ctx is final:
+// when its transaction commits for a TransactionalConsumer, and right away
+// otherwise. Use it for side effects outside Kafka that must not survive an
+// aborted transaction, such as recording an order as processed.
+func AfterCommit(ctx context.Context, fn func()) {
+	if tx := transactionFromContext(ctx); tx != nil {
+		tx.afterCommit = append(tx.afterCommit, fn)
+		return
+	}
+	fn()
+}
+
+// OnAbort runs fn if the outcome of the handler owning ctx is discarded: when
+// the handler returns an error that isn't Handled, so the message is retried
+// or dead-lettered, and when its transaction aborts for a
+// TransactionalConsumer. Use it to undo side effects outside Kafka made before
+// the outcome is known, such as claiming an order ID. Hooks run in reverse
+// order of registration.
+func OnAbort(ctx context.Context, fn func()) {
+	if a, ok := ctx.Value(attemptKey{}).(*attempt); ok {
+		a.onAbort = append(a.onAbort, fn)
+	}
+}
+
+// runHooks runs OnAbort hooks, the last registered first.
+func runHooks(hooks []func()) {
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+func fromRecord(record *kgo.Record) kafka.Message {
+	headers := make([]kafka.Header, len(record.Headers))
+	for i, h := range record.Headers {
+		headers[i] = kafka.Header{Key: h.Key, Value: h.Value}
+	}
+	return kafka.Message{
+		Topic:     record.Topic,
+		Partition: int(record.Partition),
+		Offset:    record.Offset,
+		Key:       record.Key,
+		Value:     record.Value,
+		Headers:   headers,
+		Time:      record.Timestamp,
+	}
+}
+
+func toRecord(msg kafka.Message) *kgo.Record {
+	headers := make([]kgo.RecordHeader, len(msg.Headers))
+	for i, h := range msg.Headers {
+		headers[i] = kgo.RecordHeader{Key: h.Key, Value: h.Value}
+	}
+	return &kgo.Record{
+		Topic:   msg.Topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: headers,
+	}
+}
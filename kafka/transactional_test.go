@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestKeyHasherMatchesHashBalancer(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 6, 7, 12} {
+		partitions := make([]int, n)
+		for i := range partitions {
+			partitions[i] = i
+		}
+		balancer := &kafka.Hash{}
+		for i := range 1000 {
+			key := []byte(fmt.Sprintf("ORD-20241216-%04d", i))
+			want := balancer.Balance(kafka.Message{Key: key}, partitions...)
+			if got := keyHasher(key, n); got != want {
+				t.Fatalf("%s on %d partitions: transactional producer picks %d, KafkaProducer %d", key, n, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// workerQueueSize is how many messages may wait for each worker before the
+// fetch loop blocks.
+const workerQueueSize = 16
+
+// consumeConcurrently dispatches messages to a pool of workers. Messages with
+// the same key always go to the same worker and are processed in the order
+// they were fetched, while messages with different keys run in parallel.
+// Because messages complete out of order, a partition's offset is committed
+// only up to the point below which every fetched message has completed.
+func (c *KafkaConsumer) consumeConcurrently(ctx context.Context, handler Handler) {
+	tracker := newOffsetTracker()
+	commits := make(chan kafka.Message, c.workers)
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		c.commitInOrder(ctx, commits)
+	}()
+
+	var workers sync.WaitGroup
+	queues := make([]chan kafka.Message, c.workers)
+	for i := range queues {
+		queues[i] = make(chan kafka.Message, workerQueueSize)
+		workers.Add(1)
+		go func(queue <-chan kafka.Message) {
+			defer workers.Done()
+			for msg := range queue {
+				// Once shutdown starts only the message in flight is finished;
+				// queued ones stay uncommitted and are redelivered later
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := c.process(ctx, msg, handler); err != nil {
+					log.Printf("Stopped processing message %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+					continue
+				}
+				if commit, ok := tracker.complete(msg); ok {
+					commits <- commit
+				}
+			}
+		}(queues[i])
+	}
+
+fetch:
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if c.stopped(ctx, err) {
+				break
+			}
+			log.Printf("Error fetching message: %v\n", err)
+			continue
+		}
+
+		tracker.fetch(msg)
+		select {
+		case queues[workerFor(msg, len(queues))] <- msg:
+		case <-ctx.Done():
+			break fetch
+		}
+	}
+
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(commits)
+	<-committed
+}
+
+// commitInOrder commits the offsets sent by the workers. Workers can report
+// contiguous offsets slightly out of order, so anything at or below what has
+// already been committed for a partition is dropped to keep commits moving
+// forward.
+func (c *KafkaConsumer) commitInOrder(ctx context.Context, commits <-chan kafka.Message) {
+	last := map[int]int64{}
+	for msg := range commits {
+		if offset, ok := last[msg.Partition]; ok && msg.Offset <= offset {
+			continue
+		}
+		if err := c.commit(ctx, msg); err != nil {
+			log.Printf("Error committing offset %s/%d@%d: %v\n", msg.Topic, msg.Partition, msg.Offset, err)
+			continue
+		}
+		last[msg.Partition] = msg.Offset
+	}
+}
+
+// workerFor picks the worker for msg: by key so that messages for the same
+// key stay in order, or by partition for messages without a key.
+func workerFor(msg kafka.Message, workers int) int {
+	h := fnv.New32a()
+	if len(msg.Key) > 0 {
+		h.Write(msg.Key)
+	} else {
+		h.Write([]byte{byte(msg.Partition >> 24), byte(msg.Partition >> 16), byte(msg.Partition >> 8), byte(msg.Partition)})
+	}
+	return int(h.Sum32() % uint32(workers))
+}
+
+// offsetTracker records, per partition, which fetched messages are still in
+// progress so that only contiguous completed offsets are committed.
+type offsetTracker struct {
+	mu         sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+type partitionOffsets struct {
+	pending []int64        // fetched offsets not yet committable, in fetch order
+	done    map[int64]bool // completed offsets still waiting on an earlier one
+	next    int64          // the offset after the last one fetched
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: map[int]*partitionOffsets{},
+	}
+}
+
+// fetch records that msg has been handed to a worker. A partition fetched
+// again from a lower offset was reassigned by a rebalance and is redelivered
+// from its committed offset, so what was tracked for it is dropped; keeping
+// it would leave the redelivered offsets pending twice and stall commits.
+func (t *offsetTracker) fetch(msg kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[msg.Partition]
+	if !ok || msg.Offset < p.next {
+		if ok {
+			log.Printf("Partition %s/%d redelivered from offset %d, resetting its offset tracking\n",
+				msg.Topic, msg.Partition, msg.Offset)
+		}
+		p = &partitionOffsets{done: map[int64]bool{}}
+		t.partitions[msg.Partition] = p
+	}
+	p.pending = append(p.pending, msg.Offset)
+	p.next = msg.Offset + 1
+}
+
+// complete marks msg as processed. If that extends the run of completed
+// offsets at the head of its partition, it returns the message to commit.
+func (t *offsetTracker) complete(msg kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A message below the head was fetched before a reset and has been
+	// redelivered, or is covered by an earlier commit
+	p, ok := t.partitions[msg.Partition]
+	if !ok || len(p.pending) == 0 || msg.Offset < p.pending[0] {
+		return kafka.Message{}, false
+	}
+	p.done[msg.Offset] = true
+
+	committable := int64(-1)
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		committable = p.pending[0]
+		delete(p.done, committable)
+		p.pending = p.pending[1:]
+	}
+	if committable < 0 {
+		return kafka.Message{}, false
+	}
+
+	return kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: committable}, true
+}
@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// completeAll marks offsets of partition 0 as processed in the order given
+// and returns the offsets the tracker released for commit.
+func completeAll(tracker *offsetTracker, offsets ...int64) []int64 {
+	var commits []int64
+	for _, offset := range offsets {
+		if commit, ok := tracker.complete(kafka.Message{Offset: offset}); ok {
+			commits = append(commits, commit.Offset)
+		}
+	}
+	return commits
+}
+
+func fetchAll(tracker *offsetTracker, offsets ...int64) {
+	for _, offset := range offsets {
+		tracker.fetch(kafka.Message{Offset: offset})
+	}
+}
+
+func TestOffsetTrackerCommitsContiguousOffsets(t *testing.T) {
+	tracker := newOffsetTracker()
+	fetchAll(tracker, 0, 1, 2, 3)
+
+	if commits := completeAll(tracker, 2, 1); len(commits) != 0 {
+		t.Fatalf("committed %v while offset 0 is in progress", commits)
+	}
+	if commits := completeAll(tracker, 0); !slices.Equal(commits, []int64{2}) {
+		t.Fatalf("committed %v once offset 0 completed, want [2]", commits)
+	}
+	if commits := completeAll(tracker, 3); !slices.Equal(commits, []int64{3}) {
+		t.Fatalf("committed %v, want [3]", commits)
+	}
+}
+
+func TestOffsetTrackerResetsOnRedelivery(t *testing.T) {
+	tracker := newOffsetTracker()
+	fetchAll(tracker, 0, 1, 2)
+	if commits := completeAll(tracker, 0); !slices.Equal(commits, []int64{0}) {
+		t.Fatalf("committed %v, want [0]", commits)
+	}
+
+	// A rebalance redelivers the partition from its committed offset, while
+	// the first copy of offset 2 is still being handled
+	fetchAll(tracker, 1, 2, 3)
+	if commits := completeAll(tracker, 1, 2, 2, 3); !slices.Equal(commits, []int64{1, 2, 3}) {
+		t.Fatalf("committed %v after the redelivery, want [1 2 3]", commits)
+	}
+
+	// A stale completion from before the rebalance doesn't stall later offsets
+	fetchAll(tracker, 4)
+	if commits := completeAll(tracker, 1, 4); !slices.Equal(commits, []int64{4}) {
+		t.Fatalf("committed %v, want [4]", commits)
+	}
+}
+
+func TestWorkersKeepOrderPerKey(t *testing.T) {
+	broker := newFakeBroker()
+	const orders, eventsPerOrder = 5, 4
+	for i := range eventsPerOrder {
+		for order := range orders {
+			broker.write("orders", kafka.Message{
+				Key:   []byte(fmt.Sprintf("order-%d", order)),
+				Value: []byte(fmt.Sprint(i)),
+			})
+		}
+	}
+	consumer, _ := broker.consumer(KafkaConfig{Topic: "orders", GroupID: "workers", Workers: 3})
+
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	handled := 0
+	consumeUntil(t, consumer, func(msg *Message, stop func()) error {
+		time.Sleep(time.Millisecond) // let unrelated orders overlap
+		mu.Lock()
+		defer mu.Unlock()
+		seen[string(msg.Key)] = append(seen[string(msg.Key)], string(msg.Value))
+		if handled++; handled == orders*eventsPerOrder {
+			stop()
+		}
+		return nil
+	})
+
+	for key, values := range seen {
+		if !slices.Equal(values, []string{"0", "1", "2", "3"}) {
+			t.Errorf("%s handled in order %v", key, values)
+		}
+	}
+	if offset := broker.committedOffset("workers", "orders"); offset != orders*eventsPerOrder {
+		t.Fatalf("committed offset %d, want %d", offset, orders*eventsPerOrder)
+	}
+}
+
+func TestWorkersCommitAfterRebalance(t *testing.T) {
+	broker := newFakeBroker()
+	broker.produce("orders", "a", "b", "c", "d")
+	consumer, reader := broker.consumer(KafkaConfig{Topic: "orders", GroupID: "rebalanced", Workers: 2})
+
+	var calls recorder
+	var rebalance sync.Once
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumer.Consume(ctx, func(_ context.Context, msg *Message) error {
+			calls.add(string(msg.Value))
+			if string(msg.Value) == "d" {
+				// Everything fetched but not yet committed comes again
+				rebalance.Do(reader.rebalance)
+			}
+			return nil
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Every offset must end up committed, redelivered ones included
+	deadline := time.After(testTimeout)
+	for broker.committedOffset("rebalanced", "orders") < 4 {
+		select {
+		case <-deadline:
+			t.Fatalf("committed offset %d after handling %v, want 4",
+				broker.committedOffset("rebalanced", "orders"), calls.seen())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
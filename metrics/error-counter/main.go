@@ -40,6 +40,8 @@ type Config struct {
 	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
 	//consuming from the error topic
 	ErrorTopic string `env:"KAFKA_ERROR" envDefault:"order-error"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -48,21 +50,33 @@ type AppDependencies struct {
 }
 
 // process the metric
-func ProcessMetricWrapper(db *db.SimpleDatabase) func(key, value []byte) error {
-	return func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+func ProcessMetricWrapper(db db.Store) kafka.Handler {
+	return func(_ context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
+
+		// Skip other events without decoding them; messages published without
+		// headers are checked once decoded
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.Error] {
+			log.Printf("Not of type %s. Instead event type is %s.\n", events.OrderStatus[events.Error], eventName)
+			return nil
+		}
 
 		var event *events.Event
+		var report *events.ErrorReport
 		var order *events.Order
 		var err error
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
-		// Unmarshal the order
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		// Unmarshal the error report and the order of the event that failed
+		if report, err = event.ErrorReport(); err != nil {
+			log.Printf("Failed to unmarshal error report: %v\n", err)
+			return err
+		}
+		if order, err = report.FailedEvent.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
@@ -79,11 +93,15 @@ func ProcessMetricWrapper(db *db.SimpleDatabase) func(key, value []byte) error {
 		// Enforce order idempotence
 		// idea is that order ids are unique, but they are embedded in the order object
 		// using an in memory store, but would want a real db for this
-		if db.Exists(uniqueKey) {
+		added, err := db.AddIfAbsent(uniqueKey)
+		if err != nil {
+			log.Printf("Failed to record %s: %v\n", uniqueKey, err)
+			return err
+		}
+		if !added {
 			log.Printf("Error Event Id %s is a duplicate", uniqueKey)
 			return nil
 		}
-		db.Add(uniqueKey)
 		log.Printf("Error Event Id %s is unique\n", uniqueKey)
 
 		// Increment the Prometheus counter for each message
@@ -101,14 +119,21 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Read events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
 	// Create "database" for in-memory idempotence check
 	db := db.NewSimpleDatabase()
 
 	// Define Kafka configuration
 	kafkaConfigConsumer := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.ErrorTopic,
-		GroupID: "metrics-group",
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.ErrorTopic,
+		GroupID:    "metrics-group",
 	}
 
 	// Create KafkaConsumer instance
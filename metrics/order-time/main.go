@@ -33,7 +33,8 @@ var (
 
 	// store keeps track of orders and when they were first received.
 	// key: order_id, value: time when the order was received
-	store = db.NewSimpleInMemoryDatabase[string, time.Time]()
+	// Orders that are never picked & packed expire, see Config.OrderTTL.
+	store *db.SimpleInMemoryDatabase[string, time.Time]
 )
 
 func init() {
@@ -47,6 +48,13 @@ type Config struct {
 	//consuming order-received and order-picked-packed topics
 	OrderReceivedTopic     string `env:"KAFKA_ORDER_RECEIVED" envDefault:"order-received"`
 	OrderPickedPackedTopic string `env:"KAFKA_ORDER_PICKED_PACKED" envDefault:"order-picked-packed"`
+	//orders not picked & packed within OrderTTL are dropped, as are the oldest
+	//ones beyond MaxTrackedOrders
+	OrderTTL         time.Duration `env:"ORDER_TTL" envDefault:"24h"`
+	MaxTrackedOrders int           `env:"MAX_TRACKED_ORDERS" envDefault:"100000"`
+	JanitorInterval  time.Duration `env:"JANITOR_INTERVAL" envDefault:"1m"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -68,17 +76,35 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Read events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Track received orders, bounded so abandoned ones don't leak
+	store = db.NewSimpleInMemoryDatabase[string, time.Time](
+		db.WithTTL(cfg.OrderTTL),
+		db.WithMaxSize(cfg.MaxTrackedOrders),
+		db.WithJanitor(cfg.JanitorInterval),
+	)
+	defer store.Close()
+	store.OnEvict(func(orderID string, receivedAt time.Time, reason db.EvictionReason) {
+		log.Printf("Dropped order %s received at %s without a time to ship (%s)\n", orderID, receivedAt, reason)
+	})
+	registerStoreMetrics(store)
+
 	// Start the Kafka consumers in separate goroutines
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		consumeOrderReceived(&cfg, ctx)
+		consumeOrderReceived(&cfg, serializer, ctx)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		consumeOrderPickedPacked(&cfg, ctx)
+		consumeOrderPickedPacked(&cfg, serializer, ctx)
 	}()
 
 	// Start a Gin HTTP server to expose /metrics
@@ -124,12 +150,13 @@ func main() {
 	log.Println("All goroutines have exited. Service has shut down.")
 }
 
-func consumeOrderReceived(config *Config, context context.Context) {
+func consumeOrderReceived(config *Config, serializer kafka.Serializer, ctx context.Context) {
 
 	orderConsumerConfig := kafka.KafkaConfig{
-		Brokers: []string{config.Broker},
-		Topic:   config.OrderReceivedTopic,
-		GroupID: "metrics-group",
+		Brokers:    []string{config.Broker},
+		Serializer: serializer,
+		Topic:      config.OrderReceivedTopic,
+		GroupID:    "metrics-group",
 	}
 
 	// Create KafkaConsumer instance
@@ -137,20 +164,27 @@ func consumeOrderReceived(config *Config, context context.Context) {
 	defer consumer.Close()
 
 	log.Println("Listening for Order Received events...")
-	consumer.Consume(context, func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+	consumer.Consume(ctx, func(_ context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
+
+		// Skip other events without decoding them; messages published without
+		// headers are checked once decoded
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.OrderReceived] {
+			log.Printf("Not of type %s. Instead event type is %s.\n", events.OrderStatus[events.OrderReceived], eventName)
+			return nil
+		}
 
 		var event *events.Event
 		var order *events.Order
 		var err error
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
 		// Unmarshal the order
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		if order, err = event.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
@@ -178,12 +212,13 @@ func consumeOrderReceived(config *Config, context context.Context) {
 	})
 }
 
-func consumeOrderPickedPacked(config *Config, context context.Context) {
+func consumeOrderPickedPacked(config *Config, serializer kafka.Serializer, ctx context.Context) {
 
 	orderConsumerConfig := kafka.KafkaConfig{
-		Brokers: []string{config.Broker},
-		Topic:   config.OrderPickedPackedTopic,
-		GroupID: "metrics-group",
+		Brokers:    []string{config.Broker},
+		Serializer: serializer,
+		Topic:      config.OrderPickedPackedTopic,
+		GroupID:    "metrics-group",
 	}
 
 	// Create KafkaConsumer instance
@@ -191,20 +226,27 @@ func consumeOrderPickedPacked(config *Config, context context.Context) {
 	defer consumer.Close()
 
 	fmt.Println("Listening for Order Picked & Packed events...")
-	consumer.Consume(context, func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+	consumer.Consume(ctx, func(_ context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
+
+		// Skip other events without decoding them; messages published without
+		// headers are checked once decoded
+		if eventName := msg.EventName(); eventName != "" && eventName != events.OrderStatus[events.OrderPickedPacked] {
+			log.Printf("Not of type %s. Instead event type is %s.\n", events.OrderStatus[events.OrderPickedPacked], eventName)
+			return nil
+		}
 
 		var event *events.Event
 		var order *events.Order
 		var err error
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
 		// Unmarshal the order
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		if order, err = event.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
@@ -239,6 +281,33 @@ func consumeOrderPickedPacked(config *Config, context context.Context) {
 	})
 }
 
+// registerStoreMetrics exposes the size of store and how many orders it
+// dropped before they were picked & packed.
+func registerStoreMetrics(store *db.SimpleInMemoryDatabase[string, time.Time]) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "order_time_tracked_orders",
+			Help: "Orders received and not yet picked & packed",
+		}, func() float64 {
+			return float64(store.Stats().Size)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "order_time_dropped_orders_total",
+			Help:        "Orders dropped before being picked & packed",
+			ConstLabels: prometheus.Labels{"reason": db.EvictionExpired.String()},
+		}, func() float64 {
+			return float64(store.Stats().Expirations)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "order_time_dropped_orders_total",
+			Help:        "Orders dropped before being picked & packed",
+			ConstLabels: prometheus.Labels{"reason": db.EvictionCapacity.String()},
+		}, func() float64 {
+			return float64(store.Stats().CapacityEvictions)
+		}),
+	)
+}
+
 func toTime(input string) (time.Time, error) {
 	// Parse the time in RFC3339 format
 	t, err := time.Parse(time.RFC3339, input)
@@ -5,9 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/gin-gonic/gin"
@@ -16,13 +14,27 @@ import (
 	errors "github.com/tankcdr/ppe-kafka-go/error"
 	events "github.com/tankcdr/ppe-kafka-go/events"
 	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
 )
 
 // Config holds the environment configuration
 type Config struct {
-	Broker                 string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
-	OrderNotificationTopic string `env:"KAFKA_ORDER_NOTFIFICATION" envDefault:"order-notification"`
-	ErrorTopic             string `env:"KAFKA_ERROR" envDefault:"order-error"`
+	Broker                 string        `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
+	OrderNotificationTopic string        `env:"KAFKA_ORDER_NOTFIFICATION" envDefault:"order-notification"`
+	ErrorTopic             string        `env:"KAFKA_ERROR" envDefault:"order-error"`
+	DeadLetterTopic        string        `env:"KAFKA_DEAD_LETTER" envDefault:"notification-dlq"`
+	MaxAttempts            int           `env:"KAFKA_MAX_ATTEMPTS" envDefault:"5"`
+	ShutdownTimeout        time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter         string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//store of processed orders: "memory", "bolt" to keep them across restarts, or
+	//"redis" to share them between replicas (DB_PATH is then the server URL)
+	StoreBackend string        `env:"DB_BACKEND" envDefault:"memory"`
+	StorePath    string        `env:"DB_PATH" envDefault:"notification.db"`
+	StoreTTL     time.Duration `env:"DB_TTL" envDefault:"0s"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -37,17 +49,16 @@ type KafkaProducers struct {
 }
 
 // ProcessMessage processes the consumed Kafka message
-func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) func(key, value []byte) error {
-	return func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+func ProcessMessageWrapper(db db.Store, validator *schemas.Validator, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
 
 		var event *events.Event
 		var notification *events.Notification
 		var err error
-		context := context.Background()
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
@@ -57,8 +68,13 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 			return nil
 		}
 
+		// Validate the event against its schema; invalid events are reported on the error topic
+		if err := validator.ValidateEvent(event); err != nil {
+			return errors.HandleError(ctx, event, producers.ErrorProducer, err.Error())
+		}
+
 		// Unmarshal the Notification
-		if notification, err = events.NewNotificationFromBytes([]byte(event.EventBody)); err != nil {
+		if notification, err = event.Notification(); err != nil {
 			log.Printf("Failed to unmarshal notification: %v\n", err)
 			return err
 		}
@@ -68,14 +84,24 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 
 		// Enforce order idempotence
 		// idea is that order ids are unique, but they are embedded in the order object
-		// using an in memory store, but would want a real db for this
-		if db.Exists(uniqueKey) {
+		// the store is in memory unless DB_BACKEND selects a persistent one
+		claimed, err := db.AddIfAbsent(uniqueKey)
+		if err != nil {
+			log.Printf("Failed to record %s: %v\n", uniqueKey, err)
+			return err
+		}
+		if !claimed {
 			log.Printf("Notification %s is a duplicate\n", uniqueKey)
 			errorString := fmt.Sprintf("Notification %s is a duplicate", uniqueKey)
-			return errors.HandleError(context, event, producers.ErrorProducer, errorString)
-
+			return errors.HandleDuplicate(ctx, event, producers.ErrorProducer, errorString)
 		}
-		db.Add(uniqueKey)
+		// Release the claim if this attempt is retried or its transaction
+		// aborts, so the redelivery isn't mistaken for a duplicate
+		kafka.OnAbort(ctx, func() {
+			if err := db.Delete(uniqueKey); err != nil {
+				log.Printf("Failed to release %s: %v\n", uniqueKey, err)
+			}
+		})
 		log.Printf("Notification %s is unique\n", uniqueKey)
 
 		log.Printf("Sucessfully processed notification event: %v\n", notification)
@@ -91,37 +117,72 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create "database" for in-memory idempotence check
-	db := db.NewSimpleDatabase()
+	// Read and write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the event schemas used to validate published and consumed events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Open the store of processed orders used for the idempotence check
+	db, err := db.Open(cfg.StoreBackend, cfg.StorePath, db.WithKeyPrefix("notification:"), db.WithTTL(cfg.StoreTTL))
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
 
 	// Create Kafka producers
 	producers := KafkaProducers{
 		NotificationProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.OrderNotificationTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderNotificationTopic,
+			Validator:  validator,
+			Source:     "notification",
 		}),
 		ErrorProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.ErrorTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.ErrorTopic,
+			Validator:  validator,
+			Source:     "notification",
 		}),
 	}
-	defer producers.NotificationProducer.Close()
-	defer producers.ErrorProducer.Close()
 
 	// Define Kafka configuration
 	kafkaConfigConsumer := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.OrderNotificationTopic,
-		GroupID: "notification-group",
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderNotificationTopic,
+		GroupID:    "notification-group",
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
 	}
 
 	// Create KafkaConsumer instance
 	consumer := kafka.NewConsumer(kafkaConfigConsumer)
-	defer consumer.Close()
 
-	// Set up a context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each order; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "notification", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+	coordinator.OnShutdown("Database", func(context.Context) error {
+		return db.Close()
+	})
 
 	// Start REST server in a goroutine
 	router := gin.Default()
@@ -134,33 +195,33 @@ func main() {
 	// /shutdown endpoint
 	router.POST("/shutdown", func(c *gin.Context) {
 		log.Println("Shutdown request received")
-		cancel() // Signal the Kafka consumer to stop
+		coordinator.Cancel() // Signal the Kafka consumer to stop
 		c.String(http.StatusOK, "Shutting down")
 	})
 
-	// Start the REST server
-	go func() {
-		if err := router.Run(":8080"); err != nil {
-			log.Fatalf("Failed to start REST server: %v\n", err)
-		}
-	}()
-
-	// Handle graceful shutdown signals
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Println("Received shutdown signal")
-		cancel()
-	}()
+	// Start the REST server. Shutdown hooks run in reverse order once the
+	// consumer has finished its current message: producers are flushed, the
+	// consumer is closed and the REST server stops last.
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+	coordinator.OnShutdown("Kafka consumer", func(context.Context) error {
+		return consumer.Close()
+	})
+	coordinator.OnShutdown("NotificationProducer", func(context.Context) error {
+		return producers.NotificationProducer.Close()
+	})
+	coordinator.OnShutdown("ErrorProducer", func(context.Context) error {
+		return producers.ErrorProducer.Close()
+	})
 
 	// Start consuming Kafka messages
-	go func() {
+	coordinator.Go("Kafka consumer", func(ctx context.Context) {
 		log.Println("Starting Kafka consumer...")
-		consumer.Consume(ctx, ProcessMessageWrapper(db, &producers))
-	}()
+		consumer.Consume(ctx, ProcessMessageWrapper(db, validator, &producers))
+	})
 
-	// Wait for the context to be canceled (e.g., via /shutdown or signal)
-	<-ctx.Done()
-	log.Println("Service is shutting down...")
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/gin-gonic/gin"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
+)
+
+// Config holds the environment configuration
+type Config struct {
+	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
+	//consuming every topic of the order pipeline
+	OrderReceivedTopic     string `env:"KAFKA_ORDER_RECEIVED" envDefault:"order-received"`
+	OrderConfirmedTopic    string `env:"KAFKA_ORDER_CONFIRMED" envDefault:"order-confirmed"`
+	OrderRejectedTopic     string `env:"KAFKA_ORDER_REJECTED" envDefault:"order-rejected"`
+	OrderPickedPackedTopic string `env:"KAFKA_ORDER_PICKED_PACKED" envDefault:"order-picked-packed"`
+	OrderNotificationTopic string `env:"KAFKA_ORDER_NOTIFICATION" envDefault:"order-notification"`
+	ErrorTopic             string `env:"KAFKA_ERROR" envDefault:"order-error"`
+	//the shipper's answers to CancelShipment commands
+	CancellationReplyTopic string `env:"KAFKA_CANCELLATION_REPLY" envDefault:"order-cancellation-reply"`
+	//producing ReleaseStock and CancelShipment commands to order-compensation topic
+	CompensationTopic string        `env:"KAFKA_ORDER_COMPENSATION" envDefault:"order-compensation"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter    string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//sagas and their logs are kept here
+	SagaPath string `env:"SAGA_PATH" envDefault:"orchestrator.db"`
+	//how long each step may take before the order is compensated
+	ReserveStockTimeout time.Duration `env:"RESERVE_STOCK_TIMEOUT" envDefault:"1m"`
+	PickPackTimeout     time.Duration `env:"PICK_PACK_TIMEOUT" envDefault:"5m"`
+	ShipTimeout         time.Duration `env:"SHIP_TIMEOUT" envDefault:"5m"`
+	TimeoutInterval     time.Duration `env:"TIMEOUT_CHECK_INTERVAL" envDefault:"10s"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
+}
+
+// SagaMessageWrapper applies the events of a topic to the sagas of their orders
+func SagaMessageWrapper(orchestrator *Orchestrator) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return err
+		}
+
+		orderID, obs, err := observe(event)
+		if err != nil {
+			log.Printf("Failed to read %s event %s: %v\n", event.EventName, event.EventId, err)
+			return err
+		}
+		if orderID == "" || obs.kind == "" {
+			return nil
+		}
+
+		saga, err := orchestrator.Observe(ctx, orderID, obs)
+		if err != nil {
+			log.Printf("Failed to update saga of order %s: %v\n", orderID, err)
+			return err
+		}
+		log.Printf("Order %s saga is %s at %s after %s\n", orderID, saga.Status, saga.Step, event.EventName)
+		return nil
+	}
+}
+
+// observe returns the order an event is about and what it tells about the
+// order's progress; the observation is empty for events that don't matter to
+// the saga.
+func observe(event *events.Event) (string, observation, error) {
+	obs := observation{eventID: event.EventId}
+	orderID := event.CorrelationId
+
+	switch event.EventName {
+	case events.OrderStatus[events.OrderReceived]:
+		obs.kind = observedReceived
+	case events.OrderStatus[events.OrderConfirmed]:
+		obs.kind, obs.step = observedDone, StepReserveStock
+	case events.OrderStatus[events.OrderRejected]:
+		rejection, err := event.Rejection()
+		if err != nil {
+			return "", obs, err
+		}
+		obs.kind, obs.detail = observedRejected, rejection.Reason
+	case events.OrderStatus[events.OrderPickedPacked]:
+		obs.kind, obs.step = observedDone, StepPickPack
+	case events.OrderStatus[events.NotificationEvent]:
+		notification, err := event.Notification()
+		if err != nil {
+			return "", obs, err
+		}
+		switch events.NotificationType(notification.Type) {
+		case events.OrderShipped:
+			obs.kind, obs.step = observedDone, StepShip
+		case events.CancellationConfirmed:
+			obs.kind = observedCancelled
+		}
+	case events.OrderStatus[events.Error]:
+		report, err := event.ErrorReport()
+		if err != nil {
+			return "", obs, err
+		}
+		// Duplicates are reported too, but the order is fine
+		if !report.Failure() {
+			return "", obs, nil
+		}
+		// Errors about OrderReceived events are inventory's own, mostly
+		// duplicates, and don't mean the order failed; a reservation that
+		// never comes is caught by the step's timeout
+		switch report.FailedEvent.EventName {
+		case events.OrderStatus[events.OrderConfirmed]:
+			obs.kind, obs.step = observedFailed, StepPickPack
+		case events.OrderStatus[events.OrderPickedPacked]:
+			obs.kind, obs.step = observedFailed, StepShip
+		}
+		obs.detail = report.ErrorMessage
+		if orderID == "" {
+			orderID = report.FailedEvent.CorrelationId
+		}
+	case events.OrderStatus[events.CancellationAnswered]:
+		reply, err := event.CancellationReply()
+		if err != nil {
+			return "", obs, err
+		}
+		// Answers to customer cancellations are inventory's to collect
+		if reply.Request != events.OrderStatus[events.CancelShipment] {
+			return "", obs, nil
+		}
+		obs.kind, obs.detail = observedShipmentCancelled, "shipper accepted CancelShipment"
+		if !reply.Accepted {
+			obs.kind, obs.detail = observedShipmentKept, reply.Reason
+		}
+		orderID = reply.OrderID
+	}
+	if obs.kind == "" {
+		return "", obs, nil
+	}
+
+	// Events published before correlation IDs existed carry the order ID only in the body
+	if orderID == "" && event.EventName != events.OrderStatus[events.Error] {
+		order, err := event.Order()
+		if err != nil {
+			return "", obs, err
+		}
+		orderID = order.OrderID
+	}
+	return orderID, obs, nil
+}
+
+func main() {
+	// Load configuration
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Read and write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the event schemas used to validate published events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Open the sagas left by the previous run
+	store, err := OpenSagaStore(cfg.SagaPath)
+	if err != nil {
+		log.Fatalf("Failed to open saga store: %v", err)
+	}
+
+	// Create the producer of compensation commands
+	producer := kafka.NewProducer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.CompensationTopic,
+		Validator:  validator,
+		Source:     "orchestrator",
+	})
+
+	orchestrator := NewOrchestrator(store, Timeouts{
+		StepReserveStock: cfg.ReserveStockTimeout,
+		StepPickPack:     cfg.PickPackTimeout,
+		StepShip:         cfg.ShipTimeout,
+	}, producer)
+
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each event; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "orchestrator", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+	coordinator.OnShutdown("Saga store", func(context.Context) error {
+		return store.Close()
+	})
+	coordinator.OnShutdown("Compensation producer", func(context.Context) error {
+		return producer.Close()
+	})
+
+	// Start REST server in a goroutine
+	router := gin.Default()
+
+	// /health endpoint
+	router.GET("/health", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	// saga endpoints
+	router.GET("/sagas", listSagas(store))
+	router.GET("/saga/:id", getSaga(store))
+
+	// /shutdown endpoint
+	router.POST("/shutdown", func(c *gin.Context) {
+		log.Println("Shutdown request received")
+		coordinator.Cancel() // Signal the Kafka consumers to stop
+		c.String(http.StatusOK, "Shutting down")
+	})
+
+	// Start the REST server; it stops after the consumers are closed
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+
+	// Consume every topic, each in its own group so the consumers don't
+	// rebalance one another
+	for _, topic := range []string{
+		cfg.OrderReceivedTopic,
+		cfg.OrderConfirmedTopic,
+		cfg.OrderRejectedTopic,
+		cfg.OrderPickedPackedTopic,
+		cfg.OrderNotificationTopic,
+		cfg.ErrorTopic,
+		cfg.CancellationReplyTopic,
+	} {
+		consumer := kafka.NewConsumer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      topic,
+			GroupID:    "orchestrator-" + topic,
+			// Commit only after the saga is stored
+			ManualCommit: true,
+			Retry: kafka.RetryPolicy{
+				MaxAttempts:    5,
+				InitialBackoff: time.Second,
+				MaxBackoff:     30 * time.Second,
+				Jitter:         0.2,
+			},
+		})
+		coordinator.OnShutdown(fmt.Sprintf("Kafka consumer (%s)", topic), func(context.Context) error {
+			return consumer.Close()
+		})
+		coordinator.Go(fmt.Sprintf("Kafka consumer (%s)", topic), func(ctx context.Context) {
+			log.Printf("Listening for events on %s...\n", topic)
+			consumer.Consume(ctx, SagaMessageWrapper(orchestrator))
+		})
+	}
+
+	// Fail overdue steps and retry compensations that couldn't be published
+	coordinator.Go("Saga timeouts", func(ctx context.Context) {
+		ticker := time.NewTicker(cfg.TimeoutInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := orchestrator.CheckTimeouts(ctx); err != nil {
+					log.Printf("Failed to check saga timeouts: %v\n", err)
+				}
+			}
+		}
+	})
+
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
+}
+
+// listSagas handles the GET /sagas route
+// takes optional status and limit (default 100) query parameters
+func listSagas(store *SagaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		sagas, err := store.List(c.Request.Context(), Status(c.Query("status")), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list sagas: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, sagas)
+	}
+}
+
+// getSaga handles the GET /saga/:id route
+func getSaga(store *SagaStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		saga, err := store.Get(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, ErrSagaNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("No saga for order %s", c.Param("id"))})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get saga: %v", err)})
+			return
+		}
+		c.JSON(http.StatusOK, saga)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+)
+
+// commands maps the names of compensation commands to their event types.
+var commands = map[string]events.EventType{
+	events.OrderStatus[events.ReleaseStock]:   events.ReleaseStock,
+	events.OrderStatus[events.CancelShipment]: events.CancelShipment,
+}
+
+// Orchestrator follows each order through the workflow, keeping its saga in
+// a SagaStore, and publishes the compensations of a step that fails or times
+// out.
+type Orchestrator struct {
+	store    *SagaStore
+	timeouts Timeouts
+	producer *kafka.KafkaProducer // of compensation commands
+}
+
+// NewOrchestrator creates an Orchestrator publishing compensations with
+// producer.
+func NewOrchestrator(store *SagaStore, timeouts Timeouts, producer *kafka.KafkaProducer) *Orchestrator {
+	return &Orchestrator{store: store, timeouts: timeouts, producer: producer}
+}
+
+// Observe applies obs to the saga of an order, starting the saga if it is the
+// first news of the order, and publishes the compensations it calls for.
+// Compensations that can't be published are left pending for CheckTimeouts
+// to retry; only a failure to store the saga is returned.
+func (o *Orchestrator) Observe(ctx context.Context, orderID string, obs observation) (*Saga, error) {
+	saga, err := o.store.Update(ctx, orderID,
+		func() *Saga { return newSaga(orderID, time.Now().UTC(), o.timeouts) },
+		func(s *Saga) { s.observe(obs, time.Now().UTC(), o.timeouts) })
+	if err != nil {
+		return nil, err
+	}
+	return o.compensate(ctx, saga), nil
+}
+
+// CheckTimeouts fails the sagas whose step is overdue and publishes the
+// compensations still pending.
+func (o *Orchestrator) CheckTimeouts(ctx context.Context) error {
+	orderIDs, err := o.store.Active(ctx)
+	if err != nil {
+		return err
+	}
+	for _, orderID := range orderIDs {
+		saga, err := o.store.Get(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		if saga.Status == StatusRunning && saga.Deadline != nil && time.Now().After(*saga.Deadline) {
+			saga, err = o.store.Update(ctx, orderID, nil, func(s *Saga) {
+				s.observe(observation{kind: observedTimeout}, time.Now().UTC(), o.timeouts)
+			})
+			if err != nil {
+				return err
+			}
+			if saga.Status == StatusCompensating {
+				log.Printf("Order %s: %s timed out\n", orderID, saga.FailedStep)
+			}
+		}
+		o.compensate(ctx, saga)
+	}
+	return nil
+}
+
+// compensate publishes the pending compensations of saga, recording each one
+// published, and returns the saga as stored.
+func (o *Orchestrator) compensate(ctx context.Context, saga *Saga) *Saga {
+	for _, name := range saga.Pending {
+		command, err := events.NewCompensationEvent(commands[name], &events.Compensation{
+			OrderID:    saga.OrderID,
+			FailedStep: string(saga.FailedStep),
+			Reason:     saga.failure(),
+		})
+		if err != nil {
+			log.Printf("Failed to create %s command for order %s: %v\n", name, saga.OrderID, err)
+			return saga
+		}
+		if err := o.producer.Publish(ctx, command); err != nil {
+			log.Printf("Failed to produce %s command for order %s, will retry: %v\n", name, saga.OrderID, err)
+			return saga
+		}
+		log.Printf("Published %s command for order %s\n", name, saga.OrderID)
+
+		updated, err := o.store.Update(ctx, saga.OrderID, nil, func(s *Saga) {
+			s.compensated(name, time.Now().UTC())
+		})
+		if err != nil {
+			// The command is published again later; its consumers are idempotent
+			log.Printf("Failed to record %s command for order %s: %v\n", name, saga.OrderID, err)
+			return saga
+		}
+		saga = updated
+	}
+	return saga
+}
+
+// failure describes why the failed step of a saga failed.
+func (s *Saga) failure() string {
+	for i := len(s.Log) - 1; i >= 0; i-- {
+		entry := s.Log[i]
+		if entry.Step == s.FailedStep && (entry.Action == ActionFailed || entry.Action == ActionTimedOut) {
+			return fmt.Sprintf("%s %s: %s", entry.Step, entry.Action, entry.Detail)
+		}
+	}
+	return fmt.Sprintf("%s failed", s.FailedStep)
+}
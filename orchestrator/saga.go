@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// Step is a step of the order workflow.
+type Step string
+
+const (
+	StepReserveStock Step = "ReserveStock"
+	StepPickPack     Step = "PickPack"
+	StepShip         Step = "Ship"
+)
+
+// steps lists the workflow in order.
+var steps = []Step{StepReserveStock, StepPickPack, StepShip}
+
+// Status is the status of a saga.
+type Status string
+
+const (
+	StatusRunning      Status = "Running"      // a step is under way
+	StatusCompleted    Status = "Completed"    // the order shipped
+	StatusCompensating Status = "Compensating" // a step failed; the shipment is being cancelled, then the stock released
+	StatusCompensated  Status = "Compensated"  // a step failed, the shipment was cancelled and ReleaseStock published
+	StatusRejected     Status = "Rejected"     // inventory rejected the order; nothing to undo
+	StatusCancelled    Status = "Cancelled"    // the customer cancelled; the cancellation undid the steps
+)
+
+// Actions recorded in the saga log.
+const (
+	ActionStarted      = "started"
+	ActionCompleted    = "completed"
+	ActionFailed       = "failed"
+	ActionTimedOut     = "timed out"
+	ActionCompensate   = "compensation published"
+	ActionLate         = "late"
+	ActionRejected     = "rejected"
+	ActionCancelled    = "cancelled"
+	ActionCompensating = "compensating"
+	ActionStopped      = "shipment cancelled"
+	ActionNotStopped   = "shipment not cancelled"
+)
+
+// Timeouts bounds how long each step may take.
+type Timeouts map[Step]time.Duration
+
+// LogEntry is a line of a saga's log.
+type LogEntry struct {
+	At      time.Time `json:"at"`
+	Step    Step      `json:"step"`
+	Action  string    `json:"action"`
+	Detail  string    `json:"detail,omitempty"`
+	EventID string    `json:"eventId,omitempty"`
+}
+
+// Saga is the progress of one order through the workflow.
+type Saga struct {
+	OrderID string `json:"orderId"`
+	Status  Status `json:"status"`
+	// Step is the step under way, or the last one reached
+	Step Step `json:"step"`
+	// Deadline is when the step under way times out; nil unless Running
+	Deadline   *time.Time `json:"deadline,omitempty"`
+	FailedStep Step       `json:"failedStep,omitempty"`
+	// Pending are the compensations not yet published, by event name
+	Pending   []string   `json:"pending,omitempty"`
+	StartedAt time.Time  `json:"startedAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	Log       []LogEntry `json:"log,omitempty"`
+
+	// logged counts the entries of Log already stored
+	logged int
+}
+
+// observation is what an event, or the clock, tells about an order.
+type observation struct {
+	eventID string
+	kind    string // one of the kinds below
+	step    Step   // the step done or failed
+	detail  string
+}
+
+const (
+	observedReceived  = "received"
+	observedDone      = "done"
+	observedFailed    = "failed"
+	observedTimeout   = "timeout"
+	observedRejected  = "rejected"
+	observedCancelled = "cancelled"
+	// the shipper's answer to CancelShipment
+	observedShipmentCancelled = "shipment cancelled"
+	observedShipmentKept      = "shipment kept"
+)
+
+// newSaga starts the saga of an order at its first step.
+func newSaga(orderID string, now time.Time, timeouts Timeouts) *Saga {
+	s := &Saga{OrderID: orderID, Status: StatusRunning, StartedAt: now}
+	s.start(StepReserveStock, now, timeouts)
+	return s
+}
+
+// observe moves the saga on according to obs. Events are consumed from
+// several topics independently, so a step may be seen done before the one
+// preceding it; the saga then moves ahead, and news of a step already passed
+// or of a saga already over is only logged as late. An event already in the
+// log is ignored.
+func (s *Saga) observe(obs observation, now time.Time, timeouts Timeouts) {
+	if obs.eventID != "" && slices.ContainsFunc(s.Log, func(e LogEntry) bool { return e.EventID == obs.eventID }) {
+		return
+	}
+	// The shipper's answer may come before CancelShipment is recorded as
+	// published
+	if s.awaitsShipper() {
+		switch obs.kind {
+		case observedShipmentCancelled:
+			s.Pending = []string{events.OrderStatus[events.ReleaseStock]}
+			s.log(s.FailedStep, ActionStopped, obs.detail, obs.eventID, now)
+			return
+		case observedShipmentKept:
+			// The order went through after all, and its stock goes with it
+			s.Status, s.Step, s.Pending = StatusCompleted, StepShip, nil
+			s.log(StepShip, ActionNotStopped, obs.detail, obs.eventID, now)
+			return
+		}
+	}
+	if s.Status != StatusRunning {
+		if obs.kind != observedTimeout && obs.kind != observedReceived {
+			s.log(obs.step, ActionLate, fmt.Sprintf("%s, saga already %s", obs.kind, s.Status), obs.eventID, now)
+		}
+		return
+	}
+
+	switch obs.kind {
+	case observedReceived:
+		// Starting the saga is all there is to do
+	case observedDone:
+		if stepIndex(obs.step) < stepIndex(s.Step) {
+			s.log(obs.step, ActionLate, "step already passed", obs.eventID, now)
+			return
+		}
+		s.log(obs.step, ActionCompleted, obs.detail, obs.eventID, now)
+		next := stepIndex(obs.step) + 1
+		if next == len(steps) {
+			s.Status, s.Step, s.Deadline = StatusCompleted, obs.step, nil
+			return
+		}
+		s.start(steps[next], now, timeouts)
+	case observedFailed:
+		// A failure of another step is about a redelivery or a duplicate
+		if obs.step != s.Step {
+			s.log(obs.step, ActionLate, obs.detail, obs.eventID, now)
+			return
+		}
+		s.log(obs.step, ActionFailed, obs.detail, obs.eventID, now)
+		s.fail(now)
+	case observedTimeout:
+		if s.Deadline == nil || now.Before(*s.Deadline) {
+			return
+		}
+		s.log(s.Step, ActionTimedOut, fmt.Sprintf("no progress after %v", timeouts[s.Step]), "", now)
+		s.fail(now)
+	case observedRejected:
+		s.Status, s.Deadline = StatusRejected, nil
+		s.log(StepReserveStock, ActionRejected, obs.detail, obs.eventID, now)
+	case observedCancelled:
+		s.Status, s.Deadline = StatusCancelled, nil
+		s.log("", ActionCancelled, obs.detail, obs.eventID, now)
+	}
+}
+
+// compensated records that the compensation named eventName was published,
+// completing the saga once the last one is.
+func (s *Saga) compensated(eventName string, now time.Time) {
+	s.Pending = slices.DeleteFunc(s.Pending, func(p string) bool { return p == eventName })
+	s.log(s.FailedStep, ActionCompensate, eventName, "", now)
+	if len(s.Pending) == 0 && s.Status == StatusCompensating && eventName == events.OrderStatus[events.ReleaseStock] {
+		s.Status = StatusCompensated
+	}
+}
+
+// awaitsShipper reports whether the saga is compensating and the shipper
+// hasn't yet answered its CancelShipment command.
+func (s *Saga) awaitsShipper() bool {
+	return s.Status == StatusCompensating &&
+		!slices.ContainsFunc(s.Log, func(e LogEntry) bool { return e.Action == ActionStopped })
+}
+
+// start makes step the one under way.
+func (s *Saga) start(step Step, now time.Time, timeouts Timeouts) {
+	deadline := now.Add(timeouts[step])
+	s.Step, s.Deadline = step, &deadline
+	s.log(step, ActionStarted, fmt.Sprintf("due by %s", deadline.Format(time.RFC3339)), "", now)
+}
+
+// fail starts compensating the step under way, whichever it is. The order is
+// stopped at the shipper first with CancelShipment, as even a reservation
+// that timed out may still go through and send the order on; ReleaseStock
+// follows once the shipper answers that the shipment is cancelled or was
+// never created. An order the shipper has already shipped keeps its stock.
+func (s *Saga) fail(now time.Time) {
+	s.Status, s.FailedStep, s.Deadline = StatusCompensating, s.Step, nil
+	s.Pending = []string{events.OrderStatus[events.CancelShipment]}
+	s.log(s.Step, ActionCompensating, fmt.Sprint(s.Pending), "", now)
+}
+
+// log appends an entry to the log; an entry about no particular step is
+// about the step under way.
+func (s *Saga) log(step Step, action, detail, eventID string, now time.Time) {
+	if step == "" {
+		step = s.Step
+	}
+	s.UpdatedAt = now
+	s.Log = append(s.Log, LogEntry{At: now, Step: step, Action: action, Detail: detail, EventID: eventID})
+}
+
+// stepIndex returns the position of step in the workflow.
+func stepIndex(step Step) int {
+	return slices.Index(steps, step)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+var testTimeouts = Timeouts{StepReserveStock: time.Minute, StepPickPack: time.Minute, StepShip: time.Minute}
+
+func TestFailedStepCompensations(t *testing.T) {
+	cancelShipment := []string{events.OrderStatus[events.CancelShipment]}
+	releaseStock := []string{events.OrderStatus[events.ReleaseStock]}
+
+	for _, step := range steps {
+		t.Run(string(step), func(t *testing.T) {
+			now := time.Now()
+			saga := newSaga("ORD-1", now, testTimeouts)
+			for _, done := range steps[:stepIndex(step)] {
+				saga.observe(observation{eventID: string(done), kind: observedDone, step: done}, now, testTimeouts)
+			}
+			saga.observe(observation{eventID: "error", kind: observedFailed, step: step}, now, testTimeouts)
+
+			if saga.Status != StatusCompensating || saga.FailedStep != step {
+				t.Fatalf("saga %s, failed in %s", saga.Status, saga.FailedStep)
+			}
+			// The shipment is cancelled first, and the stock released only
+			// once the shipper confirms it
+			if !slices.Equal(saga.Pending, cancelShipment) {
+				t.Fatalf("pending %v, want %v", saga.Pending, cancelShipment)
+			}
+			saga.compensated(cancelShipment[0], now)
+			if saga.Status != StatusCompensating || len(saga.Pending) > 0 {
+				t.Fatalf("saga %s pending %v while the shipper hasn't answered", saga.Status, saga.Pending)
+			}
+			saga.observe(observation{eventID: "reply", kind: observedShipmentCancelled}, now, testTimeouts)
+			if !slices.Equal(saga.Pending, releaseStock) {
+				t.Fatalf("pending %v after the shipment was cancelled, want %v", saga.Pending, releaseStock)
+			}
+			saga.compensated(releaseStock[0], now)
+			if saga.Status != StatusCompensated {
+				t.Fatalf("saga %s after compensating, want %s", saga.Status, StatusCompensated)
+			}
+		})
+	}
+}
+
+func TestShippedOrderKeepsStock(t *testing.T) {
+	now := time.Now()
+	saga := newSaga("ORD-1", now, testTimeouts)
+	saga.observe(observation{eventID: "confirmed", kind: observedDone, step: StepReserveStock}, now, testTimeouts)
+	saga.observe(observation{eventID: "picked", kind: observedDone, step: StepPickPack}, now, testTimeouts)
+	saga.observe(observation{kind: observedTimeout}, now.Add(2*time.Minute), testTimeouts)
+	saga.compensated(events.OrderStatus[events.CancelShipment], now)
+
+	saga.observe(observation{eventID: "reply", kind: observedShipmentKept, detail: "already shipped"}, now, testTimeouts)
+	if saga.Status != StatusCompleted || len(saga.Pending) > 0 {
+		t.Fatalf("saga %s pending %v after the shipper refused, want %s and nothing pending",
+			saga.Status, saga.Pending, StatusCompleted)
+	}
+}
+
+func TestShipperAnswersBeforeCancelShipmentIsRecorded(t *testing.T) {
+	now := time.Now()
+	saga := newSaga("ORD-1", now, testTimeouts)
+	saga.observe(observation{kind: observedTimeout}, now.Add(2*time.Minute), testTimeouts)
+
+	saga.observe(observation{eventID: "reply", kind: observedShipmentCancelled}, now, testTimeouts)
+	saga.compensated(events.OrderStatus[events.CancelShipment], now)
+	if saga.Status != StatusCompensating || !slices.Equal(saga.Pending, []string{events.OrderStatus[events.ReleaseStock]}) {
+		t.Fatalf("saga %s pending %v, want ReleaseStock", saga.Status, saga.Pending)
+	}
+
+	// A redelivered answer changes nothing
+	saga.observe(observation{eventID: "reply", kind: observedShipmentCancelled}, now, testTimeouts)
+	saga.compensated(events.OrderStatus[events.ReleaseStock], now)
+	if saga.Status != StatusCompensated {
+		t.Fatalf("saga %s, want %s", saga.Status, StatusCompensated)
+	}
+}
+
+func TestDuplicateReportsDontFailSagas(t *testing.T) {
+	order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", TotalAmount: 1,
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+	confirmed, err := order.ToEvent(events.OrderConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		newEvent func(*events.Event, string) (*events.Event, error)
+		want     string
+	}{
+		{"duplicate", events.NewDuplicateEvent, ""},
+		{"failure", events.NewErrorEvent, observedFailed},
+	} {
+		report, err := test.newEvent(confirmed, "pick & pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, obs, err := observe(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obs.kind != test.want {
+			t.Errorf("%s report observed as %q, want %q", test.name, obs.kind, test.want)
+		}
+	}
+}
+
+func TestReserveStockTimeoutCancelsShipment(t *testing.T) {
+	now := time.Now()
+	saga := newSaga("ORD-1", now, testTimeouts)
+	saga.observe(observation{kind: observedTimeout}, now.Add(30*time.Second), testTimeouts)
+	if saga.Status != StatusRunning {
+		t.Fatalf("saga %s before the deadline", saga.Status)
+	}
+
+	saga.observe(observation{kind: observedTimeout}, now.Add(2*time.Minute), testTimeouts)
+	if saga.Status != StatusCompensating || !slices.Contains(saga.Pending, events.OrderStatus[events.CancelShipment]) {
+		t.Fatalf("saga %s pending %v, want CancelShipment", saga.Status, saga.Pending)
+	}
+
+	// The reservation going through late changes nothing
+	saga.observe(observation{eventID: "confirmed", kind: observedDone, step: StepReserveStock}, now.Add(3*time.Minute), testTimeouts)
+	if last := saga.Log[len(saga.Log)-1]; last.Action != ActionLate {
+		t.Fatalf("late reservation logged as %s", last.Action)
+	}
+}
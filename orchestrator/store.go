@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+// ErrSagaNotFound is returned for an order without a saga.
+var ErrSagaNotFound = errors.New("saga not found")
+
+const sagaSchema = `
+CREATE TABLE IF NOT EXISTS sagas (
+	order_id    TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	step        TEXT NOT NULL,
+	deadline    TIMESTAMP,
+	failed_step TEXT NOT NULL DEFAULT '',
+	pending     TEXT NOT NULL DEFAULT '[]',
+	started_at  TIMESTAMP NOT NULL,
+	updated_at  TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sagas_active ON sagas (status) WHERE status IN ('Running', 'Compensating');
+CREATE TABLE IF NOT EXISTS saga_log (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	order_id TEXT NOT NULL,
+	at       TIMESTAMP NOT NULL,
+	step     TEXT NOT NULL,
+	action   TEXT NOT NULL,
+	detail   TEXT NOT NULL DEFAULT '',
+	event_id TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS saga_log_order ON saga_log (order_id, id);
+`
+
+// SagaStore keeps sagas and their logs in SQLite, so an orchestrator that
+// restarts carries on where it stopped, timeouts included.
+type SagaStore struct {
+	db *sql.DB
+}
+
+// OpenSagaStore opens (creating if needed) the saga database at path.
+func OpenSagaStore(path string) (*SagaStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serialises writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sagaSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating saga tables: %w", err)
+	}
+	return &SagaStore{db: db}, nil
+}
+
+// Update applies fn to the saga of an order in one transaction, and returns
+// the saga as stored. If the order has no saga, fn is given the one returned
+// by create, or nothing happens and ErrSagaNotFound is returned when create is
+// nil.
+func (s *SagaStore) Update(ctx context.Context, orderID string, create func() *Saga, fn func(*Saga)) (*Saga, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	saga, err := load(ctx, tx, orderID)
+	if errors.Is(err, ErrSagaNotFound) && create != nil {
+		saga, err = create(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fn(saga)
+
+	pending, err := json.Marshal(saga.Pending)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO sagas (order_id, status, step, deadline, failed_step, pending, started_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (order_id) DO UPDATE SET
+			status = excluded.status, step = excluded.step, deadline = excluded.deadline,
+			failed_step = excluded.failed_step, pending = excluded.pending, updated_at = excluded.updated_at`,
+		saga.OrderID, saga.Status, saga.Step, saga.Deadline, saga.FailedStep, string(pending),
+		saga.StartedAt, saga.UpdatedAt); err != nil {
+		return nil, err
+	}
+	for _, entry := range saga.Log[saga.logged:] {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO saga_log (order_id, at, step, action, detail, event_id) VALUES (?, ?, ?, ?, ?, ?)`,
+			saga.OrderID, entry.At, entry.Step, entry.Action, entry.Detail, entry.EventID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	saga.logged = len(saga.Log)
+	return saga, nil
+}
+
+// Get returns the saga of an order, with its log.
+func (s *SagaStore) Get(ctx context.Context, orderID string) (*Saga, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return load(ctx, tx, orderID)
+}
+
+// Active returns the IDs of the orders whose saga is running or
+// compensating, oldest first.
+func (s *SagaStore) Active(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT order_id FROM sagas WHERE status IN ('Running', 'Compensating') ORDER BY started_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orderIDs []string
+	for rows.Next() {
+		var orderID string
+		if err := rows.Scan(&orderID); err != nil {
+			return nil, err
+		}
+		orderIDs = append(orderIDs, orderID)
+	}
+	return orderIDs, rows.Err()
+}
+
+// List returns up to limit sagas without their logs, most recently updated
+// first, only those with the given status unless it is empty.
+func (s *SagaStore) List(ctx context.Context, status Status, limit int) ([]*Saga, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT order_id, status, step, deadline, failed_step, pending, started_at, updated_at
+		FROM sagas WHERE ? = '' OR status = ? ORDER BY updated_at DESC LIMIT ?`, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sagas := []*Saga{}
+	for rows.Next() {
+		saga, err := scanSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, saga)
+	}
+	return sagas, rows.Err()
+}
+
+// Close closes the saga database.
+func (s *SagaStore) Close() error {
+	return s.db.Close()
+}
+
+// load reads the saga of an order and its log within tx.
+func load(ctx context.Context, tx *sql.Tx, orderID string) (*Saga, error) {
+	saga, err := scanSaga(tx.QueryRowContext(ctx, `
+		SELECT order_id, status, step, deadline, failed_step, pending, started_at, updated_at
+		FROM sagas WHERE order_id = ?`, orderID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrSagaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		`SELECT at, step, action, detail, event_id FROM saga_log WHERE order_id = ? ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	saga.Log = []LogEntry{}
+	for rows.Next() {
+		var entry LogEntry
+		if err := rows.Scan(&entry.At, &entry.Step, &entry.Action, &entry.Detail, &entry.EventID); err != nil {
+			return nil, err
+		}
+		saga.Log = append(saga.Log, entry)
+	}
+	saga.logged = len(saga.Log)
+	return saga, rows.Err()
+}
+
+// scanSaga reads a row of the sagas table.
+func scanSaga(row interface{ Scan(...any) error }) (*Saga, error) {
+	var saga Saga
+	var deadline sql.NullTime
+	var pending string
+	if err := row.Scan(&saga.OrderID, &saga.Status, &saga.Step, &deadline, &saga.FailedStep, &pending,
+		&saga.StartedAt, &saga.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if deadline.Valid {
+		saga.Deadline = &deadline.Time
+	}
+	if err := json.Unmarshal([]byte(pending), &saga.Pending); err != nil {
+		return nil, fmt.Errorf("decoding pending compensations of %s: %w", saga.OrderID, err)
+	}
+	return &saga, nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/gin-gonic/gin"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
+)
+
+// Config holds the environment configuration
+type Config struct {
+	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
+	//consuming every topic of the order pipeline
+	OrderReceivedTopic     string        `env:"KAFKA_ORDER_RECEIVED" envDefault:"order-received"`
+	OrderConfirmedTopic    string        `env:"KAFKA_ORDER_CONFIRMED" envDefault:"order-confirmed"`
+	OrderRejectedTopic     string        `env:"KAFKA_ORDER_REJECTED" envDefault:"order-rejected"`
+	OrderPickedPackedTopic string        `env:"KAFKA_ORDER_PICKED_PACKED" envDefault:"order-picked-packed"`
+	OrderNotificationTopic string        `env:"KAFKA_ORDER_NOTIFICATION" envDefault:"order-notification"`
+	OrderCancelledTopic    string        `env:"KAFKA_ORDER_CANCELLED" envDefault:"order-cancelled"`
+	ErrorTopic             string        `env:"KAFKA_ERROR" envDefault:"error"`
+	ShutdownTimeout        time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter         string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//order records are saved here periodically and on shutdown, and loaded on startup;
+	//changes in between are journaled next to it before their events are committed
+	SnapshotPath     string        `env:"STATE_SNAPSHOT" envDefault:"order-state.json"`
+	SnapshotInterval time.Duration `env:"STATE_SNAPSHOT_INTERVAL" envDefault:"1m"`
+	//orders without events for this long are forgotten
+	Retention time.Duration `env:"STATE_RETENTION" envDefault:"168h"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
+}
+
+// StateMessageWrapper applies the events of a topic to the order records
+func StateMessageWrapper(tracker *Tracker) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var err error
+
+		// Unmarshal the event
+		// A malformed event won't read any better on a retry
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return kafka.Handled(err)
+		}
+
+		orderID, entry, err := historyEntry(event)
+		if err != nil {
+			log.Printf("Failed to read %s event %s: %v\n", event.EventName, event.EventId, err)
+			return kafka.Handled(err)
+		}
+		if orderID == "" {
+			log.Printf("Ignoring %s event %s without an order\n", event.EventName, event.EventId)
+			return nil
+		}
+		entry.Topic = msg.Topic
+
+		record, err := tracker.Apply(orderID, entry)
+		if goerrors.Is(err, ErrIllegalTransition) {
+			log.Printf("Order %s: %s event %s rejected: %v\n", orderID, event.EventName, event.EventId, err)
+			return nil
+		}
+		if err != nil {
+			// Not committed, so the event is retried
+			log.Printf("Order %s: failed to record %s event %s: %v\n", orderID, event.EventName, event.EventId, err)
+			return err
+		}
+		log.Printf("Order %s is %s after %s\n", orderID, record.State, event.EventName)
+		return nil
+	}
+}
+
+// historyEntry returns the order an event is about and its history entry,
+// with the state the event moves the order to.
+func historyEntry(event *events.Event) (string, HistoryEntry, error) {
+	entry := HistoryEntry{
+		EventID:   event.EventId,
+		EventName: event.EventName,
+		Timestamp: event.Timestamp,
+	}
+	orderID := event.CorrelationId
+
+	switch event.EventName {
+	case events.OrderStatus[events.OrderReceived]:
+		entry.State = StateReceived
+	case events.OrderStatus[events.OrderConfirmed]:
+		entry.State = StateConfirmed
+	case events.OrderStatus[events.OrderRejected]:
+		entry.State = StateRejected
+		rejection, err := event.Rejection()
+		if err != nil {
+			return "", entry, err
+		}
+		entry.Detail = rejection.Reason
+	case events.OrderStatus[events.OrderPickedPacked]:
+		entry.State = StatePickedPacked
+	case events.OrderStatus[events.OrderCancelled]:
+		// Only a request; the order is cancelled once inventory confirms it
+		cancellation, err := event.Cancellation()
+		if err != nil {
+			return "", entry, err
+		}
+		entry.Detail = cancellation.Reason
+	case events.OrderStatus[events.NotificationEvent]:
+		notification, err := event.Notification()
+		if err != nil {
+			return "", entry, err
+		}
+		switch events.NotificationType(notification.Type) {
+		case events.OrderShipped:
+			entry.State = StateShipped
+		case events.CancellationConfirmed:
+			entry.State = StateCancelled
+		}
+		entry.Detail = events.NotificationStatus[events.NotificationType(notification.Type)]
+	case events.OrderStatus[events.Error]:
+		report, err := event.ErrorReport()
+		if err != nil {
+			return "", entry, err
+		}
+		entry.Detail = report.ErrorMessage
+		// Only failures of the order pipeline's own events move the order;
+		// duplicates of them are only recorded
+		failedEvent := report.FailedEvent.EventName
+		if !report.Failure() {
+			failedEvent = ""
+		}
+		switch failedEvent {
+		case events.OrderStatus[events.OrderReceived]:
+			entry.State, entry.FailedIn = StateFailed, StateReceived
+		case events.OrderStatus[events.OrderConfirmed]:
+			entry.State, entry.FailedIn = StateFailed, StateConfirmed
+		case events.OrderStatus[events.OrderPickedPacked]:
+			entry.State, entry.FailedIn = StateFailed, StatePickedPacked
+		}
+		if orderID == "" {
+			orderID = report.FailedEvent.CorrelationId
+		}
+	default:
+		return "", entry, nil
+	}
+
+	// Events published before correlation IDs existed carry the order ID only in the body
+	if orderID == "" && event.EventName != events.OrderStatus[events.Error] {
+		order, err := event.Order()
+		if err != nil {
+			return "", entry, err
+		}
+		orderID = order.OrderID
+	}
+	return orderID, entry, nil
+}
+
+func main() {
+	// Load configuration
+	var cfg Config
+	if err := env.Parse(&cfg); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// Read events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the order records saved by the previous run
+	tracker := NewTracker(db.WithTTL(cfg.Retention), db.WithJanitor(time.Minute))
+	if cfg.SnapshotPath != "" {
+		if err := tracker.Persist(cfg.SnapshotPath); err != nil {
+			log.Fatalf("Failed to restore order states: %v", err)
+		}
+		log.Printf("Restored %d orders from %s\n", tracker.Len(), cfg.SnapshotPath)
+	}
+
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each event; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "order-state", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+
+	// Save the records once the consumers have stopped
+	coordinator.OnShutdown("State snapshot", func(context.Context) error {
+		defer tracker.Close()
+		return tracker.Snapshot()
+	})
+
+	// Start REST server in a goroutine
+	router := gin.Default()
+
+	// /health endpoint
+	router.GET("/health", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	// order state endpoints
+	router.GET("/order/:id", getOrder(tracker))
+	router.GET("/order/:id/history", getOrderHistory(tracker))
+
+	// /shutdown endpoint
+	router.POST("/shutdown", func(c *gin.Context) {
+		log.Println("Shutdown request received")
+		coordinator.Cancel() // Signal the Kafka consumers to stop
+		c.String(http.StatusOK, "Shutting down")
+	})
+
+	// Start the REST server; it stops after the consumers are closed and the
+	// records saved
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+
+	// Consume every topic, each in its own group so the consumers don't
+	// rebalance one another. Offsets are committed only once the order's
+	// record is journaled, so a crash never skips an event
+	for _, topic := range []string{
+		cfg.OrderReceivedTopic,
+		cfg.OrderConfirmedTopic,
+		cfg.OrderRejectedTopic,
+		cfg.OrderPickedPackedTopic,
+		cfg.OrderNotificationTopic,
+		cfg.OrderCancelledTopic,
+		cfg.ErrorTopic,
+	} {
+		consumer := kafka.NewConsumer(kafka.KafkaConfig{
+			Brokers:      []string{cfg.Broker},
+			Serializer:   serializer,
+			Topic:        topic,
+			GroupID:      "order-state-" + topic,
+			ManualCommit: true,
+			Retry: kafka.RetryPolicy{
+				InitialBackoff: time.Second,
+				MaxBackoff:     30 * time.Second,
+				Jitter:         0.2,
+			},
+		})
+		coordinator.OnShutdown(fmt.Sprintf("Kafka consumer (%s)", topic), func(context.Context) error {
+			return consumer.Close()
+		})
+		coordinator.Go(fmt.Sprintf("Kafka consumer (%s)", topic), func(ctx context.Context) {
+			log.Printf("Listening for events on %s...\n", topic)
+			consumer.Consume(ctx, StateMessageWrapper(tracker))
+		})
+	}
+
+	// Save the records regularly, which keeps the journal short
+	if cfg.SnapshotPath != "" && cfg.SnapshotInterval > 0 {
+		coordinator.Go("State snapshots", func(ctx context.Context) {
+			ticker := time.NewTicker(cfg.SnapshotInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					if err := tracker.Snapshot(); err != nil {
+						log.Printf("Failed to save order states: %v\n", err)
+					}
+				}
+			}
+		})
+	}
+
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
+}
+
+// getOrder handles the GET /order/:id route
+func getOrder(tracker *Tracker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, ok := tracker.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Order %s not found", c.Param("id"))})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"orderId": record.OrderID, "state": record.State, "updatedAt": record.UpdatedAt})
+	}
+}
+
+// getOrderHistory handles the GET /order/:id/history route
+func getOrderHistory(tracker *Tracker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record, ok := tracker.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Order %s not found", c.Param("id"))})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"orderId": record.OrderID, "state": record.State, "history": record.History})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+)
+
+// State is a stage of an order's lifecycle.
+type State string
+
+const (
+	StateReceived     State = "Received"
+	StateConfirmed    State = "Confirmed"
+	StatePickedPacked State = "PickedPacked"
+	StateShipped      State = "Shipped"
+	StateRejected     State = "Rejected"
+	StateCancelled    State = "Cancelled"
+	StateFailed       State = "Failed"
+)
+
+// transitions lists the states each state may move to. Every topic is
+// consumed separately, so an order can be seen to skip a step whose event
+// arrives later; later steps are therefore allowed as well as the next one.
+// Shipped, Rejected, Cancelled and Failed are final.
+var transitions = map[State][]State{
+	StateReceived:     {StateConfirmed, StatePickedPacked, StateShipped, StateRejected, StateCancelled, StateFailed},
+	StateConfirmed:    {StatePickedPacked, StateShipped, StateCancelled, StateFailed},
+	StatePickedPacked: {StateShipped, StateCancelled, StateFailed},
+}
+
+// progress ranks the states of the normal flow, to tell an event that arrived
+// late from one that is out of place.
+var progress = map[State]int{
+	StateReceived:     1,
+	StateConfirmed:    2,
+	StatePickedPacked: 3,
+	StateShipped:      4,
+}
+
+// CanTransition reports whether an order in state from may move to state to.
+func CanTransition(from, to State) bool {
+	return slices.Contains(transitions[from], to)
+}
+
+// ErrIllegalTransition is returned for an event that would move an order to a
+// state it can't reach from its current one.
+var ErrIllegalTransition = errors.New("illegal state transition")
+
+// Outcomes of an event in an order's history.
+const (
+	OutcomeApplied  = "applied"  // the order moved to the event's state
+	OutcomeLate     = "late"     // the order had already passed the event's state
+	OutcomeRecorded = "recorded" // the event doesn't change the state
+	OutcomeRejected = "rejected" // the transition is illegal
+)
+
+// HistoryEntry is an event seen for an order.
+type HistoryEntry struct {
+	EventID   string    `json:"eventId"`
+	EventName string    `json:"eventName"`
+	Timestamp string    `json:"timestamp"` // when the event occurred
+	SeenAt    time.Time `json:"seenAt"`
+	Topic     string    `json:"topic"`
+	State     State     `json:"state,omitempty"` // the state the event moves the order to, if any
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	// FailedIn is, for a failure, the state of the event that failed; a
+	// failure for a state the order has moved past is about a redelivery or
+	// duplicate, not this order's progress
+	FailedIn State `json:"failedIn,omitempty"`
+}
+
+// OrderRecord is the state and timeline of one order.
+type OrderRecord struct {
+	OrderID   string         `json:"orderId"`
+	State     State          `json:"state"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	History   []HistoryEntry `json:"history"`
+	// Progress is the furthest step of the normal flow reached, which a
+	// final state like Failed doesn't undo
+	Progress int `json:"progress"`
+}
+
+// Tracker keeps the record of every order, applying the state machine to the
+// events seen for it. It is safe for concurrent use.
+type Tracker struct {
+	mu      sync.Mutex // serialises read-modify-write of records
+	orders  *db.SimpleInMemoryDatabase[string, OrderRecord]
+	path    string   // snapshot file, set by Persist
+	journal *os.File // records changed since the last snapshot
+}
+
+// NewTracker creates a Tracker; opts bound how long and how many orders it
+// remembers.
+func NewTracker(opts ...db.Option) *Tracker {
+	return &Tracker{orders: db.NewSimpleInMemoryDatabase[string, OrderRecord](opts...)}
+}
+
+// Apply records entry for an order, moving the order to entry.State if that
+// is a legal transition. An entry with an empty State is only recorded. An
+// event already in the history is ignored, so redelivered events are
+// harmless. It returns the updated record, and ErrIllegalTransition if the
+// transition was rejected.
+func (t *Tracker) Apply(orderID string, entry HistoryEntry) (OrderRecord, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, ok := t.orders.Get(orderID)
+	if !ok {
+		record = OrderRecord{OrderID: orderID}
+	}
+	for _, seen := range record.History {
+		if seen.EventID == entry.EventID {
+			return record, nil
+		}
+	}
+
+	var err error
+	switch {
+	case entry.State == "":
+		entry.Outcome = OutcomeRecorded
+	case entry.FailedIn != "" && passed(record, entry.FailedIn):
+		entry.Outcome = OutcomeLate
+		entry.Detail = fmt.Sprintf("failure reported for %s, order is %s", entry.FailedIn, record.State)
+	case record.State == "" || CanTransition(record.State, entry.State):
+		entry.Outcome = OutcomeApplied
+		record.State = entry.State
+		record.Progress = max(record.Progress, progress[entry.State])
+	case progress[entry.State] > 0 && (progress[entry.State] <= record.Progress || final(record.State)):
+		// A step of the normal flow seen after a later step or a final state
+		// happened before it, its event only arrived later on its own topic
+		entry.Outcome = OutcomeLate
+		record.Progress = max(record.Progress, progress[entry.State])
+	default:
+		entry.Outcome = OutcomeRejected
+		err = fmt.Errorf("%w from %s to %s", ErrIllegalTransition, record.State, entry.State)
+		entry.Detail = err.Error()
+	}
+
+	entry.SeenAt = time.Now().UTC()
+	record.UpdatedAt = entry.SeenAt
+	// Records handed out earlier keep their own history
+	record.History = append(slices.Clip(record.History), entry)
+	// Journal the record first, so an event is never acknowledged but lost
+	if err := t.write(record); err != nil {
+		return record, fmt.Errorf("journaling order %s: %w", orderID, err)
+	}
+	t.orders.Add(orderID, record)
+	return record, err
+}
+
+// final reports whether an order in state can't move on any more.
+func final(state State) bool {
+	return state != "" && len(transitions[state]) == 0
+}
+
+// passed reports whether an order has moved on from state, which it may also
+// not have reached yet: its failure can arrive before the event that failed.
+func passed(record OrderRecord, state State) bool {
+	switch {
+	case record.State == "" || record.State == state:
+		return false
+	case final(record.State):
+		return true
+	default:
+		return progress[record.State] > progress[state]
+	}
+}
+
+// Get returns the record of an order, and whether it is known.
+func (t *Tracker) Get(orderID string) (OrderRecord, bool) {
+	return t.orders.Get(orderID)
+}
+
+// Len returns the number of orders tracked.
+func (t *Tracker) Len() int {
+	return t.orders.Len()
+}
+
+// Persist loads the records saved at path by Snapshot and journaled since,
+// and from then on journals every record Apply changes before it returns, so
+// that an event is only acknowledged once its change survives a crash.
+func (t *Tracker) Persist(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.orders.Restore(path); err != nil {
+		return err
+	}
+	journal, err := replayJournal(path+".journal", t.orders)
+	if err != nil {
+		return err
+	}
+	t.path, t.journal = path, journal
+	return nil
+}
+
+// Snapshot saves the records to the file given to Persist and empties the
+// journal. It does nothing if the records aren't persisted.
+func (t *Tracker) Snapshot() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.journal == nil {
+		return nil
+	}
+	if err := t.orders.Snapshot(t.path); err != nil {
+		return err
+	}
+	return t.journal.Truncate(0)
+}
+
+// Close stops expiring records and closes the journal.
+func (t *Tracker) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.orders.Close()
+	if t.journal == nil {
+		return nil
+	}
+	err := t.journal.Close()
+	t.journal = nil
+	return err
+}
+
+// write appends record to the journal, if any, and waits until it is on disk.
+func (t *Tracker) write(record OrderRecord) error {
+	if t.journal == nil {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := t.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return t.journal.Sync()
+}
+
+// replayJournal adds the records of the journal at path to orders, the last
+// one of each order winning, and opens the journal for appending. A last line
+// cut short by a crash was never acknowledged, and is dropped.
+func replayJournal(path string, orders *db.SimpleInMemoryDatabase[string, OrderRecord]) (*os.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record OrderRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("decoding journal %s, line %d: %w", path, i+1, err)
+		}
+		orders.Add(record.OrderID, record)
+	}
+
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// Drop a cut-short line, so the next record starts on a line of its own
+	if n := bytes.LastIndexByte(data, '\n') + 1; n < len(data) {
+		if err := journal.Truncate(int64(n)); err != nil {
+			journal.Close()
+			return nil, err
+		}
+	}
+	return journal, nil
+}
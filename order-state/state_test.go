@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+func apply(t *testing.T, tracker *Tracker, orderID string, entry HistoryEntry) OrderRecord {
+	t.Helper()
+	record, err := tracker.Apply(orderID, entry)
+	if err != nil {
+		t.Fatalf("Apply(%s) = %v", entry.EventID, err)
+	}
+	return record
+}
+
+func assertOutcomes(t *testing.T, record OrderRecord, state State, outcomes ...string) {
+	t.Helper()
+	if record.State != state {
+		t.Fatalf("order is %s, want %s", record.State, state)
+	}
+	if len(record.History) != len(outcomes) {
+		t.Fatalf("%d history entries, want %d", len(record.History), len(outcomes))
+	}
+	for i, outcome := range outcomes {
+		if record.History[i].Outcome != outcome {
+			t.Fatalf("entry %d (%s) is %s, want %s", i, record.History[i].EventID, record.History[i].Outcome, outcome)
+		}
+	}
+}
+
+func TestApplyToleratesEventsOutOfOrder(t *testing.T) {
+	tracker := NewTracker()
+	defer tracker.Close()
+
+	// Rejected seen before Received
+	apply(t, tracker, "ORD-1", HistoryEntry{EventID: "e2", State: StateRejected})
+	record := apply(t, tracker, "ORD-1", HistoryEntry{EventID: "e1", State: StateReceived})
+	assertOutcomes(t, record, StateRejected, OutcomeApplied, OutcomeLate)
+
+	// Shipped seen before the steps leading to it
+	apply(t, tracker, "ORD-2", HistoryEntry{EventID: "e4", State: StateShipped})
+	apply(t, tracker, "ORD-2", HistoryEntry{EventID: "e2", State: StateConfirmed})
+	apply(t, tracker, "ORD-2", HistoryEntry{EventID: "e1", State: StateReceived})
+	record = apply(t, tracker, "ORD-2", HistoryEntry{EventID: "e3", State: StatePickedPacked})
+	assertOutcomes(t, record, StateShipped, OutcomeApplied, OutcomeLate, OutcomeLate, OutcomeLate)
+
+	// A failure seen before the event that failed
+	apply(t, tracker, "ORD-3", HistoryEntry{EventID: "e1", State: StateReceived})
+	apply(t, tracker, "ORD-3", HistoryEntry{EventID: "e3", State: StateFailed, FailedIn: StateConfirmed})
+	record = apply(t, tracker, "ORD-3", HistoryEntry{EventID: "e2", State: StateConfirmed})
+	assertOutcomes(t, record, StateFailed, OutcomeApplied, OutcomeApplied, OutcomeLate)
+	if record.Progress != progress[StateConfirmed] {
+		t.Fatalf("progress %d, want %d", record.Progress, progress[StateConfirmed])
+	}
+
+	// A failure of a step the order has passed is about a redelivery
+	apply(t, tracker, "ORD-4", HistoryEntry{EventID: "e1", State: StateReceived})
+	apply(t, tracker, "ORD-4", HistoryEntry{EventID: "e2", State: StateConfirmed})
+	record = apply(t, tracker, "ORD-4", HistoryEntry{EventID: "e3", State: StateFailed, FailedIn: StateReceived})
+	assertOutcomes(t, record, StateConfirmed, OutcomeApplied, OutcomeApplied, OutcomeLate)
+
+	// Leaving a final state is still illegal
+	apply(t, tracker, "ORD-5", HistoryEntry{EventID: "e1", State: StateShipped})
+	if _, err := tracker.Apply("ORD-5", HistoryEntry{EventID: "e2", State: StateCancelled}); !errors.Is(err, ErrIllegalTransition) {
+		t.Fatalf("Cancelled after Shipped: %v", err)
+	}
+}
+
+func TestTrackerSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "order-state.json")
+
+	tracker := NewTracker()
+	if err := tracker.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	apply(t, tracker, "ORD-1", HistoryEntry{EventID: "e1", State: StateReceived})
+	if err := tracker.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// Journaled after the snapshot, then the service crashes without another
+	apply(t, tracker, "ORD-1", HistoryEntry{EventID: "e2", State: StateFailed, FailedIn: StateConfirmed})
+	apply(t, tracker, "ORD-2", HistoryEntry{EventID: "e3", State: StateReceived})
+	tracker.journal.Write([]byte(`{"orderId":"ORD-3","sta`)) // cut short by the crash
+	tracker.Close()
+
+	tracker = NewTracker()
+	defer tracker.Close()
+	if err := tracker.Persist(path); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.Len() != 2 {
+		t.Fatalf("%d orders after restart, want 2", tracker.Len())
+	}
+	record, _ := tracker.Get("ORD-1")
+	assertOutcomes(t, record, StateFailed, OutcomeApplied, OutcomeApplied)
+	if record.History[1].FailedIn != StateConfirmed {
+		t.Fatalf("failure for %q, want %s", record.History[1].FailedIn, StateConfirmed)
+	}
+	// The failed step's event is still recognised as late
+	record = apply(t, tracker, "ORD-1", HistoryEntry{EventID: "e4", State: StateConfirmed})
+	assertOutcomes(t, record, StateFailed, OutcomeApplied, OutcomeApplied, OutcomeLate)
+
+	// A snapshot empties the journal
+	if err := tracker.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path + ".journal"); err != nil || info.Size() != 0 {
+		t.Fatalf("journal after snapshot: %v, %v", info, err)
+	}
+}
+
+func TestDuplicateReportsDontFailOrders(t *testing.T) {
+	order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", TotalAmount: 1,
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+	confirmed, err := order.ToEvent(events.OrderConfirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		newEvent func(*events.Event, string) (*events.Event, error)
+		state    State
+	}{
+		{events.NewDuplicateEvent, ""},
+		{events.NewErrorEvent, StateFailed},
+	} {
+		report, err := tc.newEvent(confirmed, "message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		orderID, entry, err := historyEntry(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if orderID != "ORD-1" || entry.State != tc.state {
+			t.Fatalf("report about %s moves the order to %q, want %q", orderID, entry.State, tc.state)
+		}
+	}
+}
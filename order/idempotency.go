@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// ErrIdempotencyKeyUsed is returned by Outbox.Accept when another request
+// stored a response for the same Idempotency-Key first.
+var ErrIdempotencyKeyUsed = errors.New("idempotency key already used")
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// IdempotentResponse is the response to the first request made with an
+// Idempotency-Key, replayed to the retries of that request until it expires.
+type IdempotentResponse struct {
+	Key         string
+	RequestHash string // of the request body, see requestHash
+	Status      int
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// Response returns the response stored for an Idempotency-Key, or nil if the
+// key is unknown or has expired.
+func (o *Outbox) Response(ctx context.Context, key string) (*IdempotentResponse, error) {
+	r := IdempotentResponse{Key: key}
+	var body string
+	err := o.db.QueryRowContext(ctx, `
+		SELECT request_hash, status, body, expires_at FROM idempotency_keys
+		WHERE key = ? AND expires_at > ?`, key, time.Now().UTC()).
+		Scan(&r.RequestHash, &r.Status, &body, &r.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Body = []byte(body)
+	return &r, nil
+}
+
+// remember stores r within tx, dropping the expired responses so a key can be
+// used again once its window is over.
+func (o *Outbox) remember(ctx context.Context, tx *sql.Tx, r *IdempotentResponse, now time.Time) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= ?`, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (key, request_hash, status, body, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		r.Key, r.RequestHash, r.Status, string(r.Body), r.ExpiresAt); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrIdempotencyKeyUsed
+		}
+		return err
+	}
+	return nil
+}
+
+// requestHash fingerprints a JSON request body. The body is decoded and
+// encoded again first, so retries differing only in whitespace or key order
+// count as the same request.
+func requestHash(body []byte) (string, error) {
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "", err
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newOrderID generates the ID of an order posted without one.
+func newOrderID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", fmt.Errorf("generating order ID: %w", err)
+	}
+	return "ORD-" + id.String(), nil
+}
@@ -2,26 +2,48 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 	events "github.com/tankcdr/ppe-kafka-go/events"
 	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 // Config holds the environment configuration
 type Config struct {
-	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
-	Topic  string `env:"KAFKA_TOPIC" envDefault:"order-received"`
+	Broker          string        `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
+	Topic           string        `env:"KAFKA_TOPIC" envDefault:"order-received"`
+	CancelledTopic  string        `env:"KAFKA_ORDER_CANCELLED" envDefault:"order-cancelled"`
+	TracesExporter  string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	MaxOrderItems   int           `env:"MAX_ORDER_ITEMS" envDefault:"100"`
+	//responses to requests with an Idempotency-Key are replayed to retries for this long
+	IdempotencyWindow time.Duration `env:"IDEMPOTENCY_WINDOW" envDefault:"24h"`
+	//accepted orders wait here until they are published
+	OutboxPath         string        `env:"OUTBOX_PATH" envDefault:"order-outbox.db"`
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" envDefault:"1s"`
+	OutboxMaxBackoff   time.Duration `env:"OUTBOX_MAX_BACKOFF" envDefault:"30s"`
+	OutboxRetention    time.Duration `env:"OUTBOX_RETENTION" envDefault:"168h"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
 type AppDependencies struct {
-	Producer *kafka.KafkaProducer
-	Config   Config
+	Outbox    *Outbox
+	Validator *schemas.Validator
+	Config    Config
 }
 
 func main() {
@@ -31,32 +53,95 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Initialize Kafka producer
-	kafkaConfig := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.Topic,
-		GroupID: "order-service",
+	// Write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
 	}
-	producer := kafka.NewProducer(kafkaConfig)
-	defer producer.Close()
+
+	// Coordinate shutdown on SIGINT/SIGTERM
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace each order from the HTTP request through the pipeline; registered
+	// first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "order", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+
+	// Load the event schemas used to validate published events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Initialize Kafka producers, one per topic the outbox publishes to
+	producers := Producers{}
+	for eventType, topic := range map[events.EventType]string{
+		events.OrderReceived:  cfg.Topic,
+		events.OrderCancelled: cfg.CancelledTopic,
+	} {
+		producer := kafka.NewProducer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      topic,
+			GroupID:    "order-service",
+			Validator:  validator,
+			Source:     "order",
+		})
+		coordinator.OnShutdown(fmt.Sprintf("Kafka producer (%s)", topic), func(context.Context) error {
+			return producer.Close()
+		})
+		producers[events.OrderStatus[eventType]] = producer
+	}
+
+	// Open the outbox that accepted orders are stored in until published
+	outbox, err := OpenOutbox(cfg.OutboxPath)
+	if err != nil {
+		log.Fatalf("Failed to open outbox: %v", err)
+	}
+	coordinator.OnShutdown("Outbox", func(context.Context) error {
+		return outbox.Close()
+	})
 
 	// Create shared dependencies
 	deps := AppDependencies{
-		Producer: producer,
-		Config:   cfg,
+		Outbox:    outbox,
+		Validator: validator,
+		Config:    cfg,
 	}
 
-	// Setup and run the server
-	r := setupRouter(&deps)
-	r.Run(":8080")
+	// Setup and run the server; it stops before the outbox is closed
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: setupRouter(&deps)})
+
+	// Publish stored events to Kafka in the background
+	coordinator.Go("Outbox relay", func(ctx context.Context) {
+		log.Println("Starting outbox relay...")
+		outbox.Relay(ctx, producers, OutboxRelayConfig{
+			PollInterval:   cfg.OutboxPollInterval,
+			BatchSize:      100,
+			InitialBackoff: time.Second,
+			MaxBackoff:     cfg.OutboxMaxBackoff,
+			Retention:      cfg.OutboxRetention,
+		})
+	})
+
+	// Wait for a shutdown signal and for the shutdown to complete
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
 }
 
 func setupRouter(deps *AppDependencies) *gin.Engine {
 	r := gin.Default()
+	r.Use(otelgin.Middleware("order"))
 	r.GET("/health", func(c *gin.Context) {
 		c.String(200, "ok")
 	})
 	r.POST("/order", postOrder(deps))
+	r.DELETE("/order/:id", deleteOrder(deps))
 	return r
 }
 
@@ -64,14 +149,56 @@ func setupRouter(deps *AppDependencies) *gin.Engine {
 // expects a JSON payload of an Order
 func postOrder(deps *AppDependencies) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+
+		// A retry of a request made with the same Idempotency-Key gets the
+		// first response again instead of placing the order twice
+		key := c.GetHeader("Idempotency-Key")
+		var hash string
+		if key != "" {
+			if len(key) > maxIdempotencyKeyLength {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)})
+				return
+			}
+			if hash, err = requestHash(body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+				return
+			}
+			if replayed := replay(c, deps.Outbox, key, hash); replayed {
+				return
+			}
+		}
+
 		// validating the JSON payload
-		var order events.Order
-		// Get the order from the JSON body
-		// Bind the JSON to the general Event struct
-		if err := c.ShouldBindJSON(&order); err != nil {
+		var request orderRequest
+		// Get the order from the JSON body; the binding tags of orderRequest
+		// are checked as it is bound
+		bindErr := binding.JSON.BindBody(body, &request)
+		violations := bindingViolations(bindErr)
+		if bindErr != nil && violations == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
 			return
 		}
+		order := request.Order()
+
+		// Check the business rules too, so every violation is reported at once
+		violations = append(violations, businessViolations(&order, deps.Config.MaxOrderItems)...)
+		if len(violations) > 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Order is invalid", "violations": violations})
+			return
+		}
+
+		// Orders posted without an ID get one here
+		if order.OrderID == "" {
+			if order.OrderID, err = newOrderID(); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
 
 		// Create an Event struct
 		orderReceivedEvent, err := order.ToEvent(events.OrderReceived)
@@ -82,18 +209,102 @@ func postOrder(deps *AppDependencies) gin.HandlerFunc {
 			return
 		}
 
-		// Publish the OrderReceived Event to Kafka
-		ctx := context.Background()
-		producerErr := deps.Producer.Publish(ctx, orderReceivedEvent)
+		// An order that doesn't match the OrderReceived schema is the client's mistake
+		if err := deps.Validator.ValidateEvent(orderReceivedEvent); err != nil {
+			var validationErr *schemas.ValidationError
+			if errors.As(err, &validationErr) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{
+					"error":      "Order does not match the OrderReceived schema",
+					"violations": schemaViolations(validationErr),
+				})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to validate order: %v", err)})
+			return
+		}
+
+		response, err := json.Marshal(gin.H{"status": "Order received", "eventId": orderReceivedEvent.EventId, "order": order})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to encode response: %v", err)})
+			return
+		}
+		var remembered *IdempotentResponse
+		if key != "" {
+			remembered = &IdempotentResponse{
+				Key:         key,
+				RequestHash: hash,
+				Status:      http.StatusOK,
+				Body:        response,
+				ExpiresAt:   time.Now().UTC().Add(deps.Config.IdempotencyWindow),
+			}
+		}
+
+		// Store the order and its OrderReceived event; the outbox relay publishes
+		// the event to Kafka, as part of the request's trace
+		if err := deps.Outbox.Accept(c.Request.Context(), &order, orderReceivedEvent, remembered); err != nil {
+			// A concurrent request with the same key may have won the race
+			if key != "" && (errors.Is(err, ErrIdempotencyKeyUsed) || errors.Is(err, ErrDuplicateOrder)) {
+				if replayed := replay(c, deps.Outbox, key, hash); replayed {
+					return
+				}
+			}
+			if errors.Is(err, ErrDuplicateOrder) {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Order %s already exists", order.OrderID)})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store order: %v", err)})
+			return
+		}
+		log.Println("Stored order event in the outbox")
 
-		if producerErr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("Failed to marshal order: %v", producerErr),
-			})
+		c.Data(http.StatusOK, "application/json; charset=utf-8", response)
+	}
+}
+
+// replay answers a request made with an Idempotency-Key already used: with
+// the stored response if the request is the same, or a 409 if it isn't. It
+// reports whether it answered, which it doesn't for an unknown key.
+func replay(c *gin.Context, outbox *Outbox, key, hash string) bool {
+	stored, err := outbox.Response(c.Request.Context(), key)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to look up Idempotency-Key: %v", err)})
+		return true
+	}
+	if stored == nil {
+		return false
+	}
+	if stored.RequestHash != hash {
+		c.JSON(http.StatusConflict, gin.H{"error": "Idempotency-Key was already used with a different payload"})
+		return true
+	}
+	log.Printf("Replaying the response for Idempotency-Key %s\n", key)
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(stored.Status, "application/json; charset=utf-8", stored.Body)
+	return true
+}
+
+// deleteOrder handles the DELETE /order/:id route
+// requests the cancellation of an order, with an optional reason query parameter
+func deleteOrder(deps *AppDependencies) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID := c.Param("id")
+
+		// Record the cancellation and its OrderCancelled event; the services
+		// downstream stop the order if it hasn't gone too far
+		event, err := deps.Outbox.Cancel(c.Request.Context(), orderID, c.Query("reason"))
+		if err != nil {
+			switch {
+			case errors.Is(err, ErrOrderNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Order %s not found", orderID)})
+			case errors.Is(err, ErrAlreadyCancelled):
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Order %s is already cancelled", orderID)})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to cancel order: %v", err)})
+			}
 			return
 		}
-		log.Println("Published order event")
+		log.Printf("Stored cancellation of order %s in the outbox\n", orderID)
 
-		c.JSON(http.StatusOK, gin.H{"status": "Order received", "eventId": orderReceivedEvent.EventId, "order": order})
+		c.JSON(http.StatusAccepted, gin.H{"status": "Cancellation requested", "eventId": event.EventId})
 	}
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+const orderBody = `{"customerId":"CUST-1","orderDate":"2024-01-02T03:04:05Z",
+	"items":[{"itemId":"ITEM-1","quantity":2,"price":1.5}],"totalAmount":3,"currency":"USD"}`
+
+// testRouter returns the router of an order service storing orders in a
+// temporary outbox, and the outbox.
+func testRouter(t *testing.T) (*gin.Engine, *Outbox) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	validator, err := schemas.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox := openTestOutbox(t)
+	deps := &AppDependencies{
+		Outbox:    outbox,
+		Validator: validator,
+		Config:    Config{MaxOrderItems: 100, IdempotencyWindow: time.Hour},
+	}
+	return setupRouter(deps), outbox
+}
+
+// post sends body to POST /order with the Idempotency-Key key, if not empty.
+func post(router *gin.Engine, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// acceptedOrderID returns the ID of the order accepted by the response in w.
+func acceptedOrderID(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Order struct {
+			OrderID string `json:"orderId"`
+		} `json:"order"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.Order.OrderID
+}
+
+func pending(t *testing.T, outbox *Outbox) int {
+	t.Helper()
+	count, err := outbox.Pending(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPostOrderGeneratesID(t *testing.T) {
+	router, outbox := testRouter(t)
+
+	first := acceptedOrderID(t, post(router, "", orderBody))
+	second := acceptedOrderID(t, post(router, "", orderBody))
+	if !strings.HasPrefix(first, "ORD-") || !strings.HasPrefix(second, "ORD-") || first == second {
+		t.Fatalf("generated order IDs %q and %q, want two distinct ORD- IDs", first, second)
+	}
+	// Without a key, the same body is a new order every time
+	if count := pending(t, outbox); count != 2 {
+		t.Fatalf("%d events in the outbox, want 2", count)
+	}
+}
+
+func TestPostOrderReplaysSameRequest(t *testing.T) {
+	router, outbox := testRouter(t)
+
+	first := post(router, "KEY-1", orderBody)
+	orderID := acceptedOrderID(t, first)
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("first response marked as replayed")
+	}
+
+	retry := post(router, "KEY-1", orderBody)
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Fatalf("retry got %d %s, want the first response %s", retry.Code, retry.Body, first.Body)
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("retry not marked as replayed")
+	}
+	if acceptedOrderID(t, retry) != orderID {
+		t.Fatalf("retry got another order ID")
+	}
+	if count := pending(t, outbox); count != 1 {
+		t.Fatalf("%d events in the outbox, want 1", count)
+	}
+}
+
+func TestPostOrderRejectsKeyReuse(t *testing.T) {
+	router, outbox := testRouter(t)
+
+	acceptedOrderID(t, post(router, "KEY-1", orderBody))
+	other := strings.Replace(orderBody, "CUST-1", "CUST-2", 1)
+	w := post(router, "KEY-1", other)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d for another body with the same key, want 409: %s", w.Code, w.Body)
+	}
+	if count := pending(t, outbox); count != 1 {
+		t.Fatalf("%d events in the outbox, want 1", count)
+	}
+}
+
+func TestConcurrentPostsWithOneKey(t *testing.T) {
+	other := strings.Replace(orderBody, "CUST-1", "CUST-2", 1)
+	for _, test := range []struct {
+		name   string
+		bodies [2]string
+		loser  int // status of the request that didn't place the order
+	}{
+		{"same body", [2]string{orderBody, orderBody}, http.StatusOK},
+		{"different bodies", [2]string{orderBody, other}, http.StatusConflict},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				router, outbox := testRouter(t)
+				var responses [2]*httptest.ResponseRecorder
+				var wg sync.WaitGroup
+				for j := range responses {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						responses[j] = post(router, "KEY-1", test.bodies[j])
+					}()
+				}
+				wg.Wait()
+
+				// Exactly one order is placed, whichever request gets there first
+				if count := pending(t, outbox); count != 1 {
+					t.Fatalf("%d events in the outbox, want 1", count)
+				}
+				winner, loser := responses[0], responses[1]
+				if winner.Header().Get("Idempotent-Replayed") != "" || winner.Code != http.StatusOK {
+					winner, loser = loser, winner
+				}
+				if winner.Code != http.StatusOK || winner.Header().Get("Idempotent-Replayed") != "" {
+					t.Fatalf("no request placed the order: %d %s, %d %s",
+						responses[0].Code, responses[0].Body, responses[1].Code, responses[1].Body)
+				}
+				if loser.Code != test.loser {
+					t.Fatalf("losing request got %d %s, want %d", loser.Code, loser.Body, test.loser)
+				}
+				if loser.Code == http.StatusOK &&
+					(loser.Header().Get("Idempotent-Replayed") != "true" || loser.Body.String() != winner.Body.String()) {
+					t.Fatalf("losing request got %s, want the replayed %s", loser.Body, winner.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	_ "modernc.org/sqlite"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+var (
+	// ErrDuplicateOrder is returned by Outbox.Accept for an order ID that has
+	// already been accepted.
+	ErrDuplicateOrder = errors.New("order already exists")
+	// ErrOrderNotFound is returned by Outbox.Cancel for an order that was
+	// never accepted.
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrAlreadyCancelled is returned by Outbox.Cancel for an order whose
+	// cancellation was already requested.
+	ErrAlreadyCancelled = errors.New("order already cancelled")
+)
+
+const outboxSchema = `
+CREATE TABLE IF NOT EXISTS orders (
+	order_id    TEXT PRIMARY KEY,
+	customer_id TEXT NOT NULL,
+	body        TEXT NOT NULL,
+	accepted_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS cancellations (
+	order_id     TEXT PRIMARY KEY REFERENCES orders (order_id),
+	reason       TEXT NOT NULL DEFAULT '',
+	requested_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS outbox (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id      TEXT NOT NULL UNIQUE,
+	payload       TEXT NOT NULL,
+	trace_context TEXT NOT NULL DEFAULT '{}',
+	created_at    TIMESTAMP NOT NULL,
+	attempts      INTEGER NOT NULL DEFAULT 0,
+	last_error    TEXT,
+	sent_at       TIMESTAMP,
+	dead_at       TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (id) WHERE sent_at IS NULL;
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key          TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	status       INTEGER NOT NULL,
+	body         TEXT NOT NULL,
+	expires_at   TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry ON idempotency_keys (expires_at);
+`
+
+// outboxMigrations bring databases created by older versions up to
+// outboxSchema; a column that is already there makes them fail harmlessly.
+var outboxMigrations = []string{
+	`ALTER TABLE outbox ADD COLUMN dead_at TIMESTAMP`,
+}
+
+// Outbox is a transactional outbox kept in SQLite. An accepted order and the
+// OrderReceived event announcing it are written in one transaction, and the
+// relay publishes the event to Kafka afterwards, retrying until the broker
+// takes it. Orders are therefore never lost when Kafka is down, and are
+// published at least once, in the order they were accepted. Cancellations go
+// through the outbox the same way. A row that can never be published, because
+// it can't be decoded, has no topic or fails its schema, is marked dead and
+// skipped so it can't hold up the rows behind it; setting its dead_at back to
+// NULL makes the relay try it again.
+type Outbox struct {
+	db     *sql.DB
+	notify chan struct{}
+}
+
+// OutboxRelayConfig controls how the relay publishes outbox rows.
+type OutboxRelayConfig struct {
+	PollInterval   time.Duration // how often to look for rows when not notified
+	BatchSize      int
+	InitialBackoff time.Duration // wait after the first failed publish, doubled on every failure
+	MaxBackoff     time.Duration
+	Retention      time.Duration // how long sent rows are kept
+}
+
+type outboxRow struct {
+	id           int64
+	payload      string
+	traceContext string
+	attempts     int
+}
+
+// OpenOutbox opens (creating if needed) the outbox database at path.
+func OpenOutbox(path string) (*Outbox, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection serialises writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(outboxSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating outbox tables: %w", err)
+	}
+	for _, migration := range outboxMigrations {
+		if _, err := db.Exec(migration); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, fmt.Errorf("migrating outbox tables: %w", err)
+		}
+	}
+	return &Outbox{db: db, notify: make(chan struct{}, 1)}, nil
+}
+
+// Accept stores order and its event atomically. The trace context of ctx is
+// kept with the event so publishing it continues the request's trace. If
+// response isn't nil, it is stored in the same transaction, so an order is
+// accepted if and only if its response can be replayed.
+func (o *Outbox) Accept(ctx context.Context, order *events.Order, event *events.Event, response *IdempotentResponse) error {
+	body, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO orders (order_id, customer_id, body, accepted_at) VALUES (?, ?, ?, ?)`,
+		order.OrderID, order.CustomerID, string(body), now); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrDuplicateOrder
+		}
+		return err
+	}
+	if err := o.enqueue(ctx, tx, event, now); err != nil {
+		return err
+	}
+	if response != nil {
+		if err := o.remember(ctx, tx, response, now); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	o.wake()
+	return nil
+}
+
+// Cancel records the cancellation of an accepted order and stores the
+// OrderCancelled event announcing it, atomically, and returns the event.
+// Whether the order can still be stopped is decided downstream.
+func (o *Outbox) Cancel(ctx context.Context, orderID, reason string) (*events.Event, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var body string
+	err = tx.QueryRowContext(ctx, `SELECT body FROM orders WHERE order_id = ?`, orderID).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var order events.Order
+	if err := json.Unmarshal([]byte(body), &order); err != nil {
+		return nil, fmt.Errorf("decoding order %s: %w", orderID, err)
+	}
+	event, err := events.NewCancellationEvent(&order, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO cancellations (order_id, reason, requested_at) VALUES (?, ?, ?)`,
+		orderID, reason, now); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, ErrAlreadyCancelled
+		}
+		return nil, err
+	}
+	if err := o.enqueue(ctx, tx, event, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	o.wake()
+	return event, nil
+}
+
+// enqueue adds event to the outbox within tx, with the trace context of ctx.
+func (o *Outbox) enqueue(ctx context.Context, tx *sql.Tx, event *events.Event, now time.Time) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	traceContext, err := json.Marshal(carrier)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbox (event_id, payload, trace_context, created_at) VALUES (?, ?, ?, ?)`,
+		event.EventId, string(payload), string(traceContext), now)
+	return err
+}
+
+// wake wakes the relay up rather than leaving it to its next poll.
+func (o *Outbox) wake() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Pending returns the number of events still to be published, leaving out
+// dead ones.
+func (o *Outbox) Pending(ctx context.Context) (int, error) {
+	var count int
+	err := o.db.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM outbox WHERE sent_at IS NULL AND dead_at IS NULL`).Scan(&count)
+	return count, err
+}
+
+// Dead returns the number of events the relay gave up on.
+func (o *Outbox) Dead(ctx context.Context) (int, error) {
+	var count int
+	err := o.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM outbox WHERE dead_at IS NOT NULL`).Scan(&count)
+	return count, err
+}
+
+// Publisher publishes events to a topic, like *kafka.KafkaProducer.
+type Publisher interface {
+	Publish(ctx context.Context, event *events.Event, opts ...kafka.PublishOption) error
+}
+
+// Producers maps event names to the producer of their topic.
+type Producers map[string]Publisher
+
+// Relay publishes pending events with producers until ctx is cancelled.
+// Events are published one at a time in the order they were stored; when one
+// fails the relay backs off and starts again from it.
+func (o *Outbox) Relay(ctx context.Context, producers Producers, cfg OutboxRelayConfig) {
+	failures := 0
+	for {
+		wait := cfg.PollInterval
+		if err := o.relayBatch(ctx, producers, cfg.BatchSize); err != nil {
+			failures++
+			wait = relayBackoff(cfg, failures)
+			log.Printf("Outbox relay failed, retrying in %v: %v\n", wait, err)
+		} else {
+			failures = 0
+		}
+
+		if cfg.Retention > 0 {
+			if err := o.purge(ctx, time.Now().UTC().Add(-cfg.Retention)); err != nil {
+				log.Printf("Failed to purge sent outbox rows: %v\n", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.notify:
+			// A new event was stored; still respect the backoff after a failure
+			if failures > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		case <-time.After(wait):
+		}
+	}
+}
+
+// relayBatch publishes up to limit pending events, stopping at the first one
+// that fails. A row failing for good, see permanent, is marked dead instead and
+// the batch goes on; any other failure, such as the broker being down, is
+// retried however long it lasts.
+func (o *Outbox) relayBatch(ctx context.Context, producers Producers, limit int) error {
+	rows, err := o.pending(ctx, limit)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		var event events.Event
+		if err := json.Unmarshal([]byte(row.payload), &event); err != nil {
+			// Retrying won't make it decodable
+			if err := o.markDead(ctx, row.id, fmt.Errorf("decoding payload: %w", err)); err != nil {
+				return fmt.Errorf("marking outbox row %d dead: %w", row.id, err)
+			}
+			log.Printf("Outbox row %d can't be decoded, marked dead: %v\n", row.id, err)
+			continue
+		}
+
+		carrier := propagation.MapCarrier{}
+		if err := json.Unmarshal([]byte(row.traceContext), &carrier); err != nil {
+			log.Printf("Ignoring trace context of outbox row %d: %v\n", row.id, err)
+		}
+		publishCtx := otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+		err := fmt.Errorf("%w for %s events", errNoTopic, event.EventName)
+		if producer, ok := producers[event.EventName]; ok {
+			err = producer.Publish(publishCtx, &event)
+		}
+		if err != nil {
+			if permanent(err) {
+				if markErr := o.markDead(ctx, row.id, err); markErr != nil {
+					return fmt.Errorf("marking event %s dead: %w", event.EventId, markErr)
+				}
+				log.Printf("Outbox event %s (%s, correlation ID %s) can't be published, marked dead: %v\n",
+					event.EventId, event.EventName, event.CorrelationId, err)
+				continue
+			}
+			if markErr := o.markFailed(ctx, row.id, err); markErr != nil {
+				log.Printf("Failed to record outbox failure for row %d: %v\n", row.id, markErr)
+			}
+			return fmt.Errorf("publishing event %s (attempt %d): %w", event.EventId, row.attempts+1, err)
+		}
+		if err := o.markSent(ctx, row.id); err != nil {
+			// The event will be published again; consumers deduplicate by order ID
+			return fmt.Errorf("marking event %s sent: %w", event.EventId, err)
+		}
+		log.Printf("Relayed outbox event %s\n", event.EventId)
+	}
+	return nil
+}
+
+// errNoTopic is the failure of an event no producer publishes.
+var errNoTopic = errors.New("no topic")
+
+// permanent reports whether publishing failed in a way that retrying can't
+// fix: the event has no topic or doesn't match its schema.
+func permanent(err error) bool {
+	var validationErr *schemas.ValidationError
+	return errors.Is(err, errNoTopic) || errors.As(err, &validationErr)
+}
+
+func (o *Outbox) pending(ctx context.Context, limit int) ([]outboxRow, error) {
+	rows, err := o.db.QueryContext(ctx,
+		`SELECT id, payload, trace_context, attempts FROM outbox
+		 WHERE sent_at IS NULL AND dead_at IS NULL ORDER BY id LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.id, &row.payload, &row.traceContext, &row.attempts); err != nil {
+			return nil, err
+		}
+		pending = append(pending, row)
+	}
+	return pending, rows.Err()
+}
+
+func (o *Outbox) markSent(ctx context.Context, id int64) error {
+	_, err := o.db.ExecContext(context.WithoutCancel(ctx),
+		`UPDATE outbox SET sent_at = ?, attempts = attempts + 1, last_error = NULL WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+func (o *Outbox) markFailed(ctx context.Context, id int64, cause error) error {
+	_, err := o.db.ExecContext(context.WithoutCancel(ctx),
+		`UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`, cause.Error(), id)
+	return err
+}
+
+func (o *Outbox) markDead(ctx context.Context, id int64, cause error) error {
+	_, err := o.db.ExecContext(context.WithoutCancel(ctx),
+		`UPDATE outbox SET dead_at = ?, attempts = attempts + 1, last_error = ? WHERE id = ?`,
+		time.Now().UTC(), cause.Error(), id)
+	return err
+}
+
+func (o *Outbox) purge(ctx context.Context, before time.Time) error {
+	_, err := o.db.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ?`, before)
+	return err
+}
+
+// Close closes the outbox database.
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// relayBackoff returns how long to wait after the given number of consecutive
+// failures.
+func relayBackoff(cfg OutboxRelayConfig, failures int) time.Duration {
+	wait := cfg.InitialBackoff
+	for i := 1; i < failures && wait < cfg.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, cfg.MaxBackoff)
+}
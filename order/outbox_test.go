@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+// acceptOrders stores an OrderReceived event for each order ID.
+func acceptOrders(t *testing.T, outbox *Outbox, orderIDs ...string) {
+	t.Helper()
+	for _, orderID := range orderIDs {
+		order := events.Order{OrderID: orderID, CustomerID: "CUST-1", TotalAmount: 1, Currency: "USD",
+			Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}}
+		event, err := order.ToEvent(events.OrderReceived)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := outbox.Accept(context.Background(), &order, event, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func attempts(t *testing.T, outbox *Outbox) []int {
+	t.Helper()
+	rows, err := outbox.db.Query(`SELECT attempts FROM outbox ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var counts []int
+	for rows.Next() {
+		var count int
+		if err := rows.Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		counts = append(counts, count)
+	}
+	return counts
+}
+
+// fakePublisher fails with err, if set, and records what it published.
+type fakePublisher struct {
+	err       error
+	published []string // event IDs
+}
+
+func (p *fakePublisher) Publish(_ context.Context, event *events.Event, _ ...kafka.PublishOption) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, event.EventId)
+	return nil
+}
+
+func openTestOutbox(t *testing.T) *Outbox {
+	t.Helper()
+	outbox, err := OpenOutbox(filepath.Join(t.TempDir(), "outbox.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	return outbox
+}
+
+func TestRelayRetriesBrokerErrorsForever(t *testing.T) {
+	ctx := context.Background()
+	outbox := openTestOutbox(t)
+	acceptOrders(t, outbox, "ORD-1", "ORD-2")
+
+	// However long the broker is down, ORD-1 stays at the head of the queue
+	publisher := &fakePublisher{err: errors.New("dial tcp: connection refused")}
+	producers := Producers{events.OrderStatus[events.OrderReceived]: publisher}
+	for attempt := 1; attempt <= 100; attempt++ {
+		if err := outbox.relayBatch(ctx, producers, 10); err == nil {
+			t.Fatalf("attempt %d succeeded", attempt)
+		}
+	}
+	if got := attempts(t, outbox); got[0] != 100 || got[1] != 0 {
+		t.Fatalf("attempts %v, want [100 0]", got)
+	}
+	if dead, err := outbox.Dead(ctx); err != nil || dead != 0 {
+		t.Fatalf("Dead() = %d, %v; want 0", dead, err)
+	}
+
+	// Once it's back, both are published in order
+	publisher.err = nil
+	if err := outbox.relayBatch(ctx, producers, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 2 {
+		t.Fatalf("published %v, want both events", publisher.published)
+	}
+	if pending, err := outbox.Pending(ctx); err != nil || pending != 0 {
+		t.Fatalf("Pending() = %d, %v; want 0", pending, err)
+	}
+}
+
+func TestRelayMarksPermanentFailuresDead(t *testing.T) {
+	ctx := context.Background()
+	validator, err := schemas.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is written to the broker: the event fails its schema first
+	producer := kafka.NewProducer(kafka.KafkaConfig{Brokers: []string{"localhost:1"}, Topic: "order-received", Validator: validator})
+	defer producer.Close()
+
+	for name, producers := range map[string]Producers{
+		"no topic":      {},
+		"schema failed": {events.OrderStatus[events.OrderReceived]: producer},
+	} {
+		t.Run(name, func(t *testing.T) {
+			outbox := openTestOutbox(t)
+			order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", TotalAmount: 1, Currency: "USD",
+				Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 0, Price: 1}}}
+			event, err := order.ToEvent(events.OrderReceived)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := outbox.Accept(ctx, &order, event, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := outbox.relayBatch(ctx, producers, 10); err != nil {
+				t.Fatal(err)
+			}
+			if dead, err := outbox.Dead(ctx); err != nil || dead != 1 {
+				t.Fatalf("Dead() = %d, %v; want 1", dead, err)
+			}
+			if got := attempts(t, outbox); got[0] != 1 {
+				t.Fatalf("attempts %v, want [1]", got)
+			}
+		})
+	}
+}
+
+func TestRelayMarksUndecodableRowDead(t *testing.T) {
+	ctx := context.Background()
+	outbox := openTestOutbox(t)
+	if _, err := outbox.db.Exec(`INSERT INTO outbox (event_id, payload, created_at) VALUES ('bad', 'not json', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := outbox.relayBatch(ctx, Producers{}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if dead, err := outbox.Dead(ctx); err != nil || dead != 1 {
+		t.Fatalf("Dead() = %d, %v; want 1", dead, err)
+	}
+}
+
+func TestOpenOutboxMigratesOldDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	old, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(`CREATE TABLE outbox (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id      TEXT NOT NULL UNIQUE,
+		payload       TEXT NOT NULL,
+		trace_context TEXT NOT NULL DEFAULT '{}',
+		created_at    TIMESTAMP NOT NULL,
+		attempts      INTEGER NOT NULL DEFAULT 0,
+		last_error    TEXT,
+		sent_at       TIMESTAMP
+	)`); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	for range 2 { // and opening it again finds the column there
+		outbox, err := OpenOutbox(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := outbox.Dead(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		outbox.Close()
+	}
+}
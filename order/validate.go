@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+// Violation is a rule broken by a field of an order.
+type Violation struct {
+	Field   string `json:"field"` // e.g. items[1].quantity
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// orderRequest is the body of POST /order. Its binding tags are checked as
+// it is bound; events.Order stays free of them since other services decode it
+// too.
+type orderRequest struct {
+	OrderID     string             `json:"orderId"`
+	CustomerID  string             `json:"customerId" binding:"required"`
+	OrderDate   time.Time          `json:"orderDate" binding:"required"`
+	Items       []orderItemRequest `json:"items" binding:"required,min=1,dive"`
+	TotalAmount float64            `json:"totalAmount" binding:"gt=0"`
+	Currency    string             `json:"currency" binding:"omitempty,iso4217"`
+}
+
+type orderItemRequest struct {
+	ItemID   string  `json:"itemId" binding:"required"`
+	Quantity int     `json:"quantity" binding:"gt=0"`
+	Price    float64 `json:"price" binding:"gt=0"`
+}
+
+// Order returns the order requested, in the default currency if the request
+// has none.
+func (r *orderRequest) Order() events.Order {
+	order := events.Order{
+		OrderID:     r.OrderID,
+		CustomerID:  r.CustomerID,
+		OrderDate:   r.OrderDate,
+		TotalAmount: r.TotalAmount,
+		Currency:    r.Currency,
+	}
+	if order.Currency == "" {
+		order.Currency = events.DefaultCurrency
+	}
+	for _, item := range r.Items {
+		order.Items = append(order.Items, events.OrderItem{ItemID: item.ItemID, Quantity: item.Quantity, Price: item.Price})
+	}
+	return order
+}
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit isn't a
+// hundredth; amounts in any other currency have two decimal places.
+var currencyExponents = map[string]int{
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+}
+
+func init() {
+	// Report fields by their JSON names, as clients send them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// bindingViolations turns the errors of the binding tags into violations; it
+// returns nil for any other error, such as malformed JSON.
+func bindingViolations(err error) []Violation {
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return nil
+	}
+
+	violations := make([]Violation, 0, len(fieldErrs))
+	for _, fe := range fieldErrs {
+		// The namespace starts with the struct name: orderRequest.items[0].price
+		_, field, _ := strings.Cut(fe.Namespace(), ".")
+		violations = append(violations, Violation{Field: field, Rule: fe.Tag(), Message: bindingMessage(fe)})
+	}
+	return violations
+}
+
+// schemaViolations turns the violations of the OrderReceived schema into
+// violations of the order, naming the fields of the event body as the
+// binding tags do; anything outside the body keeps its JSON pointer.
+func schemaViolations(err *schemas.ValidationError) []Violation {
+	violations := make([]Violation, 0, len(err.Violations))
+	for _, v := range err.Violations {
+		field := v.Path
+		if rest, ok := strings.CutPrefix(v.Path, "/eventBody"); ok {
+			field = fieldName(rest)
+		}
+		violations = append(violations, Violation{Field: field, Rule: "schema", Message: v.Message})
+	}
+	return violations
+}
+
+// fieldName turns a JSON pointer into the order, e.g. /items/1/quantity, into
+// a field name like items[1].quantity.
+func fieldName(pointer string) string {
+	var field strings.Builder
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		switch {
+		case token == "":
+		case strings.Trim(token, "0123456789") == "":
+			field.WriteString("[" + token + "]")
+		default:
+			if field.Len() > 0 {
+				field.WriteString(".")
+			}
+			// Unescape as RFC 6901 says
+			field.WriteString(strings.NewReplacer("~1", "/", "~0", "~").Replace(token))
+		}
+	}
+	return field.String()
+}
+
+// bindingMessage describes the binding tag a field fails.
+func bindingMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "gt":
+		return fmt.Sprintf("must be greater than %s", fe.Param())
+	case "min":
+		return fmt.Sprintf("must have at least %s item(s)", fe.Param())
+	case "iso4217":
+		return "must be an ISO 4217 currency code"
+	default:
+		return fmt.Sprintf("fails the %s rule", fe.Tag())
+	}
+}
+
+// businessViolations checks the rules of an order that the binding tags of
+// orderRequest can't express: at most maxItems lines, each item on one line only, prices
+// in whole minor units of the currency, and a total equal to the sum of the
+// lines, rounded to the currency's minor unit.
+func businessViolations(order *events.Order, maxItems int) []Violation {
+	var violations []Violation
+
+	if maxItems > 0 && len(order.Items) > maxItems {
+		violations = append(violations, Violation{
+			Field:   "items",
+			Rule:    "max_items",
+			Message: fmt.Sprintf("must have at most %d items, has %d", maxItems, len(order.Items)),
+		})
+	}
+
+	exponent, ok := currencyExponents[order.Currency]
+	if !ok {
+		exponent = 2
+	}
+	scale := math.Pow10(exponent)
+
+	firstLine := map[string]int{}
+	var total int64 // in minor units
+	for i, item := range order.Items {
+		if first, seen := firstLine[item.ItemID]; seen && item.ItemID != "" {
+			violations = append(violations, Violation{
+				Field:   fmt.Sprintf("items[%d].itemId", i),
+				Rule:    "unique",
+				Message: fmt.Sprintf("duplicates items[%d]; order the item on a single line", first),
+			})
+		} else {
+			firstLine[item.ItemID] = i
+		}
+
+		price := minorUnits(item.Price, scale)
+		if !sameAmount(float64(price), item.Price*scale) {
+			violations = append(violations, Violation{
+				Field:   fmt.Sprintf("items[%d].price", i),
+				Rule:    "currency_precision",
+				Message: fmt.Sprintf("must have at most %d decimal places in %s", exponent, order.Currency),
+			})
+		}
+		total += int64(item.Quantity) * price
+	}
+
+	if !sameAmount(float64(minorUnits(order.TotalAmount, scale)), order.TotalAmount*scale) {
+		violations = append(violations, Violation{
+			Field:   "totalAmount",
+			Rule:    "currency_precision",
+			Message: fmt.Sprintf("must have at most %d decimal places in %s", exponent, order.Currency),
+		})
+	}
+	if minorUnits(order.TotalAmount, scale) != total {
+		violations = append(violations, Violation{
+			Field:   "totalAmount",
+			Rule:    "line_total",
+			Message: fmt.Sprintf("must equal the sum of the item lines (quantity times price), %.*f", exponent, float64(total)/scale),
+		})
+	}
+	return violations
+}
+
+// minorUnits rounds amount to the nearest minor unit of a currency with
+// scale minor units to the major one.
+func minorUnits(amount, scale float64) int64 {
+	return int64(math.Round(amount * scale))
+}
+
+// sameAmount reports whether a and b differ only by floating-point error.
+func sameAmount(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
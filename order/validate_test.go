@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+func TestSchemaViolations(t *testing.T) {
+	validator, err := schemas.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The binding tags would have caught this, the schema does too
+	order := events.Order{
+		OrderID:     "ORD-1",
+		CustomerID:  "CUST-1",
+		OrderDate:   time.Now(),
+		Items:       []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 2}, {ItemID: "ITEM-2", Quantity: 0, Price: 2}},
+		TotalAmount: 2,
+		Currency:    events.DefaultCurrency,
+	}
+	event, err := order.ToEvent(events.OrderReceived)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var validationErr *schemas.ValidationError
+	if err := validator.ValidateEvent(event); !errors.As(err, &validationErr) {
+		t.Fatalf("ValidateEvent = %v, want a *schemas.ValidationError", err)
+	}
+	violations := schemaViolations(validationErr)
+	if !slices.ContainsFunc(violations, func(v Violation) bool {
+		return v.Field == "items[1].quantity" && v.Rule == "schema" && v.Message != ""
+	}) {
+		t.Fatalf("violations %+v, want one for items[1].quantity", violations)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	for pointer, want := range map[string]string{
+		"":                "",
+		"/":               "",
+		"/totalAmount":    "totalAmount",
+		"/items/0":        "items[0]",
+		"/items/12/price": "items[12].price",
+		"/a~1b/c~0d":      "a/b.c~d",
+	} {
+		if got := fieldName(pointer); got != want {
+			t.Errorf("fieldName(%q) = %q, want %q", pointer, got, want)
+		}
+	}
+}
+
+func TestBusinessViolations(t *testing.T) {
+	item := func(id string, quantity int, price float64) events.OrderItem {
+		return events.OrderItem{ItemID: id, Quantity: quantity, Price: price}
+	}
+	for _, test := range []struct {
+		name     string
+		currency string
+		items    []events.OrderItem
+		total    float64
+		want     []string // field:rule of each violation
+	}{
+		{"valid USD", "USD", []events.OrderItem{item("A", 3, 0.1), item("B", 1, 19.99)}, 20.29, nil},
+		{"valid JPY", "JPY", []events.OrderItem{item("A", 3, 1500)}, 4500, nil},
+		{"valid KWD", "KWD", []events.OrderItem{item("A", 2, 1.125)}, 2.25, nil},
+		{"total off by a cent", "USD", []events.OrderItem{item("A", 3, 0.1)}, 0.31, []string{"totalAmount:line_total"}},
+		// 0.1 * 3 isn't 0.3 in floating point, the sum is in minor units
+		{"float sum", "USD", []events.OrderItem{item("A", 1, 0.1), item("B", 1, 0.2)}, 0.3, nil},
+		{"cents in JPY", "JPY", []events.OrderItem{item("A", 1, 10.5)}, 10.5,
+			[]string{"items[0].price:currency_precision", "totalAmount:currency_precision"}},
+		{"JPY total rounded like USD", "JPY", []events.OrderItem{item("A", 1, 100)}, 100.4,
+			[]string{"totalAmount:currency_precision"}},
+		{"tenths of a cent in USD", "USD", []events.OrderItem{item("A", 2, 1.005)}, 2,
+			[]string{"items[0].price:currency_precision"}},
+		{"too many items", "USD", []events.OrderItem{item("A", 1, 1), item("B", 1, 1), item("C", 1, 1), item("D", 1, 1)}, 4,
+			[]string{"items:max_items"}},
+		{"duplicate items", "USD", []events.OrderItem{item("A", 1, 1), item("B", 1, 1), item("A", 2, 1)}, 4,
+			[]string{"items[2].itemId:unique"}},
+		{"everything wrong", "JPY", []events.OrderItem{item("A", 1, 1.5), item("A", 1, 1), item("B", 1, 1), item("C", 1, 1)}, 3,
+			[]string{"items:max_items", "items[0].price:currency_precision", "items[1].itemId:unique", "totalAmount:line_total"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			order := events.Order{OrderID: "ORD-1", CustomerID: "CUST-1", Currency: test.currency, Items: test.items, TotalAmount: test.total}
+			var got []string
+			for _, v := range businessViolations(&order, 3) {
+				if v.Message == "" {
+					t.Errorf("violation %+v has no message", v)
+				}
+				got = append(got, v.Field+":"+v.Rule)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("violations %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPostOrderListsEveryViolation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	validator, err := schemas.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Invalid orders are answered before the outbox is used
+	router := setupRouter(&AppDependencies{Validator: validator, Config: Config{MaxOrderItems: 2}})
+
+	body := `{"orderDate":"2024-01-02T03:04:05Z","currency":"JPY","totalAmount":10,"items":[
+		{"itemId":"A","quantity":1,"price":1.5},{"itemId":"A","quantity":0,"price":1},{"itemId":"B","quantity":1,"price":1}]}`
+	req := httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422: %s", w.Code, w.Body)
+	}
+	var response struct {
+		Error      string      `json:"error"`
+		Violations []Violation `json:"violations"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, v := range response.Violations {
+		got = append(got, v.Field+":"+v.Rule)
+	}
+	// The binding tags and the business rules are reported together
+	want := []string{
+		"customerId:required",
+		"items[1].quantity:gt",
+		"items:max_items",
+		"items[0].price:currency_precision",
+		"items[1].itemId:unique",
+		"totalAmount:line_total",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("violations %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,12 @@
+module github.com/tankcdr/ppe-kafka-go/schemas
+
+go 1.23
+
+require (
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/tankcdr/ppe-kafka-go/events v0.0.0
+)
+
+require github.com/gofrs/uuid v4.4.0+incompatible // indirect
+
+replace github.com/tankcdr/ppe-kafka-go/events => ../events
@@ -0,0 +1,179 @@
+package schemas
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// files holds the draft-07 event schemas in this directory. The *_example.json
+// files are embedded too but are not compiled.
+//
+//go:embed *.json
+var files embed.FS
+
+// Validator checks events against the schema for their eventName.
+type Validator struct {
+	schemas map[string]*jsonschema.Schema // keyed by eventName
+}
+
+var (
+	defaultValidator *Validator
+	defaultErr       error
+	defaultOnce      sync.Once
+)
+
+// Default returns a Validator for the embedded schemas, compiled on first use.
+func Default() (*Validator, error) {
+	defaultOnce.Do(func() {
+		defaultValidator, defaultErr = New()
+	})
+	return defaultValidator, defaultErr
+}
+
+// New compiles the embedded schemas. Each schema is registered under the
+// event name listed in its eventName enum.
+func New() (*Validator, error) {
+	names, err := fs.Glob(files, "*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft7
+	compiler.AssertFormat = true
+
+	v := &Validator{schemas: map[string]*jsonschema.Schema{}}
+	for _, name := range names {
+		if strings.HasSuffix(name, "_example.json") {
+			continue
+		}
+
+		data, err := files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		eventName, err := schemaEventName(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if err := compiler.AddResource(name, bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		schema, err := compiler.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		v.schemas[eventName] = schema
+	}
+
+	return v, nil
+}
+
+// schemaEventName returns the event name a schema applies to.
+func schemaEventName(schema []byte) (string, error) {
+	var doc struct {
+		Properties struct {
+			EventName struct {
+				Enum []string `json:"enum"`
+			} `json:"eventName"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return "", err
+	}
+	if len(doc.Properties.EventName.Enum) != 1 {
+		return "", fmt.Errorf("schema must list exactly one eventName, found %d", len(doc.Properties.EventName.Enum))
+	}
+	return doc.Properties.EventName.Enum[0], nil
+}
+
+// Validate checks a serialized event against the schema for its eventName. It
+// returns a *ValidationError if the event doesn't conform and an error for
+// events that aren't JSON or have no schema.
+func (v *Validator) Validate(event []byte) error {
+	var envelope struct {
+		EventName string `json:"eventName"`
+	}
+	if err := json.Unmarshal(event, &envelope); err != nil {
+		return fmt.Errorf("event is not valid JSON: %w", err)
+	}
+
+	schema, ok := v.schemas[envelope.EventName]
+	if !ok {
+		return fmt.Errorf("no schema for event %q", envelope.EventName)
+	}
+
+	var doc any
+	if err := json.Unmarshal(event, &doc); err != nil {
+		return fmt.Errorf("event is not valid JSON: %w", err)
+	}
+	if err := schema.Validate(doc); err != nil {
+		var schemaErr *jsonschema.ValidationError
+		if errors.As(err, &schemaErr) {
+			return newValidationError(envelope.EventName, schemaErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// ValidateEvent checks event against its schema. The event is validated as it
+// would be published now, so envelopes decoded from an older version are
+// judged by the current layout.
+func (v *Validator) ValidateEvent(event *events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return v.Validate(data)
+}
+
+// Violation is a single way in which an event breaks its schema.
+type Violation struct {
+	Path    string `json:"path"` // JSON pointer into the event, e.g. /eventBody/items/0/quantity
+	Message string `json:"message"`
+}
+
+// ValidationError reports every schema violation found in an event.
+type ValidationError struct {
+	EventName  string
+	Violations []Violation
+}
+
+func newValidationError(eventName string, err *jsonschema.ValidationError) *ValidationError {
+	validationErr := &ValidationError{EventName: eventName}
+	for _, e := range err.BasicOutput().Errors {
+		// The output also lists the failed parent keywords; only the leaves
+		// carry a useful message
+		if e.Error == "" || strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+		path := e.InstanceLocation
+		if path == "" {
+			path = "/"
+		}
+		validationErr.Violations = append(validationErr.Violations, Violation{Path: path, Message: e.Error})
+	}
+	if len(validationErr.Violations) == 0 {
+		validationErr.Violations = append(validationErr.Violations, Violation{Path: "/", Message: err.Message})
+	}
+	return validationErr
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.Path + ": " + v.Message
+	}
+	return fmt.Sprintf("%s event failed schema validation: %s", e.EventName, strings.Join(parts, "; "))
+}
@@ -0,0 +1,121 @@
+package schemas
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	events "github.com/tankcdr/ppe-kafka-go/events"
+)
+
+// examples returns the example payloads, by file name.
+func examples(t *testing.T) map[string][]byte {
+	t.Helper()
+	paths, err := filepath.Glob("*_example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := map[string][]byte{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads[path] = data
+	}
+	return payloads
+}
+
+func TestEverySchemaHasAnExample(t *testing.T) {
+	schemas, err := filepath.Glob("*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := examples(t)
+	for _, schema := range schemas {
+		if strings.HasSuffix(schema, "_example.json") {
+			continue
+		}
+		example := strings.TrimSuffix(schema, ".json") + "_example.json"
+		if _, ok := payloads[example]; !ok {
+			t.Errorf("%s has no example (%s)", schema, example)
+		}
+	}
+}
+
+func TestExamplesAreValid(t *testing.T) {
+	validator, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, payload := range examples(t) {
+		t.Run(path, func(t *testing.T) {
+			if err := validator.Validate(payload); err != nil {
+				t.Fatalf("example fails its schema: %v", err)
+			}
+
+			// Decoding and publishing the example again must keep it valid
+			event, err := events.NewEventFromBytes(payload)
+			if err != nil {
+				t.Fatalf("decoding example: %v", err)
+			}
+			if err := validator.ValidateEvent(event); err != nil {
+				t.Fatalf("decoded example fails its schema: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidationErrorLocatesViolations(t *testing.T) {
+	validator, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := os.ReadFile("order_recieved_example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event map[string]any
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	body := event["eventBody"].(map[string]any)
+	delete(body, "customerId")
+	body["items"].([]any)[0].(map[string]any)["quantity"] = 0
+	invalid, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var validationErr *ValidationError
+	if err := validator.Validate(invalid); !errors.As(err, &validationErr) {
+		t.Fatalf("got %v, want a *ValidationError", err)
+	}
+	if validationErr.EventName != "OrderReceived" {
+		t.Errorf("EventName = %q, want OrderReceived", validationErr.EventName)
+	}
+	paths := map[string]bool{}
+	for _, v := range validationErr.Violations {
+		paths[v.Path] = true
+	}
+	for _, want := range []string{"/eventBody", "/eventBody/items/0/quantity"} {
+		if !paths[want] {
+			t.Errorf("no violation at %s in %v", want, validationErr.Violations)
+		}
+	}
+}
+
+func TestUnknownEvent(t *testing.T) {
+	validator, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validator.Validate([]byte(`{"eventName": "OrderTeleported"}`))
+	var validationErr *ValidationError
+	if err == nil || errors.As(err, &validationErr) {
+		t.Fatalf("got %v, want an error for the missing schema", err)
+	}
+}
@@ -6,3 +6,11 @@ $SCRIPT_DIR/create-topic.sh order-confirmed 3
 $SCRIPT_DIR/create-topic.sh order-picked-packed 3
 $SCRIPT_DIR/create-topic.sh order-notification 3
 $SCRIPT_DIR/create-topic.sh order-error 3
+$SCRIPT_DIR/create-topic.sh order-rejected 3
+$SCRIPT_DIR/create-topic.sh order-cancelled 3
+$SCRIPT_DIR/create-topic.sh order-cancellation-reply 3
+$SCRIPT_DIR/create-topic.sh order-compensation 3
+$SCRIPT_DIR/create-topic.sh inventory-dlq 7
+$SCRIPT_DIR/create-topic.sh warehouse-dlq 7
+$SCRIPT_DIR/create-topic.sh shipper-dlq 7
+$SCRIPT_DIR/create-topic.sh notification-dlq 7
@@ -5,9 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/gin-gonic/gin"
@@ -16,6 +14,9 @@ import (
 	errors "github.com/tankcdr/ppe-kafka-go/error"
 	events "github.com/tankcdr/ppe-kafka-go/events"
 	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
 )
 
 // Config holds the environment configuration
@@ -23,10 +24,28 @@ type Config struct {
 	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
 	//consuming from order-confirmed topic
 	OrderPickedPacked string `env:"KAFKA_ORDER_PICKEDPACKED" envDefault:"order-picked-packed"`
+	//orders cancelled here are refused
+	OrderCancelledTopic string `env:"KAFKA_ORDER_CANCELLED" envDefault:"order-cancelled"`
+	//orders the orchestrator compensates with a CancelShipment command are refused too
+	CompensationTopic string `env:"KAFKA_ORDER_COMPENSATION" envDefault:"order-compensation"`
+	//producing the answers to cancellations to order-cancellation-reply topic
+	CancellationReplyTopic string `env:"KAFKA_CANCELLATION_REPLY" envDefault:"order-cancellation-reply"`
 	//producing to order-notification topic
 	OrderNotificationTopic string `env:"KAFKA_ORDER_NOTFIFICATION" envDefault:"order-notification"`
 	//producing to order-error topic on error
 	ErrorTopic string `env:"KAFKA_ERROR" envDefault:"order-error"`
+	//dead-lettering messages that still fail after retries
+	DeadLetterTopic string        `env:"KAFKA_DEAD_LETTER" envDefault:"shipper-dlq"`
+	MaxAttempts     int           `env:"KAFKA_MAX_ATTEMPTS" envDefault:"5"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter  string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//store of processed orders: "memory", "bolt" to keep them across restarts, or
+	//"redis" to share them between replicas (DB_PATH is then the server URL)
+	StoreBackend string        `env:"DB_BACKEND" envDefault:"memory"`
+	StorePath    string        `env:"DB_PATH" envDefault:"shipper.db"`
+	StoreTTL     time.Duration `env:"DB_TTL" envDefault:"0s"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -38,20 +57,25 @@ type AppDependencies struct {
 type KafkaProducers struct {
 	NotificationProducer *kafka.KafkaProducer
 	ErrorProducer        *kafka.KafkaProducer
+	ReplyProducer        *kafka.KafkaProducer
 }
 
+// shipmentCancelled is the value of the store key of an order the shipper has
+// stopped. Shipping claims the same key, so an order is either shipped or
+// cancelled, whichever claims the key first.
+const shipmentCancelled = "cancelled"
+
 // ProcessMessage processes the consumed Kafka message
-func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) func(key, value []byte) error {
-	return func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+func ProcessMessageWrapper(db db.ValueStore, validator *schemas.Validator, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
 
 		var event *events.Event
 		var order *events.Order
 		var err error
-		context := context.Background()
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
@@ -62,8 +86,13 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 			return nil
 		}
 
+		// Validate the event against its schema; invalid events are reported on the error topic
+		if err := validator.ValidateEvent(event); err != nil {
+			return errors.HandleError(ctx, event, producers.ErrorProducer, err.Error())
+		}
+
 		// Unmarshal the Order
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		if order, err = event.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
@@ -71,12 +100,43 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 		// create a unqiue key for the notification using order id and type
 		uniqueKey := order.OrderID
 
+		// Refuse to ship cancelled orders, checking before claiming the order
+		stopped, err := cancelled(db, uniqueKey)
+		if err != nil {
+			log.Printf("Failed to look up cancellation of %s: %v\n", uniqueKey, err)
+			return err
+		}
+		if stopped {
+			log.Printf("Order %s was cancelled, refusing to ship it\n", uniqueKey)
+			return nil
+		}
+
 		// Enforce order idempotence
-		if db.Exists(uniqueKey) {
+		claimed, err := db.AddIfAbsent(uniqueKey)
+		if err != nil {
+			log.Printf("Failed to record %s: %v\n", uniqueKey, err)
+			return err
+		}
+		if !claimed {
+			// The order may have been cancelled since the check
+			if stopped, err = cancelled(db, uniqueKey); err != nil {
+				log.Printf("Failed to look up cancellation of %s: %v\n", uniqueKey, err)
+				return err
+			}
+			if stopped {
+				log.Printf("Order %s was cancelled, refusing to ship it\n", uniqueKey)
+				return nil
+			}
 			logString := fmt.Sprintf("Notification %s is a duplicate", uniqueKey)
-			return errors.HandleError(context, event, producers.ErrorProducer, logString)
+			return errors.HandleDuplicate(ctx, event, producers.ErrorProducer, logString)
 		}
-		db.Add(uniqueKey)
+		// Release the claim if this attempt is retried or its transaction
+		// aborts, so the redelivery isn't mistaken for a duplicate
+		kafka.OnAbort(ctx, func() {
+			if err := db.Delete(uniqueKey); err != nil {
+				log.Printf("Failed to release %s: %v\n", uniqueKey, err)
+			}
+		})
 		log.Printf("Notification %s is unique\n", uniqueKey)
 
 		// Create a Notification event
@@ -84,12 +144,12 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 		notificationEvent, err := notification.ToEvent()
 
 		if err != nil {
-			return errors.HandleError(context, event, producers.ErrorProducer, "Failed to create Notification event")
+			return errors.HandleError(ctx, event, producers.ErrorProducer, "Failed to create Notification event")
 
 		}
 
 		// Publish the Notification event to Kafka
-		if err := producers.NotificationProducer.Publish(context, notificationEvent); err != nil {
+		if err := producers.NotificationProducer.Publish(ctx, notificationEvent); err != nil {
 			log.Printf("Failed to produce Notification event: %v\n", err)
 			return fmt.Errorf("Failed to produce Notification event: %v", err)
 		}
@@ -98,6 +158,125 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 	}
 }
 
+// CancelMessageWrapper stops cancelled orders, which ProcessMessageWrapper
+// then refuses to ship, and answers whether it did; an order already shipped
+// can't be stopped
+func CancelMessageWrapper(db db.ValueStore, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var cancellation *events.Cancellation
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return kafka.Handled(err)
+		}
+		if event.EventName != events.OrderStatus[events.OrderCancelled] {
+			return nil
+		}
+		// Unmarshal the cancellation
+		if cancellation, err = event.Cancellation(); err != nil {
+			log.Printf("Failed to unmarshal cancellation: %v\n", err)
+			return kafka.Handled(err)
+		}
+		orderID := cancellation.OrderID
+
+		reply := &events.CancellationReply{OrderID: orderID, Service: "shipper", Request: event.EventName}
+		if reply.Accepted, err = stopShipment(db, orderID); err != nil {
+			log.Printf("Failed to record cancellation of %s: %v\n", orderID, err)
+			return err
+		}
+		if reply.Accepted {
+			log.Printf("Order %s cancelled\n", orderID)
+		} else {
+			reply.Reason = "the order has already shipped"
+			log.Printf("Order %s has already shipped and can't be cancelled\n", orderID)
+		}
+		return publishReply(ctx, producers.ReplyProducer, reply)
+	}
+}
+
+// CompensationMessageWrapper stops the orders the orchestrator compensates
+// with a CancelShipment command, which ProcessMessageWrapper then refuses to
+// ship, and answers whether it did
+func CompensationMessageWrapper(db db.ValueStore, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var compensation *events.Compensation
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return kafka.Handled(err)
+		}
+		if event.EventName != events.OrderStatus[events.CancelShipment] {
+			return nil
+		}
+		// Unmarshal the command
+		if compensation, err = event.Compensation(); err != nil {
+			log.Printf("Failed to unmarshal compensation: %v\n", err)
+			return kafka.Handled(err)
+		}
+		orderID := compensation.OrderID
+
+		reply := &events.CancellationReply{OrderID: orderID, Service: "shipper", Request: event.EventName}
+		if reply.Accepted, err = stopShipment(db, orderID); err != nil {
+			log.Printf("Failed to record cancellation of %s: %v\n", orderID, err)
+			return err
+		}
+		if reply.Accepted {
+			log.Printf("Shipment of order %s cancelled: %s\n", orderID, compensation.Reason)
+		} else {
+			reply.Reason = "the order has already shipped"
+			log.Printf("Order %s has already shipped and can't be stopped\n", orderID)
+		}
+		// The orchestrator releases the order's stock only once the shipment
+		// is cancelled
+		return publishReply(ctx, producers.ReplyProducer, reply)
+	}
+}
+
+// cancelled reports whether an order was stopped.
+func cancelled(db db.ValueStore, orderID string) (bool, error) {
+	value, _, err := db.Get(orderID)
+	return value == shipmentCancelled, err
+}
+
+// stopShipment stops an order unless it has already been claimed for
+// shipping, and reports whether the order is stopped.
+func stopShipment(db db.ValueStore, orderID string) (bool, error) {
+	for {
+		swapped, err := db.CompareAndSwap(orderID, "", shipmentCancelled)
+		if err != nil || swapped {
+			return swapped, err
+		}
+		value, ok, err := db.Get(orderID)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return value == shipmentCancelled, nil
+		}
+		// The shipping claim was released in between; try again
+	}
+}
+
+// publishReply publishes the answer to a cancellation.
+func publishReply(ctx context.Context, producer *kafka.KafkaProducer, reply *events.CancellationReply) error {
+	replyEvent, err := events.NewCancellationReplyEvent(reply)
+	if err != nil {
+		log.Printf("Failed to create CancellationAnswered event: %v\n", err)
+		return err
+	}
+	if err := producer.Publish(ctx, replyEvent); err != nil {
+		log.Printf("Failed to produce CancellationAnswered event: %v\n", err)
+		return fmt.Errorf("Failed to produce CancellationAnswered event: %v", err)
+	}
+	return nil
+}
+
 func main() {
 	// Load configuration
 	var cfg Config
@@ -105,37 +284,109 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create "database" for in-memory idempotence check
-	db := db.NewSimpleDatabase()
+	// Read and write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the event schemas used to validate published and consumed events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Open the store of processed orders used for the idempotence check
+	db, err := db.Open(cfg.StoreBackend, cfg.StorePath, db.WithKeyPrefix("shipper:"), db.WithTTL(cfg.StoreTTL))
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
 
 	// Create Kafka producers
 	producers := KafkaProducers{
 		NotificationProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.OrderNotificationTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderNotificationTopic,
+			Validator:  validator,
+			Source:     "shipper",
 		}),
 		ErrorProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.ErrorTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.ErrorTopic,
+			Validator:  validator,
+			Source:     "shipper",
+		}),
+		ReplyProducer: kafka.NewProducer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.CancellationReplyTopic,
+			Validator:  validator,
+			Source:     "shipper",
 		}),
 	}
-	defer producers.NotificationProducer.Close()
-	defer producers.ErrorProducer.Close()
 
 	// Define Kafka configuration
 	kafkaConfigConsumer := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.OrderPickedPacked,
-		GroupID: "shipper-group",
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderPickedPacked,
+		GroupID:    "shipper-group",
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
 	}
 
 	// Create KafkaConsumer instance
 	consumer := kafka.NewConsumer(kafkaConfigConsumer)
-	defer consumer.Close()
 
-	// Set up a context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Consumers of cancellations and compensations, each in its own group as
+	// they read other topics
+	cancelConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderCancelledTopic,
+		GroupID:    "shipper-cancel-group",
+		// Commit only once the order is stopped and the answer published,
+		// retrying until it is: a lost cancellation would let the order ship
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+	})
+	compensationConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.CompensationTopic,
+		GroupID:    "shipper-compensation-group",
+		// Likewise for the orchestrator's CancelShipment commands
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+	})
+
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each order; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "shipper", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+	coordinator.OnShutdown("Database", func(context.Context) error {
+		return db.Close()
+	})
 
 	// Start REST server in a goroutine
 	router := gin.Default()
@@ -148,33 +399,48 @@ func main() {
 	// /shutdown endpoint
 	router.POST("/shutdown", func(c *gin.Context) {
 		log.Println("Shutdown request received")
-		cancel() // Signal the Kafka consumer to stop
+		coordinator.Cancel() // Signal the Kafka consumer to stop
 		c.String(http.StatusOK, "Shutting down")
 	})
 
-	// Start the REST server
-	go func() {
-		if err := router.Run(":8080"); err != nil {
-			log.Fatalf("Failed to start REST server: %v\n", err)
-		}
-	}()
-
-	// Handle graceful shutdown signals
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Println("Received shutdown signal")
-		cancel()
-	}()
+	// Start the REST server. Shutdown hooks run in reverse order once the
+	// consumer has finished its current message: producers are flushed, the
+	// consumer is closed and the REST server stops last.
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+	coordinator.OnShutdown("Kafka consumer", func(context.Context) error {
+		return consumer.Close()
+	})
+	coordinator.OnShutdown("Cancel consumer", func(context.Context) error {
+		return cancelConsumer.Close()
+	})
+	coordinator.OnShutdown("Compensation consumer", func(context.Context) error {
+		return compensationConsumer.Close()
+	})
+	coordinator.OnShutdown("NotificationProducer", func(context.Context) error {
+		return producers.NotificationProducer.Close()
+	})
+	coordinator.OnShutdown("ErrorProducer", func(context.Context) error {
+		return producers.ErrorProducer.Close()
+	})
+	coordinator.OnShutdown("ReplyProducer", func(context.Context) error {
+		return producers.ReplyProducer.Close()
+	})
 
 	// Start consuming Kafka messages
-	go func() {
+	coordinator.Go("Kafka consumer", func(ctx context.Context) {
 		log.Println("Starting Kafka consumer...")
-		consumer.Consume(ctx, ProcessMessageWrapper(db, &producers))
-	}()
+		consumer.Consume(ctx, ProcessMessageWrapper(db, validator, &producers))
+	})
+	coordinator.Go("Cancel consumer", func(ctx context.Context) {
+		cancelConsumer.Consume(ctx, CancelMessageWrapper(db, &producers))
+	})
+	coordinator.Go("Compensation consumer", func(ctx context.Context) {
+		compensationConsumer.Consume(ctx, CompensationMessageWrapper(db, &producers))
+	})
 
-	// Wait for the context to be canceled (e.g., via /shutdown or signal)
-	<-ctx.Done()
-	log.Println("Service is shutting down...")
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/tankcdr/ppe-kafka-go/db"
+	events "github.com/tankcdr/ppe-kafka-go/events"
+	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+)
+
+// pickedPackedMessage returns a message of the order-picked-packed topic for
+// orderID.
+func pickedPackedMessage(t *testing.T, orderID string) *kafka.Message {
+	t.Helper()
+	order := events.Order{OrderID: orderID, CustomerID: "CUST-1", OrderDate: time.Now().UTC(),
+		Items: []events.OrderItem{{ItemID: "ITEM-1", Quantity: 1, Price: 1}}, TotalAmount: 1, Currency: "USD"}
+	event, err := order.ToEvent(events.OrderPickedPacked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kafka.Message{Topic: "order-picked-packed", Value: value}
+}
+
+func TestProcessChecksCancellationBeforeClaiming(t *testing.T) {
+	validator, err := schemas.Default()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewSimpleDatabase()
+	if stopped, err := stopShipment(store, "ORD-1"); err != nil || !stopped {
+		t.Fatalf("stopShipment = %v, %v; want true", stopped, err)
+	}
+
+	// The cancelled order is refused without being claimed, so it isn't
+	// reported as a duplicate either
+	process := ProcessMessageWrapper(store, validator, &KafkaProducers{})
+	for i := 0; i < 2; i++ {
+		if err := process(context.Background(), pickedPackedMessage(t, "ORD-1")); err != nil {
+			t.Fatalf("delivery %d: %v", i+1, err)
+		}
+	}
+	if stopped, err := cancelled(store, "ORD-1"); err != nil || !stopped {
+		t.Fatalf("cancelled after processing = %v, %v; want true", stopped, err)
+	}
+}
+
+func TestStopShipmentOfShippedOrder(t *testing.T) {
+	store := db.NewSimpleDatabase()
+	if claimed, err := store.AddIfAbsent("ORD-1"); err != nil || !claimed {
+		t.Fatalf("AddIfAbsent = %v, %v", claimed, err)
+	}
+	if stopped, err := stopShipment(store, "ORD-1"); err != nil || stopped {
+		t.Fatalf("stopShipment of a shipped order = %v, %v; want false", stopped, err)
+	}
+
+	// Stopping an order again still reports it stopped
+	for i := 0; i < 2; i++ {
+		if stopped, err := stopShipment(store, "ORD-2"); err != nil || !stopped {
+			t.Fatalf("stopShipment %d = %v, %v; want true", i+1, stopped, err)
+		}
+	}
+}
+
+func TestShipmentOrCancellationWins(t *testing.T) {
+	store := db.NewSimpleDatabase()
+	for i := 0; i < 100; i++ {
+		orderID := fmt.Sprintf("ORD-%d", i)
+		var claimed, stopped bool
+		var claimErr, stopErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			claimed, claimErr = store.AddIfAbsent(orderID)
+		}()
+		go func() {
+			defer wg.Done()
+			stopped, stopErr = stopShipment(store, orderID)
+		}()
+		wg.Wait()
+
+		if claimErr != nil || stopErr != nil {
+			t.Fatal(claimErr, stopErr)
+		}
+		if claimed == stopped {
+			t.Fatalf("%s: claimed for shipping %v, stopped %v; want exactly one", orderID, claimed, stopped)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/tankcdr/ppe-kafka-go/shutdown
+
+go 1.23
@@ -0,0 +1,141 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Coordinator manages the orderly stop of a service. Its context is cancelled
+// on SIGINT/SIGTERM or when Cancel is called; Wait then gives the workers
+// started with Go until the deadline to finish what they are doing (for a
+// Kafka consumer, the message in flight) and runs the registered shutdown
+// hooks in reverse order of registration, like deferred calls.
+type Coordinator struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+	workers sync.WaitGroup
+
+	mu    sync.Mutex
+	hooks []hook
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// New creates a Coordinator that allows timeout for draining workers and
+// running shutdown hooks once shutdown starts.
+func New(timeout time.Duration) *Coordinator {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Coordinator{
+		ctx:     ctx,
+		cancel:  cancel,
+		timeout: timeout,
+	}
+
+	// Handle graceful shutdown signals
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+			log.Println("Received shutdown signal")
+			c.cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+
+	return c
+}
+
+// Context returns the service context, cancelled when shutdown starts.
+func (c *Coordinator) Context() context.Context {
+	return c.ctx
+}
+
+// Cancel starts the shutdown, e.g. from a /shutdown endpoint.
+func (c *Coordinator) Cancel() {
+	c.cancel()
+}
+
+// Go runs fn in a goroutine that Wait drains before running the hooks. fn
+// must return promptly once ctx is cancelled.
+func (c *Coordinator) Go(name string, fn func(ctx context.Context)) {
+	c.workers.Add(1)
+	go func() {
+		defer c.workers.Done()
+		fn(c.ctx)
+		log.Printf("%s stopped\n", name)
+	}()
+}
+
+// OnShutdown registers fn to run during shutdown, after the workers have
+// drained. Hooks run in reverse order of registration.
+func (c *Coordinator) OnShutdown(name string, fn func(ctx context.Context) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, hook{name: name, fn: fn})
+}
+
+// Serve starts srv in the background and registers its graceful shutdown, so
+// in-flight requests are completed before the service exits.
+func (c *Coordinator) Serve(srv *http.Server) {
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start REST server: %v\n", err)
+		}
+	}()
+	c.OnShutdown("REST server", srv.Shutdown)
+}
+
+// Wait blocks until shutdown starts, waits for the workers to finish and runs
+// the shutdown hooks, all within the Coordinator's timeout. Hooks run even if
+// the workers miss the deadline. The returned error reports a missed deadline
+// and any failed hooks.
+func (c *Coordinator) Wait() error {
+	<-c.ctx.Done()
+	log.Println("Service is shutting down...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var errs []error
+
+	drained := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("workers still running after %v", c.timeout))
+	}
+
+	c.mu.Lock()
+	hooks := c.hooks
+	c.mu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		if err := h.fn(ctx); err != nil {
+			log.Printf("Failed to shut down %s: %v\n", h.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+			continue
+		}
+		log.Printf("Shut down %s\n", h.name)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,78 @@
+// Package tracing sets up OpenTelemetry tracing for the services of the order
+// pipeline. Trace context travels between services in Kafka message headers,
+// see the kafka package.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Exporters accepted by Init.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Init installs a global tracer provider for service that sends spans to the
+// named exporter:
+//   - "otlp" sends them over OTLP/HTTP, configured with the standard
+//     OTEL_EXPORTER_OTLP_* variables (by default to localhost:4318)
+//   - "stdout" (or "console") prints them as JSON, for local work
+//   - "none" records nothing, but trace context is still propagated so the
+//     services downstream see a single trace
+//
+// The returned function flushes and stops the provider; call it on shutdown.
+func Init(ctx context.Context, service, exporter string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+
+	switch strings.ToLower(exporter) {
+	case "", ExporterNone:
+	case ExporterStdout, "console":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %w", exporter, err)
+	}
+
+	provider := NewProvider(service, spanExporter)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider.Shutdown, nil
+}
+
+// NewProvider creates a tracer provider for service that batches spans to
+// exporter. A nil exporter creates spans without exporting them. Tests can
+// pass an in-memory exporter (tracetest.NewInMemoryExporter) to inspect the
+// spans.
+func NewProvider(service string, exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(service),
+		)),
+	}
+	if exporter != nil {
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	return sdktrace.NewTracerProvider(options...)
+}
@@ -5,9 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"github.com/caarlos0/env/v6"
@@ -17,6 +14,9 @@ import (
 	errors "github.com/tankcdr/ppe-kafka-go/error"
 	events "github.com/tankcdr/ppe-kafka-go/events"
 	kafka "github.com/tankcdr/ppe-kafka-go/kafka"
+	schemas "github.com/tankcdr/ppe-kafka-go/schemas"
+	shutdown "github.com/tankcdr/ppe-kafka-go/shutdown"
+	tracing "github.com/tankcdr/ppe-kafka-go/tracing"
 )
 
 // Config holds the environment configuration
@@ -24,12 +24,32 @@ type Config struct {
 	Broker string `env:"KAFKA_BROKER" envDefault:"localhost:29092"`
 	//consuming from order-confirmed topic
 	OrderConfirmedTopic string `env:"KAFKA_ORDER_CONFIRMED" envDefault:"order-confirmed"`
+	//orders cancelled here are not picked & packed, or not handed to the shipper
+	OrderCancelledTopic string `env:"KAFKA_ORDER_CANCELLED" envDefault:"order-cancelled"`
+	//producing the answers to cancellations to order-cancellation-reply topic
+	CancellationReplyTopic string `env:"KAFKA_CANCELLATION_REPLY" envDefault:"order-cancellation-reply"`
 	//producing to order-notification topic
 	OrderNotificationTopic string `env:"KAFKA_ORDER_NOTFIFICATION" envDefault:"order-notification"`
 	//producing to order-picked-packed topic
 	OrderPickedPackedTopic string `env:"KAFKA_ORDER_PICKED_PACKED" envDefault:"order-picked-packed"`
 	//producing to order-error topic on error
 	ErrorTopic string `env:"KAFKA_ERROR" envDefault:"order-error"`
+	//dead-lettering messages that still fail after retries
+	DeadLetterTopic string `env:"KAFKA_DEAD_LETTER" envDefault:"warehouse-dlq"`
+	MaxAttempts     int    `env:"KAFKA_MAX_ATTEMPTS" envDefault:"5"`
+	//orders picked & packed in parallel; events for one order stay in sequence
+	Workers         int           `env:"KAFKA_WORKERS" envDefault:"4"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	TracesExporter  string        `env:"OTEL_TRACES_EXPORTER" envDefault:"none"`
+	//store of processed orders: "memory", "bolt" to keep them across restarts, or
+	//"redis" to share them between replicas (DB_PATH is then the server URL)
+	StoreBackend string        `env:"DB_BACKEND" envDefault:"memory"`
+	StorePath    string        `env:"DB_PATH" envDefault:"warehouse.db"`
+	StoreTTL     time.Duration `env:"DB_TTL" envDefault:"0s"`
+	//consume and produce in Kafka transactions (exactly-once) when set; unique per instance
+	TransactionalID string `env:"KAFKA_TRANSACTIONAL_ID"`
+	//format of the events on every topic, shared by the whole pipeline
+	kafka.SerializerConfig
 }
 
 // AppDependencies holds shared dependencies like Kafka producers
@@ -42,20 +62,20 @@ type KafkaProducers struct {
 	NotificationProducer *kafka.KafkaProducer
 	OrderPickedPacked    *kafka.KafkaProducer
 	ErrorProducer        *kafka.KafkaProducer
+	ReplyProducer        *kafka.KafkaProducer
 }
 
 // ProcessMessage processes the consumed Kafka message
-func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) func(key, value []byte) error {
-	return func(key, value []byte) error {
-		log.Printf("Consumed message: Key=%s, Value=%s\n", string(key), string(value))
+func ProcessMessageWrapper(db db.Store, validator *schemas.Validator, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		log.Printf("Consumed message: Key=%s, Value=%s\n", string(msg.Key), string(msg.Value))
 
 		var event *events.Event
 		var order *events.Order
 		var err error
-		context := context.Background()
 
 		// Unmarshal the event
-		if event, err = events.NewEventFromBytes(value); err != nil {
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
 			log.Printf("Failed to unmarshal event: %v\n", err)
 			return err
 		}
@@ -66,8 +86,13 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 			return nil
 		}
 
+		// Validate the event against its schema; invalid events are reported on the error topic
+		if err := validator.ValidateEvent(event); err != nil {
+			return errors.HandleError(ctx, event, producers.ErrorProducer, err.Error())
+		}
+
 		// Unmarshal the Notification
-		if order, err = events.NewOrderFromBytes([]byte(event.EventBody)); err != nil {
+		if order, err = event.Order(); err != nil {
 			log.Printf("Failed to unmarshal order: %v\n", err)
 			return err
 		}
@@ -77,25 +102,49 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 
 		// Enforce order idempotence
 		// idea is that order ids are unique, but they are embedded in the order object
-		// using an in memory store, but would want a real db for this
-		if db.Exists(uniqueKey) {
+		// the store is in memory unless DB_BACKEND selects a persistent one
+		// Claiming the key checks and records it in one step, so concurrent
+		// deliveries of the same order can't both pass
+		claimed, err := db.AddIfAbsent(uniqueKey)
+		if err != nil {
+			log.Printf("Failed to record %s: %v\n", uniqueKey, err)
+			return err
+		}
+		if !claimed {
 			logString := fmt.Sprintf("Notification %s is a duplicate", uniqueKey)
-			return errors.HandleError(context, event, producers.ErrorProducer, logString)
+			return errors.HandleDuplicate(ctx, event, producers.ErrorProducer, logString)
 		}
-		db.Add(uniqueKey)
+		// Release the claim if this attempt is retried or its transaction
+		// aborts, so the redelivery isn't mistaken for a duplicate
+		kafka.OnAbort(ctx, func() {
+			if err := db.Delete(uniqueKey); err != nil {
+				log.Printf("Failed to release %s: %v\n", uniqueKey, err)
+			}
+		})
 		log.Printf("Notification %s is unique\n", uniqueKey)
 
+		// Skip orders cancelled before pick & pack starts
+		cancelled, err := db.Exists(cancelledKey(order.OrderID))
+		if err != nil {
+			log.Printf("Failed to look up cancellation of %s: %v\n", order.OrderID, err)
+			return err
+		}
+		if cancelled {
+			log.Printf("Order %s was cancelled, skipping pick & pack\n", order.OrderID)
+			return nil
+		}
+
 		// Create a Notification event
 		notification := events.NewNotification(events.OrderFulfilled, order)
 		notificationEvent, err := notification.ToEvent()
 
 		if err != nil {
-			return errors.HandleError(context, event, producers.ErrorProducer, "Failed to create Notification event")
+			return errors.HandleError(ctx, event, producers.ErrorProducer, "Failed to create Notification event")
 
 		}
 
 		// Publish the Notification event to Kafka
-		if err := producers.NotificationProducer.Publish(context, notificationEvent); err != nil {
+		if err := producers.NotificationProducer.Publish(ctx, notificationEvent); err != nil {
 			log.Printf("Failed to produce Notification event: %v\n", err)
 			return fmt.Errorf("Failed to produce Notification event: %v", err)
 		}
@@ -103,10 +152,21 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 		// Simulate the OrderPickedPacked event
 		time.Sleep(8 * time.Second)
 
+		// Abort orders cancelled while they were being picked & packed, so
+		// they don't reach the shipper
+		if cancelled, err = db.Exists(cancelledKey(order.OrderID)); err != nil {
+			log.Printf("Failed to look up cancellation of %s: %v\n", order.OrderID, err)
+			return err
+		}
+		if cancelled {
+			log.Printf("Order %s was cancelled, aborting pick & pack\n", order.OrderID)
+			return nil
+		}
+
 		// Publish the OrderPickedPacked event to Kafka
-		pickedPackedEvent := events.NewEvent(events.OrderPickedPacked, event.EventBody)
+		pickedPackedEvent := events.NewEventFrom(events.OrderPickedPacked, event)
 
-		if err := producers.OrderPickedPacked.Publish(context, pickedPackedEvent); err != nil {
+		if err := producers.OrderPickedPacked.Publish(ctx, pickedPackedEvent); err != nil {
 			log.Printf("Failed to produce Notification event: %v\n", err)
 			return fmt.Errorf("Failed to produce Notification event: %v", err)
 		}
@@ -115,6 +175,61 @@ func ProcessMessageWrapper(db *db.SimpleDatabase, producers *KafkaProducers) fun
 	}
 }
 
+// CancelMessageWrapper records cancelled orders, which ProcessMessageWrapper
+// then skips, and accepts the cancellation; an order already handed to the
+// shipper is the shipper's to stop, and inventory confirms the cancellation
+// only once the shipper has accepted it too
+func CancelMessageWrapper(db db.Store, producers *KafkaProducers) kafka.Handler {
+	return func(ctx context.Context, msg *kafka.Message) error {
+		var event *events.Event
+		var cancellation *events.Cancellation
+		var err error
+
+		// Unmarshal the event
+		if event, err = events.NewEventFromBytes(msg.Value); err != nil {
+			log.Printf("Failed to unmarshal event: %v\n", err)
+			return kafka.Handled(err)
+		}
+		if event.EventName != events.OrderStatus[events.OrderCancelled] {
+			return nil
+		}
+		// Unmarshal the cancellation
+		if cancellation, err = event.Cancellation(); err != nil {
+			log.Printf("Failed to unmarshal cancellation: %v\n", err)
+			return kafka.Handled(err)
+		}
+
+		if err := db.Add(cancelledKey(cancellation.OrderID)); err != nil {
+			log.Printf("Failed to record cancellation of %s: %v\n", cancellation.OrderID, err)
+			return err
+		}
+		log.Printf("Order %s cancelled\n", cancellation.OrderID)
+
+		// Accept only once the cancellation is recorded; a redelivered
+		// cancellation is accepted again
+		replyEvent, err := events.NewCancellationReplyEvent(&events.CancellationReply{
+			OrderID:  cancellation.OrderID,
+			Service:  "warehouse",
+			Request:  event.EventName,
+			Accepted: true,
+		})
+		if err != nil {
+			log.Printf("Failed to create CancellationAnswered event: %v\n", err)
+			return err
+		}
+		if err := producers.ReplyProducer.Publish(ctx, replyEvent); err != nil {
+			log.Printf("Failed to produce CancellationAnswered event: %v\n", err)
+			return fmt.Errorf("Failed to produce CancellationAnswered event: %v", err)
+		}
+		return nil
+	}
+}
+
+// cancelledKey is the store key recording that an order was cancelled
+func cancelledKey(orderID string) string {
+	return "cancelled:" + orderID
+}
+
 func main() {
 	// Load configuration
 	var cfg Config
@@ -122,41 +237,116 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Create "database" for in-memory idempotence check
-	db := db.NewSimpleDatabase()
+	// Read and write events in the configured format
+	serializer, err := kafka.NewSerializer(cfg.SerializerConfig)
+	if err != nil {
+		log.Fatalf("Failed to set up the event serializer: %v", err)
+	}
+
+	// Load the event schemas used to validate published and consumed events
+	validator, err := schemas.Default()
+	if err != nil {
+		log.Fatalf("Failed to load event schemas: %v", err)
+	}
+
+	// Open the store of processed orders used for the idempotence check
+	db, err := db.Open(cfg.StoreBackend, cfg.StorePath, db.WithKeyPrefix("warehouse:"), db.WithTTL(cfg.StoreTTL))
+	if err != nil {
+		log.Fatalf("Failed to open store: %v", err)
+	}
 
 	// Create Kafka producers
 	producers := KafkaProducers{
 		NotificationProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.OrderNotificationTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderNotificationTopic,
+			Validator:  validator,
+			Source:     "warehouse",
 		}),
 		ErrorProducer: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.ErrorTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.ErrorTopic,
+			Validator:  validator,
+			Source:     "warehouse",
 		}),
 		OrderPickedPacked: kafka.NewProducer(kafka.KafkaConfig{
-			Brokers: []string{cfg.Broker},
-			Topic:   cfg.OrderPickedPackedTopic,
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.OrderPickedPackedTopic,
+			Validator:  validator,
+			Source:     "warehouse",
+		}),
+		ReplyProducer: kafka.NewProducer(kafka.KafkaConfig{
+			Brokers:    []string{cfg.Broker},
+			Serializer: serializer,
+			Topic:      cfg.CancellationReplyTopic,
+			Validator:  validator,
+			Source:     "warehouse",
 		}),
 	}
-	defer producers.NotificationProducer.Close()
-	defer producers.ErrorProducer.Close()
 
 	// Define Kafka configuration
 	kafkaConfigConsumer := kafka.KafkaConfig{
-		Brokers: []string{cfg.Broker},
-		Topic:   cfg.OrderConfirmedTopic,
-		GroupID: "warehouse-group",
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderConfirmedTopic,
+		GroupID:    "warehouse-group",
+		// Commit only after the order has been processed so a crash mid-handler
+		// redelivers it instead of dropping it
+		ManualCommit: true,
+		// Pick and pack several orders at once so one slow order doesn't hold up the topic
+		Workers: cfg.Workers,
+		Retry: kafka.RetryPolicy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+		DeadLetterTopic: cfg.DeadLetterTopic,
+		TransactionalID: cfg.TransactionalID,
 	}
 
-	// Create KafkaConsumer instance
-	consumer := kafka.NewConsumer(kafkaConfigConsumer)
-	defer consumer.Close()
+	// Create the consumer; with a transactional ID, the events published for
+	// an order are committed atomically with its offset
+	var consumer kafka.Consumer
+	if cfg.TransactionalID != "" {
+		if consumer, err = kafka.NewTransactionalConsumer(kafkaConfigConsumer); err != nil {
+			log.Fatalf("Failed to create transactional consumer: %v", err)
+		}
+	} else {
+		consumer = kafka.NewConsumer(kafkaConfigConsumer)
+	}
 
-	// Set up a context with cancellation
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// Consumer of cancellations, in its own group as it reads another topic
+	cancelConsumer := kafka.NewConsumer(kafka.KafkaConfig{
+		Brokers:    []string{cfg.Broker},
+		Serializer: serializer,
+		Topic:      cfg.OrderCancelledTopic,
+		GroupID:    "warehouse-cancel-group",
+		// Commit only once the cancellation is recorded and answered, retrying
+		// until it is: a cancellation lost here would never be confirmed
+		ManualCommit: true,
+		Retry: kafka.RetryPolicy{
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+			Jitter:         0.2,
+		},
+	})
+
+	// Coordinate shutdown on SIGINT/SIGTERM or a /shutdown request
+	coordinator := shutdown.New(cfg.ShutdownTimeout)
+
+	// Trace the handling of each order; registered first so spans are flushed last
+	shutdownTracing, err := tracing.Init(context.Background(), "warehouse", cfg.TracesExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	coordinator.OnShutdown("Tracing", shutdownTracing)
+	coordinator.OnShutdown("Database", func(context.Context) error {
+		return db.Close()
+	})
 
 	// Start REST server in a goroutine
 	router := gin.Default()
@@ -169,33 +359,45 @@ func main() {
 	// /shutdown endpoint
 	router.POST("/shutdown", func(c *gin.Context) {
 		log.Println("Shutdown request received")
-		cancel() // Signal the Kafka consumer to stop
+		coordinator.Cancel() // Signal the Kafka consumer to stop
 		c.String(http.StatusOK, "Shutting down")
 	})
 
-	// Start the REST server
-	go func() {
-		if err := router.Run(":8080"); err != nil {
-			log.Fatalf("Failed to start REST server: %v\n", err)
-		}
-	}()
-
-	// Handle graceful shutdown signals
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		log.Println("Received shutdown signal")
-		cancel()
-	}()
+	// Start the REST server. Shutdown hooks run in reverse order once the
+	// consumer has finished its current message: producers are flushed, the
+	// consumer is closed and the REST server stops last.
+	coordinator.Serve(&http.Server{Addr: ":8080", Handler: router})
+	coordinator.OnShutdown("Kafka consumer", func(context.Context) error {
+		return consumer.Close()
+	})
+	coordinator.OnShutdown("Cancel consumer", func(context.Context) error {
+		return cancelConsumer.Close()
+	})
+	coordinator.OnShutdown("NotificationProducer", func(context.Context) error {
+		return producers.NotificationProducer.Close()
+	})
+	coordinator.OnShutdown("ErrorProducer", func(context.Context) error {
+		return producers.ErrorProducer.Close()
+	})
+	coordinator.OnShutdown("OrderPickedPacked", func(context.Context) error {
+		return producers.OrderPickedPacked.Close()
+	})
+	coordinator.OnShutdown("ReplyProducer", func(context.Context) error {
+		return producers.ReplyProducer.Close()
+	})
 
 	// Start consuming Kafka messages
-	go func() {
+	coordinator.Go("Kafka consumer", func(ctx context.Context) {
 		log.Println("Starting Kafka consumer...")
-		consumer.Consume(ctx, ProcessMessageWrapper(db, &producers))
-	}()
+		consumer.Consume(ctx, ProcessMessageWrapper(db, validator, &producers))
+	})
+	coordinator.Go("Cancel consumer", func(ctx context.Context) {
+		cancelConsumer.Consume(ctx, CancelMessageWrapper(db, &producers))
+	})
 
-	// Wait for the context to be canceled (e.g., via /shutdown or signal)
-	<-ctx.Done()
-	log.Println("Service is shutting down...")
+	// Wait for the shutdown to be requested (e.g., via /shutdown or signal) and completed
+	if err := coordinator.Wait(); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v\n", err)
+	}
+	log.Println("Service has shut down")
 }